@@ -0,0 +1,155 @@
+/*
+Copyright 2017 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pusher/k8s-spot-rescheduler/nodes"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/autoscaler/cluster-autoscaler/simulator"
+	kube_utils "k8s.io/autoscaler/cluster-autoscaler/utils/kubernetes"
+	kube_client "k8s.io/client-go/kubernetes"
+)
+
+// How long a force drain request waits for the main loop to pick it up.
+const forceDrainQueueTimeout = 30 * time.Second
+
+// forceDrainRequest asks the main loop to drain a node straight away. The
+// result of planning the drain is sent back on the result channel.
+type forceDrainRequest struct {
+	node   string
+	result chan error
+}
+
+// Creates a handler for POST /drain?node=<name> which hands the node to the
+// main loop and reports whether a drain plan could be built for it.
+func newForceDrainHandler(secret string, requests chan<- forceDrainRequest) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		node := r.URL.Query().Get("node")
+		if node == "" {
+			http.Error(w, "node parameter is required", http.StatusBadRequest)
+			return
+		}
+
+		req := forceDrainRequest{node: node, result: make(chan error, 1)}
+		select {
+		case requests <- req:
+		case <-time.After(forceDrainQueueTimeout):
+			http.Error(w, "rescheduler is busy, try again later", http.StatusServiceUnavailable)
+			return
+		}
+
+		err, ok := <-req.result
+		if !ok {
+			http.Error(w, "failed to plan drain", http.StatusInternalServerError)
+			return
+		}
+		if err != nil {
+			glog.Infof("Force drain of node %s rejected: %v", node, err)
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		glog.Infof("Force drain of node %s accepted.", node)
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "draining node %s\n", node)
+	}
+}
+
+// Builds a drain plan for the named node using the current state of the
+// cluster. Returns an error explaining why the node can't be drained.
+func planForceDrain(kubeClient kube_client.Interface, predicateChecker *simulator.PredicateChecker, nodeLister kube_utils.NodeLister, pdbLister kube_utils.PodDisruptionBudgetLister, name string) (*drainPlan, error) {
+	node, err := kubeClient.CoreV1().Nodes().Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, fmt.Errorf("node %s not found", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get node %s: %v", name, err)
+	}
+	if !nodes.IsOnDemand(node) {
+		return nil, fmt.Errorf("node %s is not an on-demand node", name)
+	}
+	if err := checkNodeDrainable(node); err != nil {
+		return nil, err
+	}
+
+	allNodes, err := nodeLister.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nodes: %v", err)
+	}
+	spotNodes := make([]*apiv1.Node, 0, len(allNodes)+1)
+	for _, n := range allNodes {
+		if n.Name != name {
+			spotNodes = append(spotNodes, n)
+		}
+	}
+
+	nodeMap, err := nodes.NewNodeMap(kubeClient, append(spotNodes, node))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build node map: %v", err)
+	}
+	var nodeInfo *nodes.NodeInfo
+	for _, onDemandNodeInfo := range nodeMap[nodes.OnDemand] {
+		if onDemandNodeInfo.Node.Name == name {
+			nodeInfo = onDemandNodeInfo
+		}
+	}
+	if nodeInfo == nil {
+		return nil, fmt.Errorf("node %s not found in node map", name)
+	}
+
+	pdbs, err := pdbLister.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list PDBs: %v", err)
+	}
+
+	pods, err := getPodsForDeletion(nodeInfo, pdbs)
+	if err != nil {
+		return nil, err
+	}
+	if len(pods) < 1 {
+		return nil, fmt.Errorf("no pods to move on node %s", name)
+	}
+	if err := checkPodsDrainable(kubeClient, pods, nodeMap[nodes.Spot], pdbs); err != nil {
+		return nil, err
+	}
+	plan, err := buildDrainPlan(context.Background(), predicateChecker, nodeInfo, nodeMap[nodes.Spot], pods)
+	if err != nil && *consolidateOnDemand {
+		return buildConsolidationPlan(context.Background(), predicateChecker, nodeInfo, nodeMap[nodes.Spot], nodeMap[nodes.OnDemand], pods)
+	}
+	return plan, err
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2017 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kube_client "k8s.io/client-go/kubernetes"
+)
+
+// CooldownOverrideAnnotation skips the node drain delay until the RFC3339 time
+// it is set to on the cooldown override ConfigMap.
+const CooldownOverrideAnnotation = "spot-rescheduler.pusher.com/cooldown-override"
+
+// Works out until when the node drain delay is overridden by the annotation on
+// the named ConfigMap in the rescheduler's namespace. The zero time is
+// returned if no override is active.
+func cooldownOverrideUntil(kubeClient kube_client.Interface, configMapName string, now time.Time) (time.Time, error) {
+	if configMapName == "" {
+		return time.Time{}, nil
+	}
+
+	configMap, err := kubeClient.CoreV1().ConfigMaps(reschedulerNamespace).Get(configMapName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	value, ok := configMap.Annotations[CooldownOverrideAnnotation]
+	if !ok {
+		return time.Time{}, nil
+	}
+	until, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("annotation %s is not an RFC3339 time: %v", CooldownOverrideAnnotation, err)
+	}
+	if !now.Before(until) {
+		return time.Time{}, nil
+	}
+	return until, nil
+}
+
+// Checks whether the node drain delay is currently overridden, logging while
+// it is. The delay is kept if the override can't be checked.
+func cooldownOverridden(kubeClient kube_client.Interface, configMapName string) bool {
+	until, err := cooldownOverrideUntil(kubeClient, configMapName, time.Now())
+	if err != nil {
+		glog.Errorf("Failed to check configmap/%s for a cooldown override: %v", configMapName, err)
+		return false
+	}
+	if until.IsZero() {
+		return false
+	}
+	glog.Warningf("Drain delay overridden by %s until %s, draining without waiting.", CooldownOverrideAnnotation, until.Format(time.RFC3339))
+	return true
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2017 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/golang/glog"
+	"github.com/pusher/k8s-spot-rescheduler/nodes"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/autoscaler/cluster-autoscaler/simulator"
+)
+
+// globalPlanner plans drains for all of the on-demand nodes in a cycle against
+// a single model of the spot capacity. The pods of each node that is drained
+// are assigned in the model, so later plans account for them, and pods from
+// the same controller share the results of predicate checks.
+type globalPlanner struct {
+	predicateChecker *simulator.PredicateChecker
+	// spotNodeInfos models the spot nodes with the pods assigned so far.
+	spotNodeInfos nodes.NodeInfoArray
+	// unfit records the spot nodes that pods are known not to fit on in the
+	// model. Nodes only gain pods during a pass so these stay true.
+	unfit map[fitKey]bool
+}
+
+// fitKey identifies a group of similar pods and a spot node.
+type fitKey struct {
+	pods string
+	node string
+}
+
+// Creates a planner for a cycle from the spot nodes seen by it.
+func newGlobalPlanner(predicateChecker *simulator.PredicateChecker, spotNodeInfos nodes.NodeInfoArray) *globalPlanner {
+	return &globalPlanner{
+		predicateChecker: predicateChecker,
+		spotNodeInfos:    spotNodeInfos.CopyNodeInfos(),
+		unfit:            make(map[fitKey]bool),
+	}
+}
+
+// Builds a plan to move the pods onto the spot nodes in the model, returning
+// an error unless every pod fits, or some do when draining partially. The
+// model is left as it was, so candidates which are never drained don't take
+// capacity from each other, until the plan is kept.
+func (g *globalPlanner) plan(ctx context.Context, nodeInfo *nodes.NodeInfo, pods []*apiv1.Pod) (*drainPlan, error) {
+	plan := &drainPlan{
+		node:          nodeInfo,
+		pods:          make([]*apiv1.Pod, 0, len(pods)),
+		targets:       make(map[*apiv1.Pod]*nodes.NodeInfo),
+		spotNodeInfos: g.spotNodeInfos.CopyNodeInfos(),
+	}
+
+	// Results for nodes pods have been placed on in this plan don't hold for
+	// the model
+	unfit := make(map[fitKey]bool)
+	touched := make(map[string]bool)
+	defer func() {
+		for key := range unfit {
+			if !touched[key.node] {
+				g.unfit[key] = true
+			}
+		}
+	}()
+
+	targets := filterTargetNodes(plan.spotNodeInfos)
+	for _, pod := range sortByRequests(pods) {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("planning the drain of node %s was cut short: %v", nodeInfo.Node.Name, err)
+		}
+		if hasSchedulingGates(pod) {
+			if *allowPartialDrain {
+				plan.unplaced = append(plan.unplaced, pod)
+				continue
+			}
+			return nil, fmt.Errorf("pod %s has scheduling gates and can't be rescheduled", podID(pod))
+		}
+
+		group := podPlanningKey(pod)
+		candidates := make(nodes.NodeInfoArray, 0, len(targets))
+		for _, target := range targets {
+			key := fitKey{pods: group, node: target.Node.Name}
+			if !g.unfit[key] && !unfit[key] {
+				candidates = append(candidates, target)
+			}
+		}
+
+		targetNodeInfo := findSpotNodeForPod(g.predicateChecker, candidates, pod)
+		// Candidates before the one chosen were passed over as the pod doesn't
+		// fit on them, unless every candidate was compared
+		if targetNodeInfo == nil || *packingStrategy == packingStrategyFirstFit {
+			for _, candidate := range candidates {
+				if candidate == targetNodeInfo {
+					break
+				}
+				unfit[fitKey{pods: group, node: candidate.Node.Name}] = true
+			}
+		}
+		if targetNodeInfo == nil && *allowPartialDrain {
+			glog.V(4).Infof("Leaving pod %s on %s, it can't be rescheduled on any existing spot node", podID(pod), nodeInfo.Node.Name)
+			plan.unplaced = append(plan.unplaced, pod)
+			continue
+		}
+		if targetNodeInfo == nil {
+			return nil, fmt.Errorf("pod %s can't be rescheduled on any existing spot node", podID(pod))
+		}
+		glog.V(4).Infof("Pod %s can be rescheduled on %v, adding to plan.", podID(pod), targetNodeInfo.Node.ObjectMeta.Name)
+		targetNodeInfo.AddPod(pod)
+		plan.targets[pod] = targetNodeInfo
+		plan.pods = append(plan.pods, pod)
+		touched[targetNodeInfo.Node.Name] = true
+	}
+	if len(plan.pods) == 0 && len(plan.unplaced) > 0 {
+		return nil, fmt.Errorf("none of the pods on node %s can be rescheduled on any existing spot node", nodeInfo.Node.Name)
+	}
+
+	return plan, nil
+}
+
+// Assigns the pods of a plan built by the planner in the model, once the
+// plan has been drained, so later plans account for them.
+func (g *globalPlanner) keep(plan *drainPlan) {
+	g.spotNodeInfos = plan.spotNodeInfos
+}
+
+// Works out the key pods are grouped by when sharing predicate results. Pods
+// with the same controller share a template, otherwise each pod is its own.
+func podPlanningKey(pod *apiv1.Pod) string {
+	if owner := metav1.GetControllerOf(pod); owner != nil && owner.UID != "" {
+		return string(owner.UID)
+	}
+	return podID(pod)
+}
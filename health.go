@@ -0,0 +1,71 @@
+/*
+Copyright 2017 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// loopHealth tracks when the main loop last finished a housekeeping cycle.
+type loopHealth struct {
+	mu   sync.Mutex
+	last time.Time
+	// busyUntil is when a drain in progress is expected to have finished.
+	busyUntil time.Time
+}
+
+// Records that the main loop has finished a housekeeping cycle, or started.
+func (h *loopHealth) beat(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.last = now
+}
+
+// Records that the main loop is draining a node, which may take until the
+// given time without being considered wedged.
+func (h *loopHealth) busy(until time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.busyUntil = until
+}
+
+// Determines if the main loop has finished a cycle within maxAge. A loop that
+// hasn't started, such as while waiting to become leader, is healthy.
+func (h *loopHealth) healthy(now time.Time, maxAge time.Duration) (bool, time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.last.IsZero() || now.Before(h.busyUntil) {
+		return true, h.last
+	}
+	return now.Sub(h.last) <= maxAge, h.last
+}
+
+// Serves 200 while the main loop is healthy and 500 otherwise, for use as a
+// liveness probe.
+func newHealthzHandler(health *loopHealth, maxAge time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, last := health.healthy(time.Now(), maxAge)
+		if !ok {
+			http.Error(w, fmt.Sprintf("housekeeping last finished at %s", last.Format(time.RFC3339)), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
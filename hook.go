@@ -0,0 +1,133 @@
+/*
+Copyright 2017 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"time"
+
+	"github.com/pusher/k8s-spot-rescheduler/metrics"
+)
+
+// preDrainHookRequest is sent to the pre-drain hook describing the drain.
+type preDrainHookRequest struct {
+	Node string `json:"node"`
+	// Pods maps each pod to be evicted to the spot node it should move to.
+	Pods map[string]string `json:"pods"`
+}
+
+// preDrainHookResponse is returned by the pre-drain hook URL to approve or
+// deny the drain, when approval is required.
+type preDrainHookResponse struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Runs the configured pre-drain hooks for the plan. Returns an error if any
+// hook rejects the drain or fails to run within the timeout.
+func runPreDrainHooks(plan *drainPlan, url string, requireAllow bool, command string, timeout time.Duration) error {
+	if url == "" && command == "" {
+		return nil
+	}
+
+	body, err := json.Marshal(newPreDrainHookRequest(plan))
+	if err != nil {
+		return fmt.Errorf("failed to encode pre-drain hook request: %v", err)
+	}
+
+	if url != "" {
+		err = callPreDrainHookURL(url, body, requireAllow, timeout)
+		metrics.UpdatePreDrainHook("url", err)
+		if err != nil {
+			return err
+		}
+	}
+	if command != "" {
+		err = execPreDrainHookCommand(command, body, timeout)
+		metrics.UpdatePreDrainHook("command", err)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newPreDrainHookRequest(plan *drainPlan) preDrainHookRequest {
+	req := preDrainHookRequest{
+		Node: plan.node.Node.Name,
+		Pods: make(map[string]string),
+	}
+	for _, pod := range plan.pods {
+		target := ""
+		if nodeInfo, ok := plan.targets[pod]; ok {
+			target = nodeInfo.Node.Name
+		}
+		req.Pods[podID(pod)] = target
+	}
+	return req
+}
+
+// POSTs the drain details to the hook URL, which must respond with 200 OK for
+// the drain to go ahead. When approval is required the response must also be
+// {"allow": true}, anything else, including a response which can't be
+// decoded, denies the drain.
+func callPreDrainHookURL(url string, body []byte, requireAllow bool, timeout time.Duration) error {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("pre-drain hook %s failed: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("pre-drain hook %s rejected the drain with status %s", url, resp.Status)
+	}
+	if !requireAllow {
+		return nil
+	}
+	var review preDrainHookResponse
+	if err := json.NewDecoder(resp.Body).Decode(&review); err != nil {
+		return fmt.Errorf("pre-drain hook %s returned an invalid response: %v", url, err)
+	}
+	if !review.Allow {
+		if review.Reason != "" {
+			return fmt.Errorf("pre-drain hook %s denied the drain: %s", url, review.Reason)
+		}
+		return fmt.Errorf("pre-drain hook %s denied the drain", url)
+	}
+	return nil
+}
+
+// Runs the hook command with the drain details on stdin, which must exit
+// successfully for the drain to go ahead.
+func execPreDrainHookCommand(command string, body []byte, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, command)
+	cmd.Stdin = bytes.NewReader(body)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("pre-drain hook %s rejected the drain: %v: %s", command, err, bytes.TrimSpace(output))
+	}
+	return nil
+}
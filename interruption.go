@@ -0,0 +1,131 @@
+/*
+Copyright 2017 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pusher/k8s-spot-rescheduler/metrics"
+	"github.com/pusher/k8s-spot-rescheduler/nodes"
+	"github.com/pusher/k8s-spot-rescheduler/scaler"
+	apiv1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1beta1"
+	simulator "k8s.io/autoscaler/cluster-autoscaler/simulator"
+	kube_client "k8s.io/client-go/kubernetes"
+	kube_record "k8s.io/client-go/tools/record"
+)
+
+// Evacuates the spot nodes which have been given an interruption notice,
+// moving their pods onto the other spot nodes or back onto on-demand nodes
+// before the instances are terminated. Returns whether pods were evicted.
+func evacuateInterruptedNodes(ctx context.Context, kubeClient kube_client.Interface, recorder kube_record.EventRecorder, predicateChecker *simulator.PredicateChecker, allNodes []*apiv1.Node, pdbs []*policyv1.PodDisruptionBudget) bool {
+	// Only build the node map when a node is being interrupted
+	interrupted := false
+	for _, node := range allNodes {
+		if nodes.IsSpot(node) && nodes.IsInterrupted(node) {
+			interrupted = true
+			break
+		}
+	}
+	if !interrupted {
+		return false
+	}
+
+	nodeMap, err := nodes.NewNodeMap(kubeClient, allNodes)
+	if err != nil {
+		glog.Errorf("Failed to build node map; %v", err)
+		return false
+	}
+	interruptedNodeInfos, spotNodeInfos := splitInterruptedNodes(nodeMap[nodes.Spot])
+	onDemandNodeInfos := nodeMap[nodes.OnDemand]
+
+	evacuated := false
+	for _, nodeInfo := range interruptedNodeInfos {
+		pods, err := getPodsForDeletion(nodeInfo, pdbs)
+		if err != nil {
+			glog.Errorf("Failed to get pods for consideration on interrupted spot node %s: %v", nodeInfo.Node.Name, err)
+			continue
+		}
+		if len(pods) < 1 {
+			dedupLog.Infof(2, "No pods on interrupted spot node %s, skipping.", nodeInfo.Node.Name)
+			continue
+		}
+
+		// The node is going away whether or not its pods fit elsewhere, so
+		// they are evicted anyway, leaving any which don't fit pending
+		plan, err := buildConsolidationPlan(ctx, predicateChecker, nodeInfo, spotNodeInfos, onDemandNodeInfos, pods)
+		if err != nil {
+			glog.Warningf("Not all pods on interrupted spot node %s can be moved, evicting them anyway: %v", nodeInfo.Node.Name, err)
+		} else {
+			// Later nodes are planned against the capacity this one used
+			spotNodeInfos, onDemandNodeInfos = plan.spotNodeInfos, plan.onDemandNodeInfos
+		}
+
+		if *dryRun {
+			if plan != nil {
+				logDryRun(plan)
+			} else {
+				glog.Infof("Dry run: would evacuate interrupted spot node %s, evicting %d pods.", nodeInfo.Node.Name, len(pods))
+			}
+			continue
+		}
+
+		glog.Infof("Spot node %s is being interrupted, evacuating %d pods.", nodeInfo.Node.Name, len(pods))
+		health.busy(time.Now().Add(drainDuration(len(pods)) + 2**housekeepingInterval))
+		err = evacuateNode(kubeClient, recorder, nodeInfo.Node, pods)
+		health.busy(time.Time{})
+		metrics.UpdateSpotInterruptionEvacuation(err)
+		if err != nil {
+			glog.Errorf("Failed to evacuate interrupted spot node %s: %v", nodeInfo.Node.Name, err)
+		}
+		evacuated = true
+	}
+	return evacuated
+}
+
+// Splits the spot nodes into those being interrupted and the rest.
+func splitInterruptedNodes(spotNodeInfos nodes.NodeInfoArray) (nodes.NodeInfoArray, nodes.NodeInfoArray) {
+	interrupted := make(nodes.NodeInfoArray, 0)
+	remaining := make(nodes.NodeInfoArray, 0, len(spotNodeInfos))
+	for _, nodeInfo := range spotNodeInfos {
+		if nodes.IsInterrupted(nodeInfo.Node) {
+			interrupted = append(interrupted, nodeInfo)
+			continue
+		}
+		remaining = append(remaining, nodeInfo)
+	}
+	return interrupted, remaining
+}
+
+// Cordons an interrupted spot node and evicts its pods. Unlike drainNode the
+// node is left cordoned, as it is about to be terminated.
+func evacuateNode(kubeClient kube_client.Interface, recorder kube_record.EventRecorder, node *apiv1.Node, pods []*apiv1.Pod) error {
+	if _, err := cordonNode(kubeClient, node); err != nil {
+		recorder.Eventf(node, apiv1.EventTypeWarning, "ReschedulerFailed", "failed to cordon the node: %v", err)
+		return err
+	}
+	recorder.Eventf(node, apiv1.EventTypeNormal, "ReschedulerEvacuating", "evacuating %d pods as the spot node is being interrupted", len(pods))
+
+	err := scaler.DrainNode(node, pods, kubeClient, recorder, int(maxGracefulTermination.Seconds()), *overrideGracePeriod, *podEvictionTimeout, *evictionRetryTime, nil)
+	if _, ok := err.(*scaler.ReplacementsNotReadyError); ok {
+		glog.Warningf("Evacuated spot node %s, but %v", node.Name, err)
+		return nil
+	}
+	return err
+}
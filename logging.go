@@ -0,0 +1,281 @@
+/*
+Copyright 2017 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	apiv1 "k8s.io/api/core/v1"
+	kube_record "k8s.io/client-go/tools/record"
+)
+
+const (
+	// logFormatText logs glog's text lines.
+	logFormatText = "text"
+	// logFormatJSON logs a JSON object per line.
+	logFormatJSON = "json"
+)
+
+// Validates the log format flag.
+func validateLogFormat(format string) error {
+	if format != logFormatText && format != logFormatJSON {
+		return fmt.Errorf("log format must be %s or %s, got %q", logFormatText, logFormatJSON, format)
+	}
+	return nil
+}
+
+// jsonLogger writes log lines as JSON objects with the level, time, message
+// and any key/value context.
+type jsonLogger struct {
+	mutex sync.Mutex
+	out   io.Writer
+	now   func() time.Time
+}
+
+// Sends everything glog writes to stderr through the JSON logger, which
+// writes to the original stderr. glog has no way of changing its format, so
+// its lines are read back from a pipe and converted.
+func startJSONLogging() (*jsonLogger, error) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	logger := &jsonLogger{out: os.Stderr, now: time.Now}
+	os.Stderr = writer
+
+	go func() {
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			logger.writeGlogLine(scanner.Text())
+		}
+	}()
+	return logger, nil
+}
+
+// Writes a log line with key/value context, given as alternating keys and
+// values.
+func (l *jsonLogger) log(level string, ts time.Time, msg string, keysAndValues ...interface{}) {
+	entry := map[string]interface{}{
+		"level": level,
+		"ts":    ts.Format(time.RFC3339Nano),
+		"msg":   msg,
+	}
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		value := keysAndValues[i+1]
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		entry[fmt.Sprint(keysAndValues[i])] = value
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		data, _ = json.Marshal(map[string]interface{}{"level": level, "ts": entry["ts"], "msg": msg})
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.out.Write(append(data, '\n'))
+}
+
+// Converts a line in glog's format, "Lmmdd hh:mm:ss.uuuuuu threadid
+// file:line] msg", to JSON. Lines without the header, such as the rest of a
+// stack trace, are logged as they are.
+func (l *jsonLogger) writeGlogLine(line string) {
+	now := l.now()
+	end := strings.Index(line, "] ")
+	levels := map[byte]string{'I': "info", 'W': "warning", 'E': "error", 'F': "fatal"}
+	level, ok := "", false
+	if len(line) > 0 {
+		level, ok = levels[line[0]]
+	}
+	if !ok || end < 0 || len(line) < 21 {
+		l.log("info", now, line)
+		return
+	}
+	ts, err := time.ParseInLocation("20060102 15:04:05.000000", fmt.Sprintf("%d%s", now.Year(), line[1:21]), now.Location())
+	if err != nil {
+		l.log("info", now, line)
+		return
+	}
+	fields := strings.Fields(line[21:end])
+	caller := ""
+	if len(fields) > 0 {
+		caller = fields[len(fields)-1]
+	}
+	l.log(level, ts, line[end+2:], "caller", caller)
+}
+
+// logs converts log lines to JSON, nil when logging text.
+var logs *jsonLogger
+
+// Logs the message at the given verbosity with key/value context, given as
+// alternating keys and values. Text lines have the context appended as
+// key=value pairs.
+func logInfo(level glog.Level, msg string, keysAndValues ...interface{}) {
+	if !glog.V(level) {
+		return
+	}
+	if logs != nil {
+		logs.log("info", time.Now(), msg, keysAndValues...)
+		return
+	}
+	glog.InfoDepth(1, formatKeysAndValues(msg, keysAndValues...))
+}
+
+// Logs the error message with key/value context, like logInfo.
+func logError(msg string, keysAndValues ...interface{}) {
+	if logs != nil {
+		logs.log("error", time.Now(), msg, keysAndValues...)
+		return
+	}
+	glog.ErrorDepth(1, formatKeysAndValues(msg, keysAndValues...))
+}
+
+// Appends the key/value context to the message as key=value pairs, quoting
+// values with spaces.
+func formatKeysAndValues(msg string, keysAndValues ...interface{}) string {
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		value := fmt.Sprint(keysAndValues[i+1])
+		if strings.ContainsAny(value, " \t\n\"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+		fmt.Fprintf(&b, " %v=%s", keysAndValues[i], value)
+	}
+	return b.String()
+}
+
+// dedupLogger collapses identical log messages, logging each message at most
+// once per window along with how many times it was repeated in between.
+type dedupLogger struct {
+	window  time.Duration
+	mutex   sync.Mutex
+	entries map[string]*dedupEntry
+	pruned  time.Time
+}
+
+type dedupEntry struct {
+	logged   time.Time
+	repeated int
+}
+
+func newDedupLogger(window time.Duration) *dedupLogger {
+	return &dedupLogger{
+		window:  window,
+		entries: make(map[string]*dedupEntry),
+	}
+}
+
+// Infof logs the message at the given verbosity unless it was already logged
+// within the window.
+func (d *dedupLogger) Infof(level glog.Level, format string, args ...interface{}) {
+	if !glog.V(level) {
+		return
+	}
+	if msg, ok := d.filter(fmt.Sprintf(format, args...), time.Now()); ok {
+		glog.InfoDepth(1, msg)
+	}
+}
+
+// Infow logs the message with key/value context like logInfo, unless the same
+// message and context was already logged within the window.
+func (d *dedupLogger) Infow(level glog.Level, msg string, keysAndValues ...interface{}) {
+	if !glog.V(level) {
+		return
+	}
+	repeated, ok := d.check(formatKeysAndValues(msg, keysAndValues...), time.Now())
+	if !ok {
+		return
+	}
+	if repeated > 0 {
+		keysAndValues = append(keysAndValues, "repeated", repeated)
+	}
+	logInfo(level, msg, keysAndValues...)
+}
+
+// Errorf logs the error message unless it was already logged within the window.
+func (d *dedupLogger) Errorf(format string, args ...interface{}) {
+	if msg, ok := d.filter(fmt.Sprintf(format, args...), time.Now()); ok {
+		glog.ErrorDepth(1, msg)
+	}
+}
+
+// Eventf records the event on the node unless the same event was recorded on
+// it within the window.
+func (d *dedupLogger) Eventf(recorder kube_record.EventRecorder, node *apiv1.Node, eventType string, reason string, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if _, ok := d.filter(fmt.Sprintf("event %s on %s: %s", reason, node.Name, msg), time.Now()); ok {
+		recorder.Event(node, eventType, reason, msg)
+	}
+}
+
+// Determines whether the message should be logged, returning it with the
+// number of times it was suppressed since it was last logged.
+func (d *dedupLogger) filter(msg string, now time.Time) (string, bool) {
+	repeated, ok := d.check(msg, now)
+	if ok && repeated > 0 {
+		msg = fmt.Sprintf("%s (repeated %d times)", msg, repeated)
+	}
+	return msg, ok
+}
+
+// Determines whether the message should be logged, returning the number of
+// times it was suppressed since it was last logged. A nil logger logs every
+// message.
+func (d *dedupLogger) check(msg string, now time.Time) (int, bool) {
+	if d == nil || d.window <= 0 {
+		return 0, true
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	// Forget messages which haven't been seen for a while
+	if now.Sub(d.pruned) > d.window {
+		for key, entry := range d.entries {
+			if now.Sub(entry.logged) > d.window {
+				delete(d.entries, key)
+			}
+		}
+		d.pruned = now
+	}
+
+	entry, ok := d.entries[msg]
+	if !ok {
+		d.entries[msg] = &dedupEntry{logged: now}
+		return 0, true
+	}
+	if now.Sub(entry.logged) < d.window {
+		entry.repeated++
+		return 0, false
+	}
+
+	repeated := entry.repeated
+	entry.logged = now
+	entry.repeated = 0
+	return repeated, true
+}
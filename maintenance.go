@@ -0,0 +1,106 @@
+/*
+Copyright 2017 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/pusher/k8s-spot-rescheduler/metrics"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kube_client "k8s.io/client-go/kubernetes"
+)
+
+const (
+	// MaintenanceAnnotation pauses all draining when set to "true" on the
+	// maintenance resource.
+	MaintenanceAnnotation = "spot-rescheduler.pusher.com/maintenance"
+
+	maintenanceKindConfigMap = "configmap"
+	maintenanceKindNamespace = "namespace"
+)
+
+// maintenanceResource identifies the object checked for the maintenance
+// annotation.
+type maintenanceResource struct {
+	kind string
+	name string
+}
+
+// Parses a maintenance resource of the form configmap/<name> or
+// namespace/<name>. An empty resource returns nil, disabling the check.
+func parseMaintenanceResource(resource string) (*maintenanceResource, error) {
+	if resource == "" {
+		return nil, nil
+	}
+
+	parts := strings.SplitN(resource, "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("the maintenance resource is not valid: expected %s/<name> or %s/<name>, but got %s", maintenanceKindConfigMap, maintenanceKindNamespace, resource)
+	}
+	kind := strings.ToLower(parts[0])
+	if kind != maintenanceKindConfigMap && kind != maintenanceKindNamespace {
+		return nil, fmt.Errorf("the maintenance resource is not valid: expected %s/<name> or %s/<name>, but got %s", maintenanceKindConfigMap, maintenanceKindNamespace, resource)
+	}
+	return &maintenanceResource{kind: kind, name: parts[1]}, nil
+}
+
+// Determines if the maintenance resource has the maintenance annotation set.
+// ConfigMaps are looked up in the rescheduler's namespace. A missing resource
+// is not in maintenance.
+func inMaintenance(kubeClient kube_client.Interface, resource *maintenanceResource) (bool, error) {
+	if resource == nil {
+		return false, nil
+	}
+
+	var meta metav1.ObjectMeta
+	switch resource.kind {
+	case maintenanceKindConfigMap:
+		configMap, err := kubeClient.CoreV1().ConfigMaps(reschedulerNamespace).Get(resource.name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		meta = configMap.ObjectMeta
+	case maintenanceKindNamespace:
+		namespace, err := kubeClient.CoreV1().Namespaces().Get(resource.name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		meta = namespace.ObjectMeta
+	}
+	return meta.Annotations[MaintenanceAnnotation] == "true", nil
+}
+
+// Checks whether draining is paused by the maintenance annotation and updates
+// the metrics system. Draining is also paused if the resource can't be checked.
+func maintenancePaused(kubeClient kube_client.Interface, resource *maintenanceResource) bool {
+	paused, err := inMaintenance(kubeClient, resource)
+	if err != nil {
+		glog.Errorf("Failed to check %s/%s for maintenance: %v", resource.kind, resource.name, err)
+		paused = true
+	}
+	metrics.UpdateMaintenance(paused)
+	return paused
+}
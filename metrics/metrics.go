@@ -17,6 +17,8 @@ limitations under the License.
 package metrics
 
 import (
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/pusher/k8s-spot-rescheduler/nodes"
 )
@@ -50,7 +52,287 @@ var (
 			Namespace: reschedulerNamespace,
 			Name:      "node_drain_total",
 			Help:      "Number of nodes drained by rescheduler.",
-		}, []string{"drain_state", "node"},
+		}, []string{"drain_state", "reason", "node"},
+	)
+
+	// instanceTypeDrainCount counts the nodes drained by instance type.
+	instanceTypeDrainCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: reschedulerNamespace,
+			Name:      "instance_type_drain_total",
+			Help:      "Number of nodes drained by rescheduler for each instance type.",
+		}, []string{"drain_state", "instance_type"},
+	)
+
+	// reclaimedCPU counts the allocatable CPU of nodes drained successfully.
+	reclaimedCPU = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: reschedulerNamespace,
+			Name:      "reclaimed_cpu_cores_total",
+			Help:      "Allocatable CPU cores of the nodes drained successfully by rescheduler.",
+		},
+	)
+
+	// reclaimedMemory counts the allocatable memory of nodes drained successfully.
+	reclaimedMemory = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: reschedulerNamespace,
+			Name:      "reclaimed_memory_gib_total",
+			Help:      "Allocatable memory in GiB of the nodes drained successfully by rescheduler.",
+		},
+	)
+
+	// drainSkippedNodesCount tracks the number of nodes that are no longer
+	// drained after repeatedly failing.
+	drainSkippedNodesCount = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: reschedulerNamespace,
+			Name:      "drain_skipped_nodes_count",
+			Help:      "Number of nodes skipped after exceeding the maximum drain attempts.",
+		},
+	)
+
+	// topologyStabilizing tracks whether draining is paused while the cluster
+	// topology stabilises.
+	topologyStabilizing = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: reschedulerNamespace,
+			Name:      "topology_stabilizing",
+			Help:      "Whether draining is paused waiting for the cluster topology to stabilise.",
+		},
+	)
+
+	// nodeMapBuildDuration tracks how long building the nodes map takes.
+	nodeMapBuildDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: reschedulerNamespace,
+			Name:      "node_map_build_seconds",
+			Help:      "Time taken to build the nodes map.",
+			Buckets:   prometheus.ExponentialBuckets(0.05, 2, 12),
+		},
+	)
+
+	// zoneDrainCount counts the number of nodes drained in each zone.
+	zoneDrainCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: reschedulerNamespace,
+			Name:      "zone_drain_total",
+			Help:      "Number of nodes drained by rescheduler in each zone.",
+		}, []string{"zone"},
+	)
+
+	// movablePodsCount tracks the number of pods on on-demand nodes which could
+	// be moved.
+	movablePodsCount = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: reschedulerNamespace,
+			Name:      "movable_pods_count",
+			Help:      "Number of pods on on-demand nodes which could be moved.",
+		},
+	)
+
+	// minNodesEstimate tracks the lower bound on nodes needed to host the pods.
+	minNodesEstimate = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: reschedulerNamespace,
+			Name:      "min_nodes_estimate",
+			Help:      "Lower bound on the number of nodes needed to host the pods, based on CPU requests.",
+		},
+	)
+
+	// panicsCount counts the panics recovered from in the main loop.
+	panicsCount = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: reschedulerNamespace,
+			Name:      "panics_total",
+			Help:      "Number of panics recovered from in the main loop.",
+		},
+	)
+
+	// unmatchedNodeLabels tracks whether no nodes match a node type's label.
+	unmatchedNodeLabels = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: reschedulerNamespace,
+			Name:      "unmatched_node_labels",
+			Help:      "Whether no nodes match the label for the node type, 1 if none match.",
+		},
+		[]string{"node_type"},
+	)
+
+	// maintenance tracks whether draining is paused for maintenance.
+	maintenance = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: reschedulerNamespace,
+			Name:      "maintenance",
+			Help:      "Whether draining is paused by the maintenance annotation, 1 if paused.",
+		},
+	)
+
+	// predicateRefreshFailures counts failed predicate checker refreshes.
+	predicateRefreshFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: reschedulerNamespace,
+			Name:      "predicate_refresh_failures_total",
+			Help:      "Number of times rebuilding the predicate checker failed.",
+		},
+	)
+
+	// predicatesStale tracks whether the last predicate checker refresh failed.
+	predicatesStale = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: reschedulerNamespace,
+			Name:      "predicates_stale",
+			Help:      "Whether the last predicate checker refresh failed, 1 if it failed.",
+		},
+	)
+
+	// drainsDeferredCooldown counts drains found while waiting for the drain delay.
+	drainsDeferredCooldown = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: reschedulerNamespace,
+			Name:      "drains_deferred_cooldown_total",
+			Help:      "Number of times a node could be drained but the drain delay prevented it.",
+		},
+	)
+
+	// podEvictionDuration tracks how long pods take to go after being evicted.
+	podEvictionDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: reschedulerNamespace,
+			Name:      "pod_eviction_duration_seconds",
+			Help:      "Time taken from a pod being evicted to it being gone from the node.",
+			Buckets:   []float64{1, 5, 10, 30, 60, 120, 300, 600},
+		},
+		[]string{"owner_kind"},
+	)
+
+	// inflightEvictions tracks the number of evictions currently in progress.
+	inflightEvictions = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: reschedulerNamespace,
+			Name:      "inflight_evictions",
+			Help:      "Number of pod evictions currently in progress across all drains.",
+		},
+	)
+
+	// labelDriftDetected counts drains skipped because target nodes were reclassified.
+	labelDriftDetected = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: reschedulerNamespace,
+			Name:      "label_drift_detected_total",
+			Help:      "Number of drains skipped because target nodes were removed or reclassified after planning.",
+		},
+	)
+
+	// publishDropped counts drain events dropped because the publish buffer was full.
+	publishDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: reschedulerNamespace,
+			Name:      "published_events_dropped_total",
+			Help:      "Number of drain events dropped because the publish buffer was full.",
+		},
+	)
+
+	// podsMovedCount counts the pods evicted from each node.
+	podsMovedCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: reschedulerNamespace,
+			Name:      "pods_moved_total",
+			Help:      "Number of pods evicted by rescheduler from each node.",
+		}, []string{"node"},
+	)
+
+	// planBuildDuration tracks how long building the drain plan for a node takes.
+	planBuildDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: reschedulerNamespace,
+			Name:      "plan_build_seconds",
+			Help:      "Time taken to build the drain plan for an on-demand node.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+		},
+	)
+
+	// estimatedHourlySavings sums the estimated hourly savings of the nodes
+	// drained successfully.
+	estimatedHourlySavings = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: reschedulerNamespace,
+			Name:      "estimated_hourly_savings",
+			Help:      "Estimated hourly savings of the on-demand nodes drained successfully, from the price map.",
+		}, []string{"instance_type"},
+	)
+
+	// nodeCordonCount counts cordon and uncordon attempts and their results.
+	nodeCordonCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: reschedulerNamespace,
+			Name:      "node_cordon_total",
+			Help:      "Number of nodes cordoned and uncordoned by rescheduler.",
+		}, []string{"action", "result"},
+	)
+
+	// cordonedNodes tracks the nodes currently cordoned by the rescheduler.
+	cordonedNodes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: reschedulerNamespace,
+			Name:      "cordoned_nodes",
+			Help:      "Number of nodes currently cordoned by rescheduler.",
+		},
+	)
+
+	// preDrainHookCount counts pre-drain hook calls by hook and outcome.
+	preDrainHookCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: reschedulerNamespace,
+			Name:      "pre_drain_hook_total",
+			Help:      "Number of drains allowed or denied by each pre-drain hook.",
+		}, []string{"hook", "result"},
+	)
+
+	// replacementsNotReadyCount counts drains whose evicted pods weren't
+	// replaced in time.
+	replacementsNotReadyCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: reschedulerNamespace,
+			Name:      "replacements_not_ready_total",
+			Help:      "Number of drains after which the evicted pods' controllers didn't have Ready replacements in time.",
+		}, []string{"node"},
+	)
+
+	// spotInterruptionEvacuations counts evacuations of interrupted spot nodes.
+	spotInterruptionEvacuations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: reschedulerNamespace,
+			Name:      "spot_interruption_evacuations_total",
+			Help:      "Number of spot nodes evacuated after being given an interruption notice.",
+		}, []string{"result"},
+	)
+
+	// buildInfo is always 1, labelled with the running build.
+	buildInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: reschedulerNamespace,
+			Name:      "build_info",
+			Help:      "Always 1, labelled with the version and commit of the running build.",
+		}, []string{"version", "commit"},
+	)
+
+	// nextDrainSeconds is how long until the drain delay allows the next drain.
+	nextDrainSeconds = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: reschedulerNamespace,
+			Name:      "next_drain_seconds",
+			Help:      "Seconds until the node drain delay allows the next drain, 0 when a drain is allowed.",
+		},
+	)
+
+	// lastDrainTimestamp is when a node was last drained successfully.
+	lastDrainTimestamp = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: reschedulerNamespace,
+			Name:      "last_drain_timestamp_seconds",
+			Help:      "Unix time of the last successful drain.",
+		},
 	)
 
 	// evictionsCount counts the number of pods evicted by the rescheduler
@@ -67,7 +349,37 @@ func init() {
 	prometheus.MustRegister(nodePodsCount)
 	prometheus.MustRegister(nodesCount)
 	prometheus.MustRegister(nodeDrainCount)
+	prometheus.MustRegister(instanceTypeDrainCount)
+	prometheus.MustRegister(reclaimedCPU)
+	prometheus.MustRegister(reclaimedMemory)
 	prometheus.MustRegister(evictionsCount)
+	prometheus.MustRegister(drainSkippedNodesCount)
+	prometheus.MustRegister(topologyStabilizing)
+	prometheus.MustRegister(nodeMapBuildDuration)
+	prometheus.MustRegister(zoneDrainCount)
+	prometheus.MustRegister(movablePodsCount)
+	prometheus.MustRegister(minNodesEstimate)
+	prometheus.MustRegister(panicsCount)
+	prometheus.MustRegister(unmatchedNodeLabels)
+	prometheus.MustRegister(maintenance)
+	prometheus.MustRegister(predicateRefreshFailures)
+	prometheus.MustRegister(predicatesStale)
+	prometheus.MustRegister(drainsDeferredCooldown)
+	prometheus.MustRegister(podEvictionDuration)
+	prometheus.MustRegister(inflightEvictions)
+	prometheus.MustRegister(labelDriftDetected)
+	prometheus.MustRegister(publishDropped)
+	prometheus.MustRegister(nodeCordonCount)
+	prometheus.MustRegister(estimatedHourlySavings)
+	prometheus.MustRegister(podsMovedCount)
+	prometheus.MustRegister(planBuildDuration)
+	prometheus.MustRegister(cordonedNodes)
+	prometheus.MustRegister(preDrainHookCount)
+	prometheus.MustRegister(replacementsNotReadyCount)
+	prometheus.MustRegister(spotInterruptionEvacuations)
+	prometheus.MustRegister(buildInfo)
+	prometheus.MustRegister(nextDrainSeconds)
+	prometheus.MustRegister(lastDrainTimestamp)
 }
 
 // UpdateNodesMap updates the metrics calculated by the nodes map
@@ -90,7 +402,182 @@ func UpdateEvictionsCount() {
 	evictionsCount.Add(1)
 }
 
-// UpdateNodeDrainCount updates the number drains and drain state for a node
-func UpdateNodeDrainCount(state string, nodeName string) {
-	nodeDrainCount.WithLabelValues(state, nodeName).Add(1)
+// UpdateNodeDrainCount updates the number drains and drain state for a node,
+// with the reason for failed drains
+func UpdateNodeDrainCount(state string, reason string, nodeName string) {
+	nodeDrainCount.WithLabelValues(state, reason, nodeName).Add(1)
+}
+
+// UpdateInstanceTypeDrainCount records a node drain for the instance type
+func UpdateInstanceTypeDrainCount(state string, instanceType string) {
+	instanceTypeDrainCount.WithLabelValues(state, instanceType).Add(1)
+}
+
+// UpdateReclaimedResources adds the allocatable resources of a drained node
+func UpdateReclaimedResources(cpuCores float64, memoryGiB float64) {
+	reclaimedCPU.Add(cpuCores)
+	reclaimedMemory.Add(memoryGiB)
+}
+
+// UpdateDrainSkippedNodesCount updates the number of nodes skipped for draining
+func UpdateDrainSkippedNodesCount(numNodes int) {
+	drainSkippedNodesCount.Set(float64(numNodes))
+}
+
+// UpdateTopologyStabilizing sets whether the rescheduler is waiting for the
+// cluster topology to stabilise
+func UpdateTopologyStabilizing(stabilizing bool) {
+	if stabilizing {
+		topologyStabilizing.Set(1)
+		return
+	}
+	topologyStabilizing.Set(0)
+}
+
+// ObserveNodeMapBuildDuration records how long building the nodes map took
+func ObserveNodeMapBuildDuration(duration time.Duration) {
+	nodeMapBuildDuration.Observe(duration.Seconds())
+}
+
+// UpdateZoneDrainCount adds 1 to the drain counter for a zone
+func UpdateZoneDrainCount(zone string) {
+	zoneDrainCount.WithLabelValues(zone).Add(1)
+}
+
+// UpdateTopology updates the number of unclassified nodes and movable pods
+func UpdateTopology(unclassifiedNodes int, movablePods int) {
+	nodesCount.WithLabelValues("unclassified").Set(float64(unclassifiedNodes))
+	movablePodsCount.Set(float64(movablePods))
+}
+
+// UpdateMinNodesEstimate updates the lower bound on nodes needed for the pods
+func UpdateMinNodesEstimate(count int) {
+	minNodesEstimate.Set(float64(count))
+}
+
+// UpdatePanicsCount counts a panic recovered from in the main loop
+func UpdatePanicsCount() {
+	panicsCount.Inc()
+}
+
+// UpdateUnmatchedNodeLabels updates whether no nodes match each node label
+func UpdateUnmatchedNodeLabels(onDemand bool, spot bool) {
+	unmatchedNodeLabels.WithLabelValues("on-demand").Set(boolToFloat(onDemand))
+	unmatchedNodeLabels.WithLabelValues("spot").Set(boolToFloat(spot))
+}
+
+// UpdateMaintenance updates whether draining is paused for maintenance
+func UpdateMaintenance(paused bool) {
+	maintenance.Set(boolToFloat(paused))
+}
+
+// UpdatePredicateRefresh records the outcome of refreshing the predicate checker
+func UpdatePredicateRefresh(success bool) {
+	if !success {
+		predicateRefreshFailures.Inc()
+	}
+	predicatesStale.Set(boolToFloat(!success))
+}
+
+// UpdateDrainsDeferredCooldown counts a drain deferred by the drain delay
+func UpdateDrainsDeferredCooldown() {
+	drainsDeferredCooldown.Inc()
+}
+
+// ObservePodEvictionDuration records how long a pod took to go after eviction
+func ObservePodEvictionDuration(ownerKind string, duration time.Duration) {
+	podEvictionDuration.WithLabelValues(ownerKind).Observe(duration.Seconds())
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// UpdateInflightEvictions sets the number of evictions currently in progress
+func UpdateInflightEvictions(inflight int) {
+	inflightEvictions.Set(float64(inflight))
+}
+
+// UpdateLabelDriftDetected counts a drain skipped because its targets were reclassified
+func UpdateLabelDriftDetected() {
+	labelDriftDetected.Inc()
+}
+
+// UpdatePublishDropped counts a drain event dropped from the publish buffer
+func UpdatePublishDropped() {
+	publishDropped.Inc()
+}
+
+// UpdateNodeCordon counts a cordon or uncordon of a node and tracks the
+// number of nodes left cordoned
+func UpdateNodeCordon(action string, err error) {
+	if err != nil {
+		nodeCordonCount.WithLabelValues(action, "Failure").Inc()
+		return
+	}
+	nodeCordonCount.WithLabelValues(action, "Success").Inc()
+	if action == "cordon" {
+		cordonedNodes.Inc()
+	} else {
+		cordonedNodes.Dec()
+	}
+}
+
+// UpdateEstimatedHourlySavings adds the estimated hourly saving of a drained node
+func UpdateEstimatedHourlySavings(instanceType string, saving float64) {
+	estimatedHourlySavings.WithLabelValues(instanceType).Add(saving)
+}
+
+// UpdatePodsMoved adds 1 to the number of pods evicted from a node
+func UpdatePodsMoved(nodeName string) {
+	podsMovedCount.WithLabelValues(nodeName).Inc()
+}
+
+// ObservePlanBuildDuration records how long building a drain plan took
+func ObservePlanBuildDuration(duration time.Duration) {
+	planBuildDuration.Observe(duration.Seconds())
+}
+
+// UpdatePreDrainHook counts a pre-drain hook allowing or denying a drain
+func UpdatePreDrainHook(hook string, err error) {
+	if err != nil {
+		preDrainHookCount.WithLabelValues(hook, "Denied").Inc()
+		return
+	}
+	preDrainHookCount.WithLabelValues(hook, "Allowed").Inc()
+}
+
+// UpdateReplacementsNotReady counts a drain whose evicted pods weren't replaced in time
+func UpdateReplacementsNotReady(nodeName string) {
+	replacementsNotReadyCount.WithLabelValues(nodeName).Inc()
+}
+
+// UpdateSpotInterruptionEvacuation counts the evacuation of an interrupted spot node
+func UpdateSpotInterruptionEvacuation(err error) {
+	if err != nil {
+		spotInterruptionEvacuations.WithLabelValues("Failure").Inc()
+		return
+	}
+	spotInterruptionEvacuations.WithLabelValues("Success").Inc()
+}
+
+// UpdateBuildInfo records the version and commit of the running build
+func UpdateBuildInfo(version string, commit string) {
+	buildInfo.WithLabelValues(version, commit).Set(1)
+}
+
+// UpdateNextDrain records how long until the next drain is allowed
+func UpdateNextDrain(until time.Duration) {
+	if until < 0 {
+		until = 0
+	}
+	nextDrainSeconds.Set(until.Seconds())
+}
+
+// UpdateLastDrain records the time of a successful drain
+func UpdateLastDrain(drained time.Time) {
+	lastDrainTimestamp.Set(float64(drained.Unix()))
 }
@@ -0,0 +1,113 @@
+/*
+Copyright 2017 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// rollingCounter counts events per key within a rolling window.
+type rollingCounter struct {
+	window time.Duration
+	events map[string][]time.Time
+	pruned time.Time
+}
+
+func newRollingCounter(window time.Duration) *rollingCounter {
+	return &rollingCounter{
+		window: window,
+		events: make(map[string][]time.Time),
+	}
+}
+
+// add records an event for the key. Keys without any events in the window,
+// which may never be counted again, are forgotten at most once per window.
+func (r *rollingCounter) add(key string, now time.Time) {
+	if now.Sub(r.pruned) > r.window {
+		for k := range r.events {
+			r.count(k, now)
+		}
+		r.pruned = now
+	}
+	r.events[key] = append(r.events[key], now)
+}
+
+// count returns the number of events for the key within the window,
+// forgetting any older events.
+func (r *rollingCounter) count(key string, now time.Time) int {
+	recent := make([]time.Time, 0, len(r.events[key]))
+	for _, event := range r.events[key] {
+		if now.Sub(event) < r.window {
+			recent = append(recent, event)
+		}
+	}
+	if len(recent) == 0 {
+		delete(r.events, key)
+		return 0
+	}
+	r.events[key] = recent
+	return len(recent)
+}
+
+// moveTracker records when each application, identified by the UID of the
+// controller owning its pods, was moved within a rolling window.
+type moveTracker struct {
+	moves *rollingCounter
+}
+
+func newMoveTracker(window time.Duration) *moveTracker {
+	return &moveTracker{moves: newRollingCounter(window)}
+}
+
+// record adds a move for each application with pods in the list.
+// An application with several pods in the list is only counted once.
+func (m *moveTracker) record(pods []*apiv1.Pod, now time.Time) {
+	seen := make(map[types.UID]bool)
+	for _, pod := range pods {
+		owner := metav1.GetControllerOf(pod)
+		if owner == nil || seen[owner.UID] {
+			continue
+		}
+		seen[owner.UID] = true
+		m.moves.add(string(owner.UID), now)
+	}
+}
+
+// count returns the number of times the application was moved within the
+// window.
+func (m *moveTracker) count(uid types.UID, now time.Time) int {
+	return m.moves.count(string(uid), now)
+}
+
+// limited returns the first pod in the list whose application has already
+// been moved limit times within the window, or nil if there is none.
+func (m *moveTracker) limited(pods []*apiv1.Pod, limit int, now time.Time) *apiv1.Pod {
+	for _, pod := range pods {
+		owner := metav1.GetControllerOf(pod)
+		if owner == nil {
+			continue
+		}
+		if m.count(owner.UID, now) >= limit {
+			return pod
+		}
+	}
+	return nil
+}
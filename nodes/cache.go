@@ -0,0 +1,81 @@
+/*
+Copyright 2017 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodes
+
+import (
+	"fmt"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	kube_client "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// nodeNameIndex indexes cached pods by the node they are scheduled on.
+const nodeNameIndex = "nodeName"
+
+// PodCache serves the pods on each node from memory, kept up to date by a
+// watch, so node maps can be built without listing pods for every node. The
+// cached pods are shared and must not be modified.
+type PodCache struct {
+	informer cache.SharedIndexInformer
+}
+
+// NewPodCache creates a PodCache for all pods in the cluster and starts
+// watching them until stopChannel is closed.
+func NewPodCache(client kube_client.Interface, stopChannel <-chan struct{}) *PodCache {
+	listWatch := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return client.CoreV1().Pods(apiv1.NamespaceAll).List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return client.CoreV1().Pods(apiv1.NamespaceAll).Watch(options)
+		},
+	}
+	informer := cache.NewSharedIndexInformer(listWatch, &apiv1.Pod{}, 0, cache.Indexers{
+		nodeNameIndex: func(obj interface{}) ([]string, error) {
+			pod, ok := obj.(*apiv1.Pod)
+			if !ok || pod.Spec.NodeName == "" {
+				return []string{}, nil
+			}
+			return []string{pod.Spec.NodeName}, nil
+		},
+	})
+	go informer.Run(stopChannel)
+	return &PodCache{informer: informer}
+}
+
+// WaitForSync blocks until the cache has been filled, returning false if
+// stopChannel was closed first.
+func (c *PodCache) WaitForSync(stopChannel <-chan struct{}) bool {
+	return cache.WaitForCacheSync(stopChannel, c.informer.HasSynced)
+}
+
+// PodsOnNode returns the cached pods scheduled on the node.
+func (c *PodCache) PodsOnNode(nodeName string) ([]*apiv1.Pod, error) {
+	objs, err := c.informer.GetIndexer().ByIndex(nodeNameIndex, nodeName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list cached pods on node %s: %v", nodeName, err)
+	}
+	pods := make([]*apiv1.Pod, 0, len(objs))
+	for _, obj := range objs {
+		pods = append(pods, obj.(*apiv1.Pod))
+	}
+	return pods, nil
+}
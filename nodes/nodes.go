@@ -17,24 +17,76 @@ limitations under the License.
 package nodes
 
 import (
+	"fmt"
+	"math"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+
+	"github.com/golang/glog"
 
 	apiv1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	kube_client "k8s.io/client-go/kubernetes"
 )
 
+const (
+	// DrainSkippedAnnotation marks a node the rescheduler has given up draining.
+	// It must be removed by an operator before the node is considered again.
+	DrainSkippedAnnotation = "spot-rescheduler.pusher.com/drain-skipped"
+
+	// UnknownZone is the zone of nodes without a zone label.
+	UnknownZone = "unknown"
+
+	// UnknownInstanceType is the instance type of nodes without an instance type label.
+	UnknownInstanceType = "unknown"
+)
+
+// zoneLabels are the labels which may hold a node's zone, in order of preference.
+var zoneLabels = []string{
+	"topology.kubernetes.io/zone",
+	"failure-domain.beta.kubernetes.io/zone",
+}
+
+// instanceTypeLabels are the labels which may hold a node's instance type, in
+// order of preference.
+var instanceTypeLabels = []string{
+	"node.kubernetes.io/instance-type",
+	"beta.kubernetes.io/instance-type",
+}
+
 var (
 	// OnDemandNodeLabel label for on-demand instances.
 	OnDemandNodeLabel = "kubernetes.io/role=worker"
-	// SpotNodeLabel label for spot instances.
+	// SpotNodeLabel comma separated labels for spot instances, a node with any
+	// of them is spot.
 	SpotNodeLabel = "kubernetes.io/role=spot-worker"
 	// OnDemand key for on-demand instances of NodesMap.
 	OnDemand NodeType
 	// Spot key for spot instances of NodesMap.
 	Spot NodeType = 1
+	// NodeMapWorkers is the number of nodes built concurrently by NewNodeMap.
+	NodeMapWorkers = 10
+	// ExcludeAnnotation excludes a node from draining while set to "true".
+	ExcludeAnnotation = "spot-rescheduler.pusher.com/exclude"
+	// OnDemandNodeTaint taint for on-demand instances, checked as well as the
+	// label. Disabled when empty.
+	OnDemandNodeTaint = ""
+	// SpotNodeTaint taint for spot instances, checked as well as the labels.
+	// Disabled when empty.
+	SpotNodeTaint = ""
+	// SpotInterruptionTaint taint given to spot instances which are about to
+	// be interrupted. Disabled when empty.
+	SpotInterruptionTaint = ""
+	// SpotNodePriorityLabel label holding an integer priority for spot nodes,
+	// higher priority nodes are filled first. Disabled when empty.
+	SpotNodePriorityLabel = ""
+	// Pods serves the pods on each node when set, instead of listing them from
+	// the API server.
+	Pods *PodCache
 )
 
 // NodeInfo struct containing node and it's pods as well information
@@ -44,6 +96,8 @@ type NodeInfo struct {
 	Pods         []*apiv1.Pod
 	RequestedCPU int64
 	FreeCPU      int64
+	// requested caches the total requests of the pods, nil until worked out.
+	requested apiv1.ResourceList
 }
 
 // NodeType integer key for keying NodesMap.
@@ -57,29 +111,33 @@ type Map map[NodeType]NodeInfoArray
 
 // NewNodeMap creates a new NodesMap from a list of Nodes.
 func NewNodeMap(client kube_client.Interface, nodes []*apiv1.Node) (Map, error) {
+	return newNodeMap(client, nodes, false)
+}
+
+// NewLiveNodeMap creates a new NodesMap from a list of Nodes like NewNodeMap,
+// but always lists the pods on each node from the API server rather than the
+// pod cache, for checks which must see pods that have only just changed.
+func NewLiveNodeMap(client kube_client.Interface, nodes []*apiv1.Node) (Map, error) {
+	return newNodeMap(client, nodes, true)
+}
+
+func newNodeMap(client kube_client.Interface, nodes []*apiv1.Node, live bool) (Map, error) {
 	nodeMap := Map{
 		OnDemand: make([]*NodeInfo, 0),
 		Spot:     make([]*NodeInfo, 0),
 	}
 
-	for _, node := range nodes {
-		nodeInfo, err := newNodeInfo(client, node)
-		if err != nil {
-			return nil, err
-		}
-
-		// Sort pods with biggest CPU request first
-		sort.Slice(nodeInfo.Pods, func(i, j int) bool {
-			iCPU := getPodCPURequests(nodeInfo.Pods[i])
-			jCPU := getPodCPURequests(nodeInfo.Pods[j])
-			return iCPU > jCPU
-		})
+	nodeInfos, err := newNodeInfos(client, nodes, live)
+	if err != nil {
+		return nil, err
+	}
 
+	for _, nodeInfo := range nodeInfos {
 		switch true {
-		case isSpotNode(node):
+		case isSpotNode(nodeInfo.Node):
 			nodeMap[Spot] = append(nodeMap[Spot], nodeInfo)
 			continue
-		case isOnDemandNode(node):
+		case isOnDemandNode(nodeInfo.Node):
 			nodeMap[OnDemand] = append(nodeMap[OnDemand], nodeInfo)
 			continue
 		default:
@@ -87,8 +145,12 @@ func NewNodeMap(client kube_client.Interface, nodes []*apiv1.Node) (Map, error)
 		}
 	}
 
-	// Sort spot nodes by most requested CPU first
+	// Sort spot nodes by highest priority, then most requested CPU first
 	sort.Slice(nodeMap[Spot], func(i, j int) bool {
+		priorityI, priorityJ := SpotPriority(nodeMap[Spot][i].Node), SpotPriority(nodeMap[Spot][j].Node)
+		if priorityI != priorityJ {
+			return priorityI > priorityJ
+		}
 		return nodeMap[Spot][i].RequestedCPU > nodeMap[Spot][j].RequestedCPU
 	})
 	// Sort on-demand nodes by least requested CPU first
@@ -99,13 +161,60 @@ func NewNodeMap(client kube_client.Interface, nodes []*apiv1.Node) (Map, error)
 	return nodeMap, nil
 }
 
-func newNodeInfo(client kube_client.Interface, node *apiv1.Node) (*NodeInfo, error) {
-	pods, err := getPodsOnNode(client, node)
+// Builds a NodeInfo for each of the nodes using a pool of NodeMapWorkers.
+// Errors from every node are collected and returned together.
+func newNodeInfos(client kube_client.Interface, nodes []*apiv1.Node, live bool) ([]*NodeInfo, error) {
+	workers := NodeMapWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	nodeInfos := make([]*NodeInfo, len(nodes))
+	errs := make([]error, 0)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+
+	indexes := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				nodeInfo, err := newNodeInfo(client, nodes[i], live)
+				mutex.Lock()
+				if err != nil {
+					errs = append(errs, fmt.Errorf("failed to build node info for %s: %v", nodes[i].Name, err))
+				} else {
+					nodeInfos[i] = nodeInfo
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for i := range nodes {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return nil, utilerrors.NewAggregate(errs)
+	}
+	return nodeInfos, nil
+}
+
+func newNodeInfo(client kube_client.Interface, node *apiv1.Node, live bool) (*NodeInfo, error) {
+	pods, err := getPodsOnNode(client, node, live)
 	if err != nil {
 		return nil, err
 	}
 	requestedCPU := calculateRequestedCPU(pods)
 
+	// Sort pods with biggest CPU request first
+	sort.Slice(pods, func(i, j int) bool {
+		return getPodCPURequests(pods[i]) > getPodCPURequests(pods[j])
+	})
+
 	return &NodeInfo{
 		Node:         node,
 		Pods:         pods,
@@ -115,14 +224,80 @@ func newNodeInfo(client kube_client.Interface, node *apiv1.Node) (*NodeInfo, err
 }
 
 // AddPod adds a pod to a NodeInfo and updates the relevant resource values.
+// The pods are copied so NodeInfos sharing them aren't modified.
 func (n *NodeInfo) AddPod(pod *apiv1.Pod) {
-	n.Pods = append(n.Pods, pod)
+	pods := make([]*apiv1.Pod, len(n.Pods), len(n.Pods)+1)
+	copy(pods, n.Pods)
+	n.Pods = append(pods, pod)
 	n.RequestedCPU = calculateRequestedCPU(n.Pods)
 	n.FreeCPU = n.Node.Status.Allocatable.Cpu().MilliValue() - n.RequestedCPU
+	n.requested = nil
+}
+
+// RemovePod removes a pod from a NodeInfo, matching it by namespace and name,
+// and updates the relevant resource values. Returns whether the pod was found.
+// The pods are copied so NodeInfos sharing them aren't modified.
+func (n *NodeInfo) RemovePod(pod *apiv1.Pod) bool {
+	pods := make([]*apiv1.Pod, 0, len(n.Pods))
+	found := false
+	for _, p := range n.Pods {
+		if !found && p.Namespace == pod.Namespace && p.Name == pod.Name {
+			found = true
+			continue
+		}
+		pods = append(pods, p)
+	}
+	if !found {
+		return false
+	}
+	n.Pods = pods
+	n.RequestedCPU = calculateRequestedCPU(n.Pods)
+	n.FreeCPU = n.Node.Status.Allocatable.Cpu().MilliValue() - n.RequestedCPU
+	n.requested = nil
+	return true
+}
+
+// RequestedResources returns the total resources requested by the pods on the
+// node. The total is cached until pods are added or removed.
+func (n *NodeInfo) RequestedResources() apiv1.ResourceList {
+	if n.requested == nil {
+		n.requested = PodRequests(n.Pods...)
+	}
+	return n.requested.DeepCopy()
+}
+
+// AllocatableResources returns the resources of the node which can be
+// requested by pods.
+func (n *NodeInfo) AllocatableResources() apiv1.ResourceList {
+	return n.Node.Status.Allocatable.DeepCopy()
 }
 
-// Gets a list of pods that are running on the given node
-func getPodsOnNode(client kube_client.Interface, node *apiv1.Node) ([]*apiv1.Pod, error) {
+// PodRequests returns the total resources requested by the containers of the
+// pods.
+func PodRequests(pods ...*apiv1.Pod) apiv1.ResourceList {
+	total := apiv1.ResourceList{}
+	for _, pod := range pods {
+		for _, container := range pod.Spec.Containers {
+			for name, quantity := range container.Resources.Requests {
+				if sum, ok := total[name]; ok {
+					sum.Add(quantity)
+					total[name] = sum
+					continue
+				}
+				total[name] = quantity.DeepCopy()
+			}
+		}
+	}
+	return total
+}
+
+// Gets a list of pods that are running on the given node, from the pod cache
+// if there is one unless a live list is required
+func getPodsOnNode(client kube_client.Interface, node *apiv1.Node, live bool) ([]*apiv1.Pod, error) {
+	if Pods != nil && !live {
+		return Pods.PodsOnNode(node.Name)
+	}
+
 	podsOnNode, err := client.CoreV1().Pods(apiv1.NamespaceAll).List(
 		metav1.ListOptions{FieldSelector: fields.SelectorFromSet(fields.Set{"spec.nodeName": node.Name}).String()})
 	if err != nil {
@@ -156,50 +331,169 @@ func getPodCPURequests(pod *apiv1.Pod) int64 {
 	return CPUTotal
 }
 
-// Determines if a node has the spotNodeLabel assigned
-func isSpotNode(node *apiv1.Node) bool {
-	splitLabel := strings.SplitN(SpotNodeLabel, "=", 2)
+// IsOnDemand determines if a node would be classed as on-demand by NewNodeMap.
+func IsOnDemand(node *apiv1.Node) bool {
+	return !isSpotNode(node) && isOnDemandNode(node)
+}
 
-	// If "=" found, check for new label schema. If no "=" is found, check for
-	// old label schema
-	switch len(splitLabel) {
-	case 1:
-		_, found := node.ObjectMeta.Labels[SpotNodeLabel]
-		return found
-	case 2:
-		spotLabelKey := splitLabel[0]
-		spotLabelVal := splitLabel[1]
+// IsSpot determines if a node would be classed as spot by NewNodeMap.
+func IsSpot(node *apiv1.Node) bool {
+	return isSpotNode(node)
+}
+
+// IsInterrupted determines if a node has the SpotInterruptionTaint, so is
+// about to be terminated.
+func IsInterrupted(node *apiv1.Node) bool {
+	return SpotInterruptionTaint != "" && hasTaint(node, SpotInterruptionTaint)
+}
+
+// SpotPriority returns the priority of a spot node from the
+// SpotNodePriorityLabel. Nodes without a valid priority sort after all others.
+func SpotPriority(node *apiv1.Node) int64 {
+	if SpotNodePriorityLabel == "" {
+		return 0
+	}
+	value, found := node.ObjectMeta.Labels[SpotNodePriorityLabel]
+	if !found {
+		return math.MinInt64
+	}
+	priority, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		glog.V(2).Infof("Ignoring invalid priority %q on node %s: %v", value, node.Name, err)
+		return math.MinInt64
+	}
+	return priority
+}
 
-		val, _ := node.ObjectMeta.Labels[spotLabelKey]
-		if val == spotLabelVal {
+// Determines if a node has any of the comma separated SpotNodeLabels assigned,
+// or the SpotNodeTaint if set
+func isSpotNode(node *apiv1.Node) bool {
+	if SpotNodeTaint != "" && hasTaint(node, SpotNodeTaint) {
+		return true
+	}
+	for _, label := range strings.Split(SpotNodeLabel, ",") {
+		if hasLabel(node, strings.TrimSpace(label)) {
 			return true
 		}
 	}
 	return false
 }
 
-// Determines if a node has the OnDemandNodeLabel assigned
+// Determines if a node has the OnDemandNodeLabel assigned, or the
+// OnDemandNodeTaint if set
 func isOnDemandNode(node *apiv1.Node) bool {
-	splitLabel := strings.SplitN(OnDemandNodeLabel, "=", 2)
+	if OnDemandNodeTaint != "" && hasTaint(node, OnDemandNodeTaint) {
+		return true
+	}
+	return hasLabel(node, OnDemandNodeLabel)
+}
+
+// Determines if a node has the taint, given as '<key>', '<key>=<value>' or
+// either followed by ':<effect>'. Parts which aren't given match any taint.
+func hasTaint(node *apiv1.Node, taint string) bool {
+	key, effect := taint, ""
+	if i := strings.LastIndex(taint, ":"); i >= 0 {
+		key, effect = taint[:i], taint[i+1:]
+	}
+	value, hasValue := "", false
+	if i := strings.Index(key, "="); i >= 0 {
+		key, value, hasValue = key[:i], key[i+1:], true
+	}
+
+	for _, t := range node.Spec.Taints {
+		if t.Key != key {
+			continue
+		}
+		if hasValue && t.Value != value {
+			continue
+		}
+		if effect != "" && string(t.Effect) != effect {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// Determines if a node has the label assigned, given as either
+// '<label_name>' or '<label_name>=<label_value>'
+func hasLabel(node *apiv1.Node, label string) bool {
+	splitLabel := strings.SplitN(label, "=", 2)
 
 	// If "=" found, check for new label schema. If no "=" is found, check for
 	// old label schema
 	switch len(splitLabel) {
 	case 1:
-		_, found := node.ObjectMeta.Labels[OnDemandNodeLabel]
+		_, found := node.ObjectMeta.Labels[label]
 		return found
 	case 2:
-		onDemandLabelKey := splitLabel[0]
-		onDemandLabelVal := splitLabel[1]
+		labelKey := splitLabel[0]
+		labelVal := splitLabel[1]
 
-		val, _ := node.ObjectMeta.Labels[onDemandLabelKey]
-		if val == onDemandLabelVal {
+		val, _ := node.ObjectMeta.Labels[labelKey]
+		if val == labelVal {
 			return true
 		}
 	}
 	return false
 }
 
+// Zone returns the availability zone of the node from its topology labels.
+func Zone(node *apiv1.Node) string {
+	for _, label := range zoneLabels {
+		if zone, found := node.ObjectMeta.Labels[label]; found && zone != "" {
+			return zone
+		}
+	}
+	return UnknownZone
+}
+
+// InstanceType returns the instance type of the node from its labels.
+func InstanceType(node *apiv1.Node) string {
+	for _, label := range instanceTypeLabels {
+		if instanceType, found := node.ObjectMeta.Labels[label]; found && instanceType != "" {
+			return instanceType
+		}
+	}
+	return UnknownInstanceType
+}
+
+// IsExcluded determines if a node has the ExcludeAnnotation set to true.
+func IsExcluded(node *apiv1.Node) bool {
+	return ExcludeAnnotation != "" && node.Annotations[ExcludeAnnotation] == "true"
+}
+
+// IsDrainSkipped determines if a node has the DrainSkippedAnnotation assigned
+func IsDrainSkipped(node *apiv1.Node) bool {
+	_, found := node.ObjectMeta.Annotations[DrainSkippedAnnotation]
+	return found
+}
+
+// MarkDrainSkipped adds the DrainSkippedAnnotation to the node so that it is
+// no longer considered for draining.
+func MarkDrainSkipped(node *apiv1.Node, client kube_client.Interface) error {
+	// Get the newest version of the node.
+	freshNode, err := client.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	if err != nil || freshNode == nil {
+		return fmt.Errorf("failed to get node %v: %v", node.Name, err)
+	}
+
+	if IsDrainSkipped(freshNode) {
+		return nil
+	}
+	if freshNode.ObjectMeta.Annotations == nil {
+		freshNode.ObjectMeta.Annotations = make(map[string]string)
+	}
+	freshNode.ObjectMeta.Annotations[DrainSkippedAnnotation] = "true"
+
+	_, err = client.CoreV1().Nodes().Update(freshNode)
+	if err != nil {
+		glog.Warningf("Error while adding drain skipped annotation on node %v: %v", node.Name, err)
+		return err
+	}
+	return nil
+}
+
 // CopyNodeInfos returns an array of copies of the NodeInfos in this array.
 func (n NodeInfoArray) CopyNodeInfos() NodeInfoArray {
 	var arr NodeInfoArray
@@ -209,6 +503,7 @@ func (n NodeInfoArray) CopyNodeInfos() NodeInfoArray {
 			Pods:         node.Pods,
 			RequestedCPU: node.RequestedCPU,
 			FreeCPU:      node.FreeCPU,
+			requested:    node.requested,
 		}
 		arr = append(arr, nodeInfo)
 	}
@@ -40,6 +40,12 @@ func TestIsSpotNode(t *testing.T) {
 
 	SpotNodeLabel = "foo=baz"
 	assert.False(t, isSpotNode(spotNode), "expected node with label 'foo' and value 'bar' to not be spot node")
+
+	SpotNodeLabel = "foo=baz, foo=bar"
+	assert.True(t, isSpotNode(spotNode), "expected node matching any of the labels to be spot node")
+
+	SpotNodeLabel = "foo=baz,qux"
+	assert.False(t, isSpotNode(spotNode), "expected node matching none of the labels to not be spot node")
 }
 
 func TestIsOnDemandNode(t *testing.T) {
@@ -55,6 +61,41 @@ func TestIsOnDemandNode(t *testing.T) {
 	assert.False(t, isOnDemandNode(onDemandNode), "expected node with label 'foo' and value 'bar' to not be on demand node")
 }
 
+func TestNodeTaints(t *testing.T) {
+	OnDemandNodeLabel = "kubernetes.io/role=worker"
+	SpotNodeLabel = "kubernetes.io/role=spot-worker"
+	defer func() { OnDemandNodeTaint, SpotNodeTaint = "", "" }()
+
+	spotNode := createTestNodeWithLabel("spot", 2000, map[string]string{})
+	spotNode.Spec.Taints = []apiv1.Taint{{Key: "spotInstance", Value: "true", Effect: apiv1.TaintEffectNoSchedule}}
+	onDemandNode := createTestNodeWithLabel("on-demand", 2000, map[string]string{})
+	onDemandNode.Spec.Taints = []apiv1.Taint{{Key: "onDemand", Effect: apiv1.TaintEffectPreferNoSchedule}}
+	labelledNode := createTestNodeWithLabel("labelled", 2000, map[string]string{"kubernetes.io/role": "spot-worker"})
+
+	assert.False(t, IsSpot(spotNode), "expected taints to be ignored when not set")
+
+	for _, taint := range []string{"spotInstance", "spotInstance=true", "spotInstance=true:NoSchedule", "spotInstance:NoSchedule"} {
+		SpotNodeTaint = taint
+		assert.True(t, IsSpot(spotNode), "expected node to match taint %s", taint)
+	}
+	for _, taint := range []string{"spotInstance=false", "spotInstance=true:NoExecute", "other"} {
+		SpotNodeTaint = taint
+		assert.False(t, IsSpot(spotNode), "expected node not to match taint %s", taint)
+	}
+
+	// Labels still classify nodes alongside taints
+	SpotNodeTaint = "spotInstance=true:NoSchedule"
+	assert.True(t, IsSpot(labelledNode))
+
+	OnDemandNodeTaint = "onDemand"
+	assert.True(t, IsOnDemand(onDemandNode))
+
+	// Spot takes precedence when a node matches both
+	onDemandNode.Spec.Taints = append(onDemandNode.Spec.Taints, spotNode.Spec.Taints...)
+	assert.False(t, IsOnDemand(onDemandNode))
+	assert.True(t, IsSpot(onDemandNode))
+}
+
 func TestNewNodeMap(t *testing.T) {
 	OnDemandNodeLabel = "kubernetes.io/role=worker"
 	SpotNodeLabel = "kubernetes.io/role=spot-worker"
@@ -123,6 +164,51 @@ func TestNewNodeMap(t *testing.T) {
 
 }
 
+func TestNewNodeMapSpotPriority(t *testing.T) {
+	SpotNodeLabel = "kubernetes.io/role=spot-worker"
+	SpotNodePriorityLabel = "priority"
+	defer func() { SpotNodePriorityLabel = "" }()
+
+	nodes := []*apiv1.Node{
+		createTestNodeWithLabel("node3", 2000, map[string]string{"kubernetes.io/role": "spot-worker", "priority": "10"}),
+		createTestNodeWithLabel("node4", 2000, map[string]string{"kubernetes.io/role": "spot-worker"}),
+		createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "spot-worker", "priority": "cheap"}),
+	}
+
+	nodeMap, err := NewNodeMap(createFakeClient(t), nodes)
+	assert.NoError(t, err)
+
+	// node4 has the most requested CPU, but node3 has the highest priority
+	spotNodeInfos := nodeMap[Spot]
+	assert.Equal(t, "node3", spotNodeInfos[0].Node.Name)
+	assert.Equal(t, "node4", spotNodeInfos[1].Node.Name)
+	assert.Equal(t, "node1", spotNodeInfos[2].Node.Name)
+	assert.Equal(t, int64(10), SpotPriority(spotNodeInfos[0].Node))
+	assert.Equal(t, SpotPriority(spotNodeInfos[1].Node), SpotPriority(spotNodeInfos[2].Node), "expected invalid priorities to be ignored")
+}
+
+func TestNewNodeMapErrors(t *testing.T) {
+	nodes := []*apiv1.Node{
+		createTestNode("node1", 2000),
+		createTestNode("broken1", 2000),
+		createTestNode("broken2", 2000),
+	}
+
+	fakeClient := &fake.Clientset{}
+	fakeClient.Fake.AddReactor("list", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		restrictions := action.(core.ListAction).GetListRestrictions().Fields.String()
+		if restrictions == "spec.nodeName=node1" {
+			return true, &apiv1.PodList{}, nil
+		}
+		return true, nil, fmt.Errorf("failed to list pods")
+	})
+
+	_, err := NewNodeMap(fakeClient, nodes)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "broken1")
+	assert.Contains(t, err.Error(), "broken2")
+}
+
 func TestAddPod(t *testing.T) {
 
 	nodeInfo1 := createTestNodeInfo(createTestNode("node1", 2000), []*apiv1.Pod{}, 0)
@@ -139,6 +225,110 @@ func TestAddPod(t *testing.T) {
 	assert.Equal(t, 2, len(nodeInfo1.Pods))
 	assert.Equal(t, int64(1021), nodeInfo1.RequestedCPU)
 	assert.Equal(t, int64(979), nodeInfo1.FreeCPU)
+
+	// Copies sharing the pods don't overwrite each other's additions, even
+	// when the pods have spare capacity
+	nodeInfo1.Pods = append(make([]*apiv1.Pod, 0, 4), nodeInfo1.Pods...)
+	copies := NodeInfoArray{nodeInfo1, nodeInfo1}.CopyNodeInfos()
+	pod3, pod4 := createTestPod("pod3", 100), createTestPod("pod4", 100)
+	copies[0].AddPod(pod3)
+	copies[1].AddPod(pod4)
+	assert.Equal(t, []*apiv1.Pod{pod1, pod2, pod3}, copies[0].Pods)
+	assert.Equal(t, []*apiv1.Pod{pod1, pod2, pod4}, copies[1].Pods)
+	assert.Equal(t, 2, len(nodeInfo1.Pods))
+}
+
+func TestRemovePod(t *testing.T) {
+	pod1 := createTestPod("pod1", 300)
+	pod2 := createTestPod("pod2", 721)
+	nodeInfo1 := createTestNodeInfo(createTestNode("node1", 2000), []*apiv1.Pod{pod1, pod2}, 1021)
+	nodeInfoCopy := NodeInfoArray{nodeInfo1}.CopyNodeInfos()[0]
+
+	assert.True(t, nodeInfo1.RemovePod(createTestPod("pod1", 300)), "expected the pod to be matched by name")
+	assert.Equal(t, []*apiv1.Pod{pod2}, nodeInfo1.Pods)
+	assert.Equal(t, int64(721), nodeInfo1.RequestedCPU)
+	assert.Equal(t, int64(1279), nodeInfo1.FreeCPU)
+
+	// Copies sharing the pods are left alone
+	assert.Equal(t, []*apiv1.Pod{pod1, pod2}, nodeInfoCopy.Pods)
+	assert.Equal(t, int64(1021), nodeInfoCopy.RequestedCPU)
+
+	assert.False(t, nodeInfo1.RemovePod(pod1), "expected the pod to be gone")
+	assert.Equal(t, 1, len(nodeInfo1.Pods))
+
+	assert.True(t, nodeInfo1.RemovePod(pod2))
+	assert.Equal(t, 0, len(nodeInfo1.Pods))
+	assert.Equal(t, int64(0), nodeInfo1.RequestedCPU)
+	assert.Equal(t, int64(2000), nodeInfo1.FreeCPU)
+}
+
+func TestRequestedResources(t *testing.T) {
+	pod1 := createTestPod("pod1", 300)
+	pod1.Spec.Containers[0].Resources.Requests[apiv1.ResourceMemory] = *resource.NewQuantity(1024, resource.BinarySI)
+	pod2 := createTestPod("pod2", 200)
+	nodeInfo1 := createTestNodeInfo(createTestNode("node1", 2000), []*apiv1.Pod{pod1}, 300)
+
+	requested := nodeInfo1.RequestedResources()
+	assert.Equal(t, int64(300), requested.Cpu().MilliValue())
+	assert.Equal(t, int64(1024), requested.Memory().Value())
+
+	// The cached total can't be changed through the returned list
+	requested[apiv1.ResourceCPU] = *resource.NewMilliQuantity(0, resource.DecimalSI)
+	requested = nodeInfo1.RequestedResources()
+	assert.Equal(t, int64(300), requested.Cpu().MilliValue())
+
+	nodeInfo1.AddPod(pod2)
+	requested = nodeInfo1.RequestedResources()
+	assert.Equal(t, int64(500), requested.Cpu().MilliValue())
+	nodeInfo1.RemovePod(pod1)
+	requested = nodeInfo1.RequestedResources()
+	assert.Equal(t, int64(200), requested.Cpu().MilliValue())
+	assert.Equal(t, int64(0), requested.Memory().Value())
+
+	allocatable := nodeInfo1.AllocatableResources()
+	assert.Equal(t, int64(2000), allocatable.Cpu().MilliValue())
+}
+
+func TestPodCache(t *testing.T) {
+	p1 := createTestPod("p1", 100)
+	p1.Spec.NodeName = "node1"
+	p2 := createTestPod("p2", 200)
+	p2.Spec.NodeName = "node1"
+	p3 := createTestPod("p3", 300)
+	p3.Spec.NodeName = "node2"
+	pending := createTestPod("pending", 300)
+	fakeClient := fake.NewSimpleClientset(p1, p2, p3, pending)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	Pods = NewPodCache(fakeClient, stop)
+	defer func() { Pods = nil }()
+	assert.True(t, Pods.WaitForSync(stop))
+
+	nodeMap, err := NewNodeMap(fakeClient, []*apiv1.Node{
+		createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"}),
+		createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "worker"}),
+		createTestNodeWithLabel("node3", 2000, map[string]string{"kubernetes.io/role": "worker"}),
+	})
+	assert.NoError(t, err)
+	requested := map[string]int64{}
+	for _, nodeInfo := range nodeMap[OnDemand] {
+		requested[nodeInfo.Node.Name] = nodeInfo.RequestedCPU
+	}
+	assert.Equal(t, map[string]int64{"node1": 300, "node2": 300, "node3": 0}, requested)
+
+	// Live node maps list the pods from the API server, even when the cache
+	// disagrees with it
+	nodeMap, err = NewLiveNodeMap(createFakeClient(t), []*apiv1.Node{
+		createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"}),
+		createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "worker"}),
+	})
+	assert.NoError(t, err)
+	requested = map[string]int64{}
+	for _, nodeInfo := range nodeMap[OnDemand] {
+		requested[nodeInfo.Node.Name] = nodeInfo.RequestedCPU
+	}
+	assert.Equal(t, map[string]int64{"node1": 400, "node2": 1200}, requested)
 }
 
 func TestGetPodsOnNode(t *testing.T) {
@@ -149,7 +339,7 @@ func TestGetPodsOnNode(t *testing.T) {
 
 	fakeClient := createFakeClient(t)
 
-	podsOnNode1, err := getPodsOnNode(fakeClient, node1)
+	podsOnNode1, err := getPodsOnNode(fakeClient, node1, false)
 	if err != nil {
 		assert.Error(t, err, "Found error in getting pods on node")
 	}
@@ -157,7 +347,7 @@ func TestGetPodsOnNode(t *testing.T) {
 	assert.Equal(t, "p1n1", podsOnNode1[0].Name)
 	assert.Equal(t, "p2n1", podsOnNode1[1].Name)
 
-	podsOnNode2, err := getPodsOnNode(fakeClient, node2)
+	podsOnNode2, err := getPodsOnNode(fakeClient, node2, false)
 	if err != nil {
 		assert.Error(t, err, "Found error in getting pods on node")
 	}
@@ -166,7 +356,7 @@ func TestGetPodsOnNode(t *testing.T) {
 	assert.Equal(t, "p2n2", podsOnNode2[1].Name)
 	assert.Equal(t, "p3n2", podsOnNode2[2].Name)
 
-	podsOnNode3, err := getPodsOnNode(fakeClient, node3)
+	podsOnNode3, err := getPodsOnNode(fakeClient, node3, false)
 	if err != nil {
 		assert.Error(t, err, "Found error in getting pods on node")
 	}
@@ -174,7 +364,7 @@ func TestGetPodsOnNode(t *testing.T) {
 	assert.Equal(t, "p1n3", podsOnNode3[0].Name)
 	assert.Equal(t, "p2n3", podsOnNode3[1].Name)
 
-	podsOnNode4, err := getPodsOnNode(fakeClient, node4)
+	podsOnNode4, err := getPodsOnNode(fakeClient, node4, false)
 	if err != nil {
 		assert.Error(t, err, "Found error in getting pods on node")
 	}
@@ -267,6 +457,40 @@ func TestCopyNodeInfos(t *testing.T) {
 	assert.Equal(t, len(pods3), len(nodeInfos[2].Pods))
 }
 
+func TestZone(t *testing.T) {
+	node := createTestNodeWithLabel("node1", 2000, map[string]string{"failure-domain.beta.kubernetes.io/zone": "eu-west-1a"})
+	assert.Equal(t, "eu-west-1a", Zone(node))
+
+	node.Labels["topology.kubernetes.io/zone"] = "eu-west-1b"
+	assert.Equal(t, "eu-west-1b", Zone(node), "expected the topology label to be preferred")
+
+	assert.Equal(t, UnknownZone, Zone(createTestNode("node2", 2000)))
+}
+
+func TestInstanceType(t *testing.T) {
+	node := createTestNodeWithLabel("node1", 2000, map[string]string{"beta.kubernetes.io/instance-type": "m5.large"})
+	assert.Equal(t, "m5.large", InstanceType(node))
+
+	node.Labels["node.kubernetes.io/instance-type"] = "m5.2xlarge"
+	assert.Equal(t, "m5.2xlarge", InstanceType(node), "expected the stable label to be preferred")
+
+	assert.Equal(t, UnknownInstanceType, InstanceType(createTestNode("node2", 2000)))
+}
+
+func TestMarkDrainSkipped(t *testing.T) {
+	node := createTestNode("node1", 2000)
+	fakeClient := fake.NewSimpleClientset(node)
+
+	assert.False(t, IsDrainSkipped(node))
+
+	err := MarkDrainSkipped(node, fakeClient)
+	assert.NoError(t, err)
+
+	updatedNode, err := fakeClient.CoreV1().Nodes().Get("node1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.True(t, IsDrainSkipped(updatedNode), "expected node to have the drain skipped annotation")
+}
+
 func createTestPod(name string, cpu int64) *apiv1.Pod {
 	pod := &apiv1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
@@ -373,3 +597,14 @@ func createFakeClient(t *testing.T) *fake.Clientset {
 	})
 	return fakeClient
 }
+
+func TestIsExcluded(t *testing.T) {
+	node := &apiv1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}
+	assert.False(t, IsExcluded(node))
+
+	node.Annotations = map[string]string{ExcludeAnnotation: "true"}
+	assert.True(t, IsExcluded(node))
+
+	node.Annotations[ExcludeAnnotation] = "false"
+	assert.False(t, IsExcluded(node))
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2017 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pusher/k8s-spot-rescheduler/nodes"
+)
+
+const (
+	// drainOrderLeastUtilized considers the on-demand nodes with the lowest
+	// requested CPU and memory first.
+	drainOrderLeastUtilized = "least-utilized"
+	// drainOrderMostUtilized considers the on-demand nodes with the highest
+	// requested CPU and memory first.
+	drainOrderMostUtilized = "most-utilized"
+	// drainOrderOldest considers the oldest on-demand nodes first.
+	drainOrderOldest = "oldest"
+)
+
+// Checks that the drain order provided as an argument is known.
+func validateDrainOrder(order string) error {
+	switch order {
+	case drainOrderLeastUtilized, drainOrderMostUtilized, drainOrderOldest:
+		return nil
+	}
+	return fmt.Errorf("the drain order is not valid: expected '%s', '%s' or '%s', but got %s", drainOrderLeastUtilized, drainOrderMostUtilized, drainOrderOldest, order)
+}
+
+// Sorts a copy of the nodes into the order they should be considered for
+// draining in, keeping the existing order for nodes which compare equal.
+func sortByDrainOrder(nodeInfos nodes.NodeInfoArray, order string) nodes.NodeInfoArray {
+	sorted := make(nodes.NodeInfoArray, len(nodeInfos))
+	copy(sorted, nodeInfos)
+
+	switch order {
+	case drainOrderOldest:
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return sorted[i].Node.CreationTimestamp.Before(&sorted[j].Node.CreationTimestamp)
+		})
+	case drainOrderLeastUtilized, drainOrderMostUtilized:
+		utilization := make(map[*nodes.NodeInfo]float64, len(sorted))
+		for _, nodeInfo := range sorted {
+			utilization[nodeInfo] = nodeUtilization(nodeInfo)
+		}
+		sort.SliceStable(sorted, func(i, j int) bool {
+			if order == drainOrderMostUtilized {
+				return utilization[sorted[i]] > utilization[sorted[j]]
+			}
+			return utilization[sorted[i]] < utilization[sorted[j]]
+		})
+	}
+	return sorted
+}
+
+// Sums the fractions of the node's allocatable CPU and memory requested by
+// its pods, with the default requests applied.
+func nodeUtilization(nodeInfo *nodes.NodeInfo) float64 {
+	requested := nodeRequests(nodeInfo)
+	allocatable := nodeInfo.AllocatableResources()
+
+	var utilization float64
+	if cpu := allocatable.Cpu().MilliValue(); cpu > 0 {
+		utilization += float64(requested.Cpu().MilliValue()) / float64(cpu)
+	}
+	if memory := allocatable.Memory().Value(); memory > 0 {
+		utilization += float64(requested.Memory().Value()) / float64(memory)
+	}
+	return utilization
+}
@@ -0,0 +1,200 @@
+/*
+Copyright 2017 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	autoscaler_drain "k8s.io/autoscaler/cluster-autoscaler/utils/drain"
+)
+
+// ownerKind identifies a kind of owner, optionally within an API group.
+type ownerKind struct {
+	group string
+	kind  string
+	// anyGroup matches the kind in any API group.
+	anyGroup bool
+}
+
+// skippedOwners are parsed from skipPodsOwnedBy.
+var skippedOwners []ownerKind
+
+// Parses owner kinds of the form <group>/<Kind>, or just <Kind> to match the
+// kind in any group. Core kinds have an empty group, e.g. /ReplicationController.
+func parseOwnerKinds(values []string) ([]ownerKind, error) {
+	owners := make([]ownerKind, 0, len(values))
+	for _, value := range values {
+		if value == "" {
+			continue
+		}
+		if !strings.Contains(value, "/") {
+			owners = append(owners, ownerKind{kind: value, anyGroup: true})
+			continue
+		}
+		parts := strings.SplitN(value, "/", 2)
+		if parts[1] == "" || strings.Contains(parts[1], "/") {
+			return nil, fmt.Errorf("the owner kind is not valid: expected <group>/<Kind> or <Kind>, but got %s", value)
+		}
+		owners = append(owners, ownerKind{group: parts[0], kind: parts[1]})
+	}
+	return owners, nil
+}
+
+// Returns an error if any of the pods can't be moved because of who owns them,
+// their namespace, their local storage, their QoS class or their annotations,
+// pinning them to their node.
+func checkPinnedPods(pods []*apiv1.Pod) error {
+	if err := checkSafeToEvict(pods); err != nil {
+		return err
+	}
+	if err := checkNamespaces(pods, *includeNamespaces, *excludeNamespaces); err != nil {
+		return err
+	}
+	if err := checkLocalStorage(pods, *evictLocalStoragePods); err != nil {
+		return err
+	}
+	if err := checkPVCs(pods, *skipPodsWithPVC); err != nil {
+		return err
+	}
+	if err := checkQoS(pods); err != nil {
+		return err
+	}
+	return checkOwners(pods)
+}
+
+// Returns an error if any of the pods are annotated as not safe to evict, as
+// the cluster autoscaler does for pods it must not move.
+func checkSafeToEvict(pods []*apiv1.Pod) error {
+	for _, pod := range pods {
+		if pod.GetAnnotations()[autoscaler_drain.PodSafeToEvictKey] == "false" {
+			return fmt.Errorf("pod %s has annotation %s=false and is pinned", podID(pod), autoscaler_drain.PodSafeToEvictKey)
+		}
+	}
+	return nil
+}
+
+// Returns an error if any of the pods are in an excluded namespace, or outside
+// the included namespaces when any are given. Exclusions take precedence.
+func checkNamespaces(pods []*apiv1.Pod, include []string, exclude []string) error {
+	for _, pod := range pods {
+		if containsString(exclude, pod.Namespace) {
+			return fmt.Errorf("pod %s is in excluded namespace %s and is pinned", podID(pod), pod.Namespace)
+		}
+		if len(include) > 0 && !containsString(include, pod.Namespace) {
+			return fmt.Errorf("pod %s is not in an included namespace and is pinned", podID(pod))
+		}
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns an error if any of the pods match the selector of pods which must
+// not be moved. A nil selector matches no pods.
+func checkProtectedPods(pods []*apiv1.Pod, selector labels.Selector) error {
+	if selector == nil {
+		return nil
+	}
+	for _, pod := range pods {
+		if selector.Matches(labels.Set(pod.Labels)) {
+			return fmt.Errorf("pod %s matches the pod exclude selector and is protected", podID(pod))
+		}
+	}
+	return nil
+}
+
+// Returns an error if any of the pods use local storage, such as emptyDir
+// volumes, which would be lost when they are evicted, unless evicting them is
+// allowed.
+func checkLocalStorage(pods []*apiv1.Pod, allowed bool) error {
+	if allowed {
+		return nil
+	}
+	for _, pod := range pods {
+		if autoscaler_drain.HasLocalStorage(pod) {
+			return fmt.Errorf("pod %s uses local storage and is pinned", podID(pod))
+		}
+	}
+	return nil
+}
+
+// Returns an error if skipping is enabled and any of the pods reference a
+// PersistentVolumeClaim, whatever the type of volume bound to it.
+func checkPVCs(pods []*apiv1.Pod, skip bool) error {
+	if !skip {
+		return nil
+	}
+	for _, pod := range pods {
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim != nil {
+				return fmt.Errorf("pod %s uses PersistentVolumeClaim %s and is pinned", podID(pod), volume.PersistentVolumeClaim.ClaimName)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns an error if any of the pods are owned by a skipped owner kind.
+func checkOwners(pods []*apiv1.Pod) error {
+	if len(skippedOwners) == 0 {
+		return nil
+	}
+	for _, pod := range pods {
+		for _, ref := range pod.GetOwnerReferences() {
+			gv, err := schema.ParseGroupVersion(ref.APIVersion)
+			if err != nil {
+				continue
+			}
+			for _, owner := range skippedOwners {
+				if owner.kind == ref.Kind && (owner.anyGroup || owner.group == gv.Group) {
+					return fmt.Errorf("pod %s is owned by %s %s and is pinned", podID(pod), ref.Kind, ref.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Returns an error if any of the pods started less than minAge ago. Pods which
+// haven't started yet use their creation time.
+func checkPodAge(pods []*apiv1.Pod, minAge time.Duration, now time.Time) error {
+	if minAge <= 0 {
+		return nil
+	}
+	for _, pod := range pods {
+		started := pod.CreationTimestamp.Time
+		if pod.Status.StartTime != nil {
+			started = pod.Status.StartTime.Time
+		}
+		if now.Sub(started) < minAge {
+			return fmt.Errorf("pod %s started less than %s ago", podID(pod), minAge)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2017 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pusher/k8s-spot-rescheduler/nodes"
+	apiv1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1beta1"
+)
+
+const (
+	// drainSelectionFirst drains the first on-demand node that can be drained.
+	drainSelectionFirst = "first"
+	// drainSelectionBest plans all on-demand nodes and drains the best one.
+	drainSelectionBest = "best"
+
+	// packingStrategyFirstFit places pods on the first spot node they fit on,
+	// in order of most requested CPU.
+	packingStrategyFirstFit = "first-fit"
+	// packingStrategyBestFit places pods on the spot node with the least CPU
+	// and memory left over after placing them.
+	packingStrategyBestFit = "best-fit"
+	// packingStrategyWorstFit places pods on the spot node with the most CPU
+	// and memory left over after placing them, spreading them across the spot
+	// nodes.
+	packingStrategyWorstFit = "worst-fit"
+
+	// targetSelectionMostRequested is the deprecated name of the first-fit
+	// packing strategy used by --target-selection.
+	targetSelectionMostRequested = "most-requested"
+
+	// daemonSetPodsIgnore leaves DaemonSet pods on drained nodes.
+	daemonSetPodsIgnore = "ignore"
+	// daemonSetPodsDelete deletes DaemonSet pods once their node is drained.
+	daemonSetPodsDelete = "delete"
+)
+
+// drainPlan describes how the pods on an on-demand node would be moved onto
+// spot nodes.
+type drainPlan struct {
+	// node is the on-demand node to be drained.
+	node *nodes.NodeInfo
+	// pods are the pods which will be evicted from the node.
+	pods []*apiv1.Pod
+	// unplaced are the pods which don't fit elsewhere so will be left on the
+	// node, only set when draining partially.
+	unplaced []*apiv1.Pod
+	// targets maps each pod to the spot node it is expected to move to.
+	targets map[*apiv1.Pod]*nodes.NodeInfo
+	// spotNodeInfos are copies of the spot nodes with the planned pods added.
+	spotNodeInfos nodes.NodeInfoArray
+	// onDemandNodeInfos are copies of the other on-demand nodes with the
+	// planned pods added, only set when consolidating on-demand nodes.
+	onDemandNodeInfos nodes.NodeInfoArray
+	// groupPods is the number of pods left on the node's group, only set when
+	// optimizing node groups.
+	groupPods int
+}
+
+// betterThan determines if the plan should be preferred over another plan.
+// Plans for nodes in groups with fewer pods left bring the group closer to
+// being removed so are preferred first. Then plans emptying their node are
+// preferred over partial drains. Then plans which move fewer pods cause less
+// disruption so are preferred, if both move the same number of pods the plan
+// freeing the most CPU is preferred.
+func (p *drainPlan) betterThan(other *drainPlan) bool {
+	if p.groupPods != other.groupPods {
+		return p.groupPods < other.groupPods
+	}
+	if (len(p.unplaced) == 0) != (len(other.unplaced) == 0) {
+		return len(p.unplaced) == 0
+	}
+	if len(p.pods) != len(other.pods) {
+		return len(p.pods) < len(other.pods)
+	}
+	return p.node.Node.Status.Allocatable.Cpu().MilliValue() > other.node.Node.Status.Allocatable.Cpu().MilliValue()
+}
+
+// Picks the plan to drain from a list of successful plans.
+// In first mode the first plan is used, in best mode the best plan is used.
+func selectDrainPlan(plans []*drainPlan) *drainPlan {
+	if len(plans) < 1 {
+		return nil
+	}
+	if *drainSelection == drainSelectionFirst {
+		return plans[0]
+	}
+
+	best := plans[0]
+	for _, plan := range plans[1:] {
+		if plan.betterThan(best) {
+			best = plan
+		}
+	}
+	return best
+}
+
+// Works out the node group of a node from its node group label. Nodes without
+// the label are treated as being in a group of their own.
+func nodeGroup(node *apiv1.Node, label string) string {
+	if group, ok := node.Labels[label]; ok && group != "" {
+		return "group/" + group
+	}
+	return "node/" + node.Name
+}
+
+// Counts the pods which would need to be moved to empty each node group.
+func nodeGroupPods(nodeInfos nodes.NodeInfoArray, pdbs []*policyv1.PodDisruptionBudget, label string) map[string]int {
+	groupPods := make(map[string]int)
+	for _, nodeInfo := range nodeInfos {
+		count := len(nodeInfo.Pods)
+		if pods, err := getPodsForDeletion(nodeInfo, pdbs); err == nil {
+			count = len(pods)
+		}
+		groupPods[nodeGroup(nodeInfo.Node, label)] += count
+	}
+	return groupPods
+}
+
+// Sorts a copy of the nodes so those in groups with the fewest pods come
+// first, keeping the existing order within each group.
+func sortByNodeGroup(nodeInfos nodes.NodeInfoArray, groupPods map[string]int, label string) nodes.NodeInfoArray {
+	sorted := make(nodes.NodeInfoArray, len(nodeInfos))
+	copy(sorted, nodeInfos)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return groupPods[nodeGroup(sorted[i].Node, label)] < groupPods[nodeGroup(sorted[j].Node, label)]
+	})
+	return sorted
+}
+
+// planView is the JSON description of the latest drain plan.
+type planView struct {
+	// Node is the on-demand node to be drained, empty if no node could be.
+	Node string `json:"node"`
+	// Pods maps each pod to be evicted to the node it should move to.
+	Pods map[string]string `json:"pods"`
+	Time time.Time         `json:"time"`
+}
+
+// latestPlan holds the plan most recently selected by the main loop for the
+// plan endpoint.
+type latestPlan struct {
+	mu   sync.Mutex
+	view planView
+}
+
+// Records the selected plan, or that no node could be drained if nil.
+func (l *latestPlan) record(plan *drainPlan, now time.Time) {
+	view := planView{Pods: map[string]string{}, Time: now}
+	if plan != nil {
+		view.Node = plan.node.Node.Name
+		view.Pods = newPreDrainHookRequest(plan).Pods
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.view = view
+}
+
+func (l *latestPlan) get() planView {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.view
+}
+
+// Serves the latest plan as JSON.
+func newPlanHandler(l *latestPlan) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(l.get())
+	})
+}
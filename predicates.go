@@ -0,0 +1,97 @@
+/*
+Copyright 2017 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pusher/k8s-spot-rescheduler/metrics"
+	simulator "k8s.io/autoscaler/cluster-autoscaler/simulator"
+	kube_client "k8s.io/client-go/kubernetes"
+	"k8s.io/kubernetes/pkg/scheduler/factory"
+)
+
+// How long a new predicate checker's informers are given to sync before it
+// replaces the existing checker.
+const predicateCheckerSyncDelay = 30 * time.Second
+
+// refreshedPredicateChecker is a newly built predicate checker along with the
+// channel which stops its informers.
+type refreshedPredicateChecker struct {
+	checker *simulator.PredicateChecker
+	stop    chan struct{}
+}
+
+// Builds a new predicate checker, picking up any changes to the scheduler
+// configuration, and sends it to the main loop once its informers have had
+// time to sync. The checker reads from informer caches, so it doesn't make API
+// requests per check and only needs rebuilding to pick up new configuration.
+func refreshPredicateChecker(kubeClient kube_client.Interface, refreshed chan<- refreshedPredicateChecker) {
+	stop := make(chan struct{})
+	checker, err := simulator.NewPredicateChecker(kubeClient, stop)
+	if err != nil {
+		close(stop)
+		glog.Errorf("Failed to refresh predicate checker, continuing with the existing one: %v", err)
+		metrics.UpdatePredicateRefresh(false)
+		return
+	}
+
+	time.Sleep(predicateCheckerSyncDelay)
+	refreshed <- refreshedPredicateChecker{checker: checker, stop: stop}
+	metrics.UpdatePredicateRefresh(true)
+}
+
+// Removes the comma separated predicates from the scheduler's default
+// algorithm provider, which predicate checkers are built from, so the checkers
+// built afterwards don't run them. Every name is checked before any are
+// removed, rejecting names which aren't registered or which the default
+// provider doesn't run.
+func disablePredicates(names string) error {
+	if names == "" {
+		return nil
+	}
+	provider, err := factory.GetAlgorithmProvider(factory.DefaultProvider)
+	if err != nil {
+		return err
+	}
+
+	disabled := make([]string, 0)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !factory.IsFitPredicateRegistered(name) {
+			return fmt.Errorf("unknown predicate %q", name)
+		}
+		if !provider.FitPredicateKeys.Has(name) {
+			return fmt.Errorf("predicate %q isn't run by default, so can't be disabled", name)
+		}
+		disabled = append(disabled, name)
+	}
+
+	for _, name := range disabled {
+		if err := factory.RemovePredicateKeyFromAlgoProvider(factory.DefaultProvider, name); err != nil {
+			return err
+		}
+		glog.V(1).Infof("Disabled predicate %s", name)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2017 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// spotPricePrefix marks an entry of the price map as a spot price.
+const spotPricePrefix = "spot:"
+
+// priceMap holds the hourly on-demand and spot prices of instance types.
+type priceMap struct {
+	onDemand map[string]float64
+	spot     map[string]float64
+}
+
+// Parses a comma separated list of <instance-type>=<price> on-demand prices
+// and spot:<instance-type>=<price> spot prices.
+func parsePriceMap(value string) (priceMap, error) {
+	prices := priceMap{onDemand: make(map[string]float64), spot: make(map[string]float64)}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return prices, fmt.Errorf("the price map entry is not valid: expected '<instance-type>=<price>' or 'spot:<instance-type>=<price>', but got %s", entry)
+		}
+		price, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || price < 0 {
+			return prices, fmt.Errorf("the price of %s is not a valid price: %s", parts[0], parts[1])
+		}
+		if strings.HasPrefix(parts[0], spotPricePrefix) {
+			prices.spot[strings.TrimPrefix(parts[0], spotPricePrefix)] = price
+			continue
+		}
+		prices.onDemand[parts[0]] = price
+	}
+	return prices, nil
+}
+
+// Estimates the hourly saving from draining an on-demand node of the instance
+// type, less the spot price of the same instance type if known. Returns false
+// if the on-demand price of the instance type isn't known.
+func (p priceMap) hourlySaving(instanceType string) (float64, bool) {
+	price, ok := p.onDemand[instanceType]
+	if !ok {
+		return 0, false
+	}
+	return price - p.spot[instanceType], true
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2017 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pusher/k8s-spot-rescheduler/metrics"
+)
+
+const (
+	drainOutcomeSuccess = "Success"
+	drainOutcomeFailure = "Failure"
+
+	// publishTimeout is how long publishing a single event may take.
+	publishTimeout = 10 * time.Second
+)
+
+// drainEvent describes a drain decision and its outcome for publishing.
+type drainEvent struct {
+	Node string `json:"node"`
+	// Pods maps each pod that was evicted to the spot node it should move to.
+	Pods    map[string]string `json:"pods"`
+	Outcome string            `json:"outcome"`
+	Error   string            `json:"error,omitempty"`
+	Time    time.Time         `json:"time"`
+}
+
+func newDrainEvent(plan *drainPlan, err error, now time.Time) drainEvent {
+	event := drainEvent{
+		Node:    plan.node.Node.Name,
+		Pods:    newPreDrainHookRequest(plan).Pods,
+		Outcome: drainOutcomeSuccess,
+		Time:    now,
+	}
+	if err != nil {
+		event.Outcome = drainOutcomeFailure
+		event.Error = err.Error()
+	}
+	return event
+}
+
+// publisher sends drain events to downstream systems.
+type publisher interface {
+	Publish(event drainEvent) error
+}
+
+// noopPublisher discards events, used when publishing is disabled.
+type noopPublisher struct{}
+
+func (noopPublisher) Publish(drainEvent) error {
+	return nil
+}
+
+// httpPublisher POSTs each event as JSON to an endpoint, such as the REST
+// proxy in front of a message queue.
+type httpPublisher struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPPublisher(url string) *httpPublisher {
+	return &httpPublisher{url: url, client: &http.Client{Timeout: publishTimeout}}
+}
+
+func (p *httpPublisher) Publish(event drainEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode drain event: %v", err)
+	}
+	resp, err := p.client.Post(p.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to publish drain event to %s: %v", p.url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("failed to publish drain event to %s: status %s", p.url, resp.Status)
+	}
+	return nil
+}
+
+// asyncPublisher buffers events and publishes them in the background so
+// publishing never blocks the housekeeping loop. Events are dropped while the
+// buffer is full.
+type asyncPublisher struct {
+	events chan drainEvent
+	next   publisher
+}
+
+// Creates an asyncPublisher buffering up to size events for next, and starts
+// publishing them.
+func newAsyncPublisher(next publisher, size int) *asyncPublisher {
+	p := &asyncPublisher{
+		events: make(chan drainEvent, size),
+		next:   next,
+	}
+	go p.run()
+	return p
+}
+
+func (p *asyncPublisher) Publish(event drainEvent) error {
+	select {
+	case p.events <- event:
+		return nil
+	default:
+		metrics.UpdatePublishDropped()
+		return fmt.Errorf("publish buffer is full, dropping drain event for node %s", event.Node)
+	}
+}
+
+func (p *asyncPublisher) run() {
+	for event := range p.events {
+		if err := p.next.Publish(event); err != nil {
+			glog.Errorf("%v", err)
+		}
+	}
+}
+
+// multiPublisher publishes each event to every one of its publishers.
+type multiPublisher []publisher
+
+func (p multiPublisher) Publish(event drainEvent) error {
+	errs := make([]string, 0)
+	for _, next := range p {
+		if err := next.Publish(event); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Creates the publisher configured by the flags. Each destination gets its
+// own buffer so a slow endpoint doesn't hold up the others.
+func newPublisher(url string, slackWebhookURL string, bufferSize int) publisher {
+	publishers := make(multiPublisher, 0)
+	if url != "" {
+		publishers = append(publishers, newAsyncPublisher(newHTTPPublisher(url), bufferSize))
+	}
+	if slackWebhookURL != "" {
+		publishers = append(publishers, newAsyncPublisher(newSlackPublisher(slackWebhookURL), bufferSize))
+	}
+	switch len(publishers) {
+	case 0:
+		return noopPublisher{}
+	case 1:
+		return publishers[0]
+	}
+	return publishers
+}
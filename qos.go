@@ -0,0 +1,79 @@
+/*
+Copyright 2017 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pusher/k8s-spot-rescheduler/nodes"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/kubernetes/pkg/apis/core/v1/helper/qos"
+)
+
+// Returns an error if any of the pods are Guaranteed QoS and Guaranteed pods
+// are protected from being moved.
+func checkQoS(pods []*apiv1.Pod) error {
+	if !*protectGuaranteedPods {
+		return nil
+	}
+	for _, pod := range pods {
+		if qos.GetPodQOS(pod) == apiv1.PodQOSGuaranteed {
+			return fmt.Errorf("pod %s has Guaranteed QoS and is protected", podID(pod))
+		}
+	}
+	return nil
+}
+
+// Sorts a copy of the nodes so those with the fewest pods which aren't
+// BestEffort QoS come first, keeping the existing order otherwise.
+func sortByBestEffort(nodeInfos nodes.NodeInfoArray) nodes.NodeInfoArray {
+	counts := make(map[*nodes.NodeInfo]int, len(nodeInfos))
+	for _, nodeInfo := range nodeInfos {
+		for _, pod := range nodeInfo.Pods {
+			if qos.GetPodQOS(pod) != apiv1.PodQOSBestEffort {
+				counts[nodeInfo]++
+			}
+		}
+	}
+
+	sorted := make(nodes.NodeInfoArray, len(nodeInfos))
+	copy(sorted, nodeInfos)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return counts[sorted[i]] < counts[sorted[j]]
+	})
+	return sorted
+}
+
+// Sorts a copy of the pods so those with the lowest priority come first,
+// keeping the existing order otherwise. Pods without a priority are treated
+// as priority 0.
+func sortByPodPriority(pods []*apiv1.Pod) []*apiv1.Pod {
+	sorted := make([]*apiv1.Pod, len(pods))
+	copy(sorted, pods)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return podPriority(sorted[i]) < podPriority(sorted[j])
+	})
+	return sorted
+}
+
+func podPriority(pod *apiv1.Pod) int32 {
+	if pod.Spec.Priority == nil {
+		return 0
+	}
+	return *pod.Spec.Priority
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2017 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kube_client "k8s.io/client-go/kubernetes"
+)
+
+// readyFailureThreshold is how many list calls in a row must fail for the
+// rescheduler to no longer be ready.
+const readyFailureThreshold = 3
+
+// readiness tracks whether the rescheduler can reach the API server.
+type readiness struct {
+	mu        sync.Mutex
+	succeeded bool
+	failures  int
+	lastErr   error
+}
+
+// Records the outcome of listing from the API server.
+func (r *readiness) record(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.failures++
+		r.lastErr = err
+		return
+	}
+	r.succeeded = true
+	r.failures = 0
+	r.lastErr = nil
+}
+
+// Determines if a list has succeeded and the latest lists haven't all failed.
+func (r *readiness) ready() (bool, string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.succeeded {
+		return false, "nodes have not been listed yet"
+	}
+	if r.failures >= readyFailureThreshold {
+		return false, fmt.Sprintf("the last %d lists failed: %v", r.failures, r.lastErr)
+	}
+	return true, ""
+}
+
+// Serves 200 while the rescheduler is ready and 503 otherwise, for use as a
+// readiness probe.
+func newReadyzHandler(r *readiness) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if ok, reason := r.ready(); !ok {
+			http.Error(w, reason, http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// Lists a node every interval until stopped, recording the outcome, so that
+// replicas waiting to become leader report whether they can reach the API.
+func checkConnectivity(kubeClient kube_client.Interface, r *readiness, interval time.Duration, stop <-chan struct{}) {
+	for {
+		_, err := kubeClient.CoreV1().Nodes().List(metav1.ListOptions{Limit: 1})
+		if err != nil {
+			glog.Errorf("Failed to list nodes: %v", err)
+		}
+		r.record(err)
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2017 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pusher/k8s-spot-rescheduler/nodes"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// defaultPodRequests are assigned to containers without requests when
+// simulating pod placement, empty if no defaults are set.
+var defaultPodRequests = apiv1.ResourceList{}
+
+// Parses the default CPU and memory requests provided as arguments, leaving
+// out any which are zero.
+func parseDefaultPodRequests(cpu string, memory string) (apiv1.ResourceList, error) {
+	requests := apiv1.ResourceList{}
+	for name, value := range map[apiv1.ResourceName]string{apiv1.ResourceCPU: cpu, apiv1.ResourceMemory: memory} {
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, fmt.Errorf("the default pod %s request is not valid: %v", name, err)
+		}
+		if !quantity.IsZero() {
+			requests[name] = quantity
+		}
+	}
+	return requests, nil
+}
+
+// Returns the pod with the default requests set on any containers which don't
+// request those resources. The pod is only copied if it needs to be changed.
+func withDefaultRequests(pod *apiv1.Pod) *apiv1.Pod {
+	if !needsDefaultRequests(pod) {
+		return pod
+	}
+
+	pod = pod.DeepCopy()
+	for i := range pod.Spec.Containers {
+		container := &pod.Spec.Containers[i]
+		if container.Resources.Requests == nil {
+			container.Resources.Requests = apiv1.ResourceList{}
+		}
+		for name, quantity := range defaultPodRequests {
+			if _, ok := container.Resources.Requests[name]; !ok {
+				container.Resources.Requests[name] = quantity
+			}
+		}
+	}
+	return pod
+}
+
+// Applies withDefaultRequests to each of the pods.
+func withDefaultRequestsAll(pods []*apiv1.Pod) []*apiv1.Pod {
+	if len(defaultPodRequests) == 0 {
+		return pods
+	}
+
+	defaulted := make([]*apiv1.Pod, 0, len(pods))
+	for _, pod := range pods {
+		defaulted = append(defaulted, withDefaultRequests(pod))
+	}
+	return defaulted
+}
+
+// Returns the total requests of the pods on the node, with the default requests
+// applied. The cached requests can only be used when no requests are defaulted.
+func nodeRequests(nodeInfo *nodes.NodeInfo) apiv1.ResourceList {
+	if len(defaultPodRequests) > 0 {
+		return nodes.PodRequests(withDefaultRequestsAll(nodeInfo.Pods)...)
+	}
+	return nodeInfo.RequestedResources()
+}
+
+// Sorts a copy of the pods by decreasing CPU request, then decreasing memory
+// request, with the default requests applied.
+func sortByRequests(pods []*apiv1.Pod) []*apiv1.Pod {
+	cpu := make(map[*apiv1.Pod]int64, len(pods))
+	memory := make(map[*apiv1.Pod]int64, len(pods))
+	for _, pod := range pods {
+		requests := nodes.PodRequests(withDefaultRequests(pod))
+		cpu[pod], memory[pod] = requests.Cpu().MilliValue(), requests.Memory().Value()
+	}
+
+	sorted := make([]*apiv1.Pod, len(pods))
+	copy(sorted, pods)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if cpu[sorted[i]] != cpu[sorted[j]] {
+			return cpu[sorted[i]] > cpu[sorted[j]]
+		}
+		return memory[sorted[i]] > memory[sorted[j]]
+	})
+	return sorted
+}
+
+// Determines if any of the pod's containers are missing a request which has
+// a default.
+func needsDefaultRequests(pod *apiv1.Pod) bool {
+	for _, container := range pod.Spec.Containers {
+		for name := range defaultPodRequests {
+			if _, ok := container.Resources.Requests[name]; !ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -17,10 +17,14 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	goflag "flag"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"runtime/debug"
+	"sort"
 	"strings"
 	"time"
 
@@ -29,7 +33,10 @@ import (
 	"github.com/pusher/k8s-spot-rescheduler/scaler"
 	apiv1 "k8s.io/api/core/v1"
 	policyv1 "k8s.io/api/policy/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	simulator "k8s.io/autoscaler/cluster-autoscaler/simulator"
 	autoscaler_drain "k8s.io/autoscaler/cluster-autoscaler/utils/drain"
 	kube_utils "k8s.io/autoscaler/cluster-autoscaler/utils/kubernetes"
@@ -49,6 +56,15 @@ import (
 	flag "github.com/spf13/pflag"
 )
 
+const (
+	// serviceAccountNamespaceFile holds the namespace of the pod's service account.
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+	// schedulingGatedReason is the PodScheduled reason given to pods with
+	// scheduling gates.
+	schedulingGatedReason = "SchedulingGated"
+)
+
 var (
 	flags = flag.NewFlagSet(
 		`rescheduler: rescheduler --running-in-cluster=true`,
@@ -59,31 +75,374 @@ var (
 		 pod secrets for creating a Kubernetes client.`)
 
 	namespace = flags.String("namespace", "kube-system",
-		`Namespace in which k8s-spot-rescheduler is run`)
+		`Namespace in which k8s-spot-rescheduler is run. Used when
+		 rescheduler-namespace is not set and can't be detected.`)
+
+	reschedulerNamespaceFlag = flags.String("rescheduler-namespace", "",
+		`Namespace for resources owned by the rescheduler, such as the leader
+		 election lock. Detected from the service account when running in the
+		 cluster if not set.`)
 
 	contentType = flags.String("kube-api-content-type", "application/vnd.kubernetes.protobuf",
 		`Content type of requests sent to apiserver.`)
 
+	kubeAPIQPS = flags.Float64("kube-api-qps", 5,
+		`Maximum queries per second sent to the apiserver.`)
+
+	kubeAPIBurst = flags.Int("kube-api-burst", 10,
+		`Maximum burst of queries sent to the apiserver above the QPS limit.`)
+
+	cycleTimeout = flags.Duration("cycle-timeout", 0,
+		`Longest a housekeeping cycle may spend planning drains.
+		 When it runs out no further drains are planned or started in the cycle,
+		 although a drain already under way is finished. 0 disables this.`)
+
 	housekeepingInterval = flags.Duration("housekeeping-interval", 10*time.Second,
 		`How often rescheduler takes actions.`)
 
+	maxPendingPods = flags.Int("max-pending-pods", 0,
+		`Pause draining while more than this many pods are Pending across the
+		 cluster. 0 disables this check.`)
+
 	nodeDrainDelay = flags.Duration("node-drain-delay", 10*time.Minute,
 		`How long the scheduler should wait between draining nodes.`)
 
+	perNodeDrainDelay = flags.Bool("per-node-drain-delay", false,
+		`Apply node-drain-delay to each node separately, so a drained node isn't
+		 drained again too soon while other nodes are still drained, up to
+		 max-drains-per-cycle each cycle.`)
+
+	planDuringCooldown = flags.Bool("plan-during-cooldown", false,
+		`Keep planning drains while waiting for the node drain delay, counting the
+		 drains it defers without acting on them.`)
+
 	podEvictionTimeout = flags.Duration("pod-eviction-timeout", 2*time.Minute,
 		`How long should the rescheduler attempt to retrieve successful pod
 		 evictions for.`)
 
+	minOnDemandNodes = flags.Int("min-on-demand-nodes", 0,
+		`Minimum number of non-empty on-demand nodes to keep. Nodes are not drained
+		 if doing so would leave fewer. 0 disables this.`)
+
+	drainEmptyNodes = flags.Bool("drain-empty-nodes", false,
+		`Cordon on-demand nodes without any pods to move, DaemonSet and mirror pods
+		 aside, so that the cluster autoscaler can remove them. Each cordon counts
+		 towards --max-drains-per-cycle. By default they are skipped and left
+		 schedulable.`)
+
+	maxDrainsPerCycle = flags.Int("max-drains-per-cycle", 1,
+		`Maximum number of on-demand nodes drained in a housekeeping cycle. Later
+		 drains only follow straight away once the node drain delay has passed,
+		 otherwise they are left to later cycles.`)
+
+	evictionRetryTime = flags.Duration("eviction-retry-time", scaler.EvictionRetryTime,
+		`How long to wait between attempts to evict a pod.`)
+
 	maxGracefulTermination = flags.Duration("max-graceful-termination", 2*time.Minute,
 		`How long should the rescheduler wait for pods to shutdown gracefully before
 		 failing the node drain attempt.`)
 
+	overrideGracePeriod = flags.Int("override-grace-period", -1,
+		`Grace period in seconds given to pods when they are evicted, overriding their
+		 own termination grace period. -1 honors the pod's own value.`)
+
+	metricsInterval = flags.Duration("metrics-interval", 0,
+		`How often cluster metrics are updated, separately from the housekeeping
+		 cycle. 0 updates them during each housekeeping cycle.`)
+
+	predicateRefreshInterval = flags.Duration("predicate-refresh-interval", 0,
+		`How often the scheduler predicates used to check where pods fit are rebuilt,
+		 picking up scheduler configuration changes. 0 disables this.`)
+
+	disabledPredicatesFlag = flags.String("disabled-predicates", "",
+		`Comma separated names of scheduler predicates not to check when working
+		 out where pods can move, such as MatchInterPodAffinity.`)
+
+	statusReportInterval = flags.Duration("status-report-interval", 0,
+		`How often a summary of the rescheduler's activity is printed to stdout.
+		 0 disables this.`)
+
 	listenAddress = flags.String("listen-address", "localhost:9235",
 		`Address to listen on for serving prometheus metrics`)
 
+	maxNodeDrainAttempts = flags.Int("max-node-drain-attempts", 0,
+		`How many consecutive times draining a node may fail before the node is
+		 annotated and skipped until the annotation is removed. 0 means unlimited.`)
+
+	maxDrainBackoff = flags.Duration("max-drain-backoff", 0,
+		`Longest time a node which keeps failing to drain is skipped for. After each
+		 consecutive failure the node is skipped for twice as long, starting from
+		 node-drain-delay. 0 disables this.`)
+
+	topologyStabilizationDelay = flags.Duration("topology-stabilization-delay", 0,
+		`How long to wait before draining after the set of nodes in the cluster
+		 changes, to let the cluster settle. 0 disables this.`)
+
+	excludeTargetSelector = flags.String("exclude-target-selector", "",
+		`Label selector for spot nodes which should never be used as targets for
+		 rescheduled pods.`)
+
+	podExcludeSelector = flags.String("pod-exclude-selector", "",
+		`Label selector for pods which should never be moved, leaving nodes
+		 running them undrained.`)
+
+	maxMovesPerAppPerHour = flags.Int("max-moves-per-app-per-hour", 0,
+		`How many times within an hour the pods of a single application may be moved
+		 before nodes hosting it are skipped. 0 means unlimited.`)
+
+	maxDrainsPerZone = flags.Int("max-drains-per-zone", 0,
+		`How many nodes may be drained in a single zone within the zone drain window.
+		 0 means unlimited.`)
+
+	zoneDrainWindow = flags.Duration("zone-drain-window", time.Hour,
+		`Rolling window over which drains per zone are counted.`)
+
+	minFreePodSlots = flags.Int("min-free-pod-slots", 0,
+		`Minimum number of pod slots which must remain free on a spot node after
+		 placing a pod on it.`)
+
+	spotNodeWarmup = flags.Duration("spot-node-warmup", 0,
+		`How long after a spot node joins the cluster or becomes ready before pods
+		 are moved onto it. 0 disables this.`)
+
+	priceMapFlag = flags.String("price-map", "",
+		`Comma separated hourly prices of instance types used to estimate savings,
+		 as <instance-type>=<price> for on-demand and spot:<instance-type>=<price>
+		 for spot prices.`)
+
+	evictLocalStoragePods = flags.Bool("evict-local-storage-pods", false,
+		`Move pods using local storage, such as emptyDir volumes, losing the data
+		 stored in it. Otherwise nodes running them are left undrained. Earlier
+		 releases always moved these pods, so set this to keep that behavior.`)
+
+	skipPodsWithPVC = flags.Bool("skip-pods-with-pvc", false,
+		`Leave nodes undrained while they run any pod using a PersistentVolumeClaim,
+		 whatever the type of volume.`)
+
+	respectPodPriority = flags.Bool("respect-pod-priority", false,
+		`Evict pods with the lowest priority first, so the most important pods stay
+		 on the node longest if the drain fails. Without --drain-concurrency pods
+		 are evicted one at a time to keep the order.`)
+
+	spotHeadroomPercent = flags.Float64("spot-headroom-percent", 0,
+		`Percentage of a spot node's allocatable CPU and memory which must remain
+		 unrequested after placing a pod on it. 0 disables this.`)
+
+	revalidateDuringDrain = flags.Bool("revalidate-during-drain", false,
+		`Evict pods one at a time and check the remaining pods still fit on the spot
+		 nodes before each eviction, aborting the drain if they don't.`)
+
+	drainSelection = flags.String("drain-selection", drainSelectionFirst,
+		`How to choose which on-demand node to drain. 'first' drains the first node
+		 whose pods can all be moved, 'best' plans every node and drains the best one.`)
+
+	drainOrder = flags.String("drain-order", drainOrderLeastUtilized,
+		`Order on-demand nodes are considered for draining in. 'least-utilized'
+		 and 'most-utilized' order by the fraction of CPU and memory requested,
+		 'oldest' orders by node age.`)
+
+	packingStrategy = flags.String("packing-strategy", packingStrategyFirstFit,
+		`How to choose which spot node a pod moves to. 'first-fit' uses the first
+		 spot node the pod fits on, in order of most requested CPU, 'best-fit' uses
+		 the spot node with the least CPU and memory left over after placing the
+		 pod, 'worst-fit' uses the spot node with the most left over. Pods are
+		 placed largest request first.`)
+
+	targetSelection = flags.String("target-selection", targetSelectionMostRequested,
+		`Deprecated name of packing-strategy, with 'most-requested' for first-fit.`)
+
+	defaultPodRequestCPU = flags.String("default-pod-request-cpu", "0",
+		`CPU request assumed for containers without one when working out where pods
+		 fit. 0 treats them as requesting nothing.`)
+
+	defaultPodRequestMemory = flags.String("default-pod-request-memory", "0",
+		`Memory request assumed for containers without one when working out where
+		 pods fit. 0 treats them as requesting nothing.`)
+
+	protectGuaranteedPods = flags.Bool("protect-guaranteed-pods", false,
+		`Never move pods with Guaranteed QoS, leaving nodes running them undrained.`)
+
+	preferBestEffortNodes = flags.Bool("prefer-best-effort-nodes", false,
+		`Consider on-demand nodes running the fewest pods which aren't BestEffort QoS
+		 for draining first.`)
+
+	minPodAge = flags.Duration("min-pod-age", 0,
+		`How long pods must have been running before they are moved. Nodes running
+		 younger pods are skipped until the pods are old enough. 0 disables this.`)
+
+	skipPodsOwnedBy = flags.StringSlice("skip-pods-owned-by", []string{},
+		`Owner kinds, as <group>/<Kind> or <Kind>, whose pods are never moved,
+		 leaving nodes running them undrained.`)
+
+	includeNamespaces = flags.StringSlice("include-namespaces", []string{},
+		`Namespaces whose pods may be moved. When set, nodes running pods in any
+		 other namespace are left undrained.`)
+
+	excludeNamespaces = flags.StringSlice("exclude-namespaces", []string{},
+		`Namespaces whose pods are never moved, leaving nodes running them
+		 undrained. Takes precedence over include-namespaces.`)
+
+	consolidateOnDemand = flags.Bool("consolidate-on-demand", false,
+		`Move pods which don't fit onto any spot node onto other on-demand nodes
+		 instead, so that on-demand nodes can be consolidated.`)
+
+	optimizeNodeGroups = flags.Bool("optimize-node-groups", false,
+		`Prefer draining on-demand nodes in the node groups with the fewest pods, so
+		 that whole node groups can be scaled down. Requires node-group-label.`)
+
+	nodeGroupLabel = flags.String("node-group-label", "",
+		`Label key holding the name of the node group a node belongs to.`)
+
 	deleteNonReplicatedPods = flags.Bool("delete-non-replicated-pods", false, `Delete non-replicated pods running on on-demand instance. Note that some non-replicated pods will not be rescheduled.`)
 
+	publishURL = flags.String("publish-url", "",
+		`Endpoint each drain decision and its outcome is POSTed to as JSON, such
+		 as the REST proxy of a message queue. Events are published in the
+		 background.`)
+
+	publishBufferSize = flags.Int("publish-buffer-size", 100,
+		`Number of drain events buffered for publishing, after which new events
+		 are dropped.`)
+
+	slackWebhookURL = flags.String("slack-webhook-url", "",
+		`Slack Incoming Webhook a summary of each drain and its outcome is
+		 posted to. Messages are posted in the background.`)
+
+	shutdownGracePeriod = flags.Duration("shutdown-grace-period", 3*time.Minute,
+		`How long to wait after SIGTERM or SIGINT for the current housekeeping
+		 cycle, including any drain, to finish before exiting.`)
+
+	dryRun = flags.Bool("dry-run", false,
+		`Plan drains as usual but only log which pods would be evicted and where
+		 they would move to, without evicting them or running pre-drain hooks.`)
+
+	allowPartialDrain = flags.Bool("allow-partial-drain", false,
+		`Move the pods which fit onto spot nodes even when others on the node
+		 don't, leaving those where they are. Nodes are drained gradually over
+		 cycles rather than all or nothing.`)
+
+	handleSpotInterruptions = flags.Bool("handle-spot-interruptions", false,
+		`Evacuate spot nodes with the spot interruption taint straight away,
+		 moving their pods onto the other spot nodes or back onto on-demand nodes
+		 before the instance is terminated. This ignores the node drain delay.`)
+
+	globalPlanning = flags.Bool("global-planning", false,
+		`Plan every on-demand node in a cycle against one model of the spot capacity,
+		 so plans account for the pods of nodes drained before them and similar
+		 pods share predicate checks.`)
+
+	daemonSetPods = flags.String("daemonset-pods", daemonSetPodsIgnore,
+		`What to do with DaemonSet pods on drained nodes. 'ignore' leaves them to
+		 go with the node, 'delete' deletes them once after the other pods have
+		 moved. They are never evicted, as their controller would recreate them.`)
+
+	preDrainHookURL = flags.String("pre-drain-hook-url", "",
+		`URL which is POSTed the details of each drain before it starts. The drain
+		 only goes ahead if it responds with 200 OK.`)
+
+	preDrainHookRequireAllow = flags.Bool("pre-drain-hook-require-allow", false,
+		`Require the pre-drain hook URL to approve each drain by responding with
+		 {"allow": true} as well as 200 OK, otherwise the node is skipped.`)
+
+	preDrainHookCommand = flags.String("pre-drain-hook-command", "",
+		`Command which is run with the details of each drain on stdin before it
+		 starts. The drain only goes ahead if it exits successfully.`)
+
+	preDrainHookTimeout = flags.Duration("pre-drain-hook-timeout", 10*time.Second,
+		`How long to wait for a pre-drain hook before aborting the drain.`)
+
+	logDedupWindow = flags.Duration("log-dedup-window", 5*time.Minute,
+		`How long identical per-node log messages are suppressed for after being
+		 logged. 0 disables this.`)
+
+	strictLabelValidation = flags.Bool("strict-label-validation", false,
+		`Exit at startup if no node matches the on-demand node label or none
+		 matches the spot node labels, instead of only logging a warning.`)
+
+	logFormat = flags.String("log-format", logFormatText,
+		`Format of log lines, 'text' for glog's format or 'json' for a JSON object
+		 per line with the level, time, message and any context.`)
+
+	maintenanceResourceFlag = flags.String("maintenance-resource", "",
+		`Resource checked each cycle for the maintenance annotation, which pauses all
+		 draining while set to true. Either configmap/<name>, in the rescheduler
+		 namespace, or namespace/<name>.`)
+
+	activeWindowFlag = flags.String("active-window", "",
+		`Time of day in which draining is allowed, as HH:MM-HH:MM optionally
+		 preceded by a day or range of days, such as "Mon-Fri 09:00-17:00".
+		 Draining is allowed at any time when empty.`)
+
+	timezone = flags.String("timezone", "UTC",
+		`Time zone the active window is in, such as Europe/London.`)
+
+	cooldownOverrideConfigMap = flags.String("cooldown-override-configmap", "",
+		`ConfigMap in the rescheduler namespace checked for the cooldown override
+		 annotation, which skips the node drain delay until the time it is set to.`)
+
+	enableAdminAPI = flags.Bool("enable-admin-api", false,
+		`Serve the admin API on the listen address, allowing operators to force a
+		 node to be drained with POST /drain?node=<name>.`)
+
+	adminAPISecret = flags.String("admin-api-secret", "",
+		`Shared secret which must be sent as a bearer token to use the admin API.`)
+
+	tlsCertFile = flags.String("tls-cert-file", "",
+		`Certificate file to serve the listen address over TLS with. Plaintext is
+		 served unless this and the key file are set.`)
+
+	tlsKeyFile = flags.String("tls-key-file", "",
+		`Private key file for the TLS certificate.`)
+
+	tlsClientCAFile = flags.String("tls-client-ca-file", "",
+		`CA file used to verify client certificates, which are then required to
+		 scrape /metrics.`)
+
+	enablePprof = flags.Bool("enable-pprof", false,
+		`Serve the pprof profiling endpoints under /debug/pprof/ on the listen
+		 address, or on the pprof address if set.`)
+
+	pprofAddress = flags.String("pprof-address", "",
+		`Address to serve the pprof endpoints on instead of the listen address.`)
+
 	showVersion = flags.Bool("version", false, "Show version information and exit.")
+
+	// reschedulerNamespace is the namespace used for all rescheduler-owned resources.
+	reschedulerNamespace string
+
+	// maintenance is parsed from maintenanceResourceFlag, nil if unset.
+	maintenance *maintenanceResource
+
+	// window is parsed from activeWindowFlag, nil if unset.
+	window *activeWindow
+
+	// drainPublisher sends drain events downstream, a no-op unless enabled.
+	drainPublisher publisher = noopPublisher{}
+
+	// dedupLog collapses repeated per-node log messages, built from
+	// logDedupWindow once the flags are parsed. Nothing is collapsed before then.
+	dedupLog *dedupLogger
+
+	// health tracks the main loop for the liveness endpoint.
+	health = &loopHealth{}
+
+	// ready tracks API server connectivity for the readiness endpoint.
+	ready = &readiness{}
+
+	// plans holds the latest drain plan for the plan endpoint.
+	plans = &latestPlan{}
+
+	// forceDrainRequests passes nodes from the admin API to the main loop.
+	forceDrainRequests = make(chan forceDrainRequest)
+
+	// excludedTargets is parsed from excludeTargetSelector, nil if unset.
+	excludedTargets labels.Selector
+
+	// protectedPods is parsed from podExcludeSelector, nil if unset.
+	protectedPods labels.Selector
+
+	// prices is parsed from priceMapFlag.
+	prices priceMap
 )
 
 func main() {
@@ -102,12 +461,65 @@ func main() {
 	flags.StringVar(&nodes.SpotNodeLabel,
 		"spot-node-label",
 		"kubernetes.io/role=spot-worker",
-		`Name of label on nodes to be considered as targets for pods.`)
+		`Comma separated names of labels on nodes to be considered as targets
+		 for pods. Nodes with any of the labels are targets.`)
+
+	flags.StringVar(&nodes.OnDemandNodeTaint,
+		"on-demand-node-taint",
+		"",
+		`Taint on nodes to be considered for draining, as <key>[=<value>][:<effect>],
+		 in addition to the on-demand node label.`)
+	flags.StringVar(&nodes.SpotNodeTaint,
+		"spot-node-taint",
+		"",
+		`Taint on nodes to be considered as targets for pods, as
+		 <key>[=<value>][:<effect>], in addition to the spot node labels.`)
+	flags.StringVar(&nodes.SpotInterruptionTaint,
+		"spot-interruption-taint",
+		"aws-node-termination-handler/spot-itn",
+		`Taint given to spot nodes about to be interrupted, as
+		 <key>[=<value>][:<effect>]. Used with --handle-spot-interruptions.`)
+
+	flags.StringVar(&nodes.SpotNodePriorityLabel,
+		"spot-node-priority-label",
+		"",
+		`Label on spot nodes holding an integer priority, spot nodes with a higher
+		 priority are filled first. Nodes without the label are filled last.`)
+
+	flags.StringVar(&nodes.ExcludeAnnotation,
+		"exclude-node-annotation",
+		nodes.ExcludeAnnotation,
+		`Annotation which excludes an on-demand node from draining while set to true.`)
+
+	flags.IntVar(&nodes.NodeMapWorkers,
+		"node-map-workers",
+		10,
+		`Number of nodes whose pods are fetched concurrently when building the node map.`)
+	flags.DurationVar(&scaler.MaxPreStopGracePeriod,
+		"max-prestop-grace-period",
+		0,
+		`Longest grace period given to pods with a PreStop hook whose own termination
+		 grace period is longer than override-grace-period. 0 disables this.`)
+	flags.DurationVar(&scaler.ReplacementReadyTimeout,
+		"replacement-ready-timeout",
+		0,
+		`How long to wait at the end of a drain for the evicted pods' controllers to
+		 have Ready replacements before the node is released. 0 disables this.`)
+	flags.IntVar(&scaler.MaxInflightEvictions,
+		"max-global-inflight-evictions",
+		0,
+		`Maximum number of pod evictions in progress at once across all drains. 0 means unlimited.`)
+	flags.IntVar(&scaler.DrainConcurrency,
+		"drain-concurrency",
+		0,
+		`Maximum number of pod evictions in progress at once within a single drain. 0 means unlimited,
+		 unless --respect-pod-priority is set.`)
+	flags.MarkDeprecated("target-selection", "use --packing-strategy instead")
 
 	flags.Parse(os.Args)
 
 	if *showVersion {
-		fmt.Printf("k8s-spot-rescheduler %s\n", VERSION)
+		fmt.Printf("k8s-spot-rescheduler %s (commit %s, built %s)\n", VERSION, gitCommit, buildDate)
 		os.Exit(0)
 	}
 
@@ -117,21 +529,225 @@ func main() {
 		os.Exit(1)
 	}
 
+	err = validateDrainSelection(*drainSelection)
+	if err != nil {
+		fmt.Printf("Error: %s", err)
+		os.Exit(1)
+	}
+
+	err = validateDrainOrder(*drainOrder)
+	if err != nil {
+		fmt.Printf("Error: %s", err)
+		os.Exit(1)
+	}
+
+	// The deprecated target selection is used unless a packing strategy is set
+	if flags.Changed("target-selection") && !flags.Changed("packing-strategy") {
+		*packingStrategy = *targetSelection
+		if *targetSelection == targetSelectionMostRequested {
+			*packingStrategy = packingStrategyFirstFit
+		}
+	}
+	err = validatePackingStrategy(*packingStrategy)
+	if err != nil {
+		fmt.Printf("Error: %s", err)
+		os.Exit(1)
+	}
+
+	err = validateDaemonSetPods(*daemonSetPods)
+	if err != nil {
+		fmt.Printf("Error: %s", err)
+		os.Exit(1)
+	}
+
+	err = validateLogFormat(*logFormat)
+	if err != nil {
+		fmt.Printf("Error: %s", err)
+		os.Exit(1)
+	}
+
+	err = disablePredicates(*disabledPredicatesFlag)
+	if err != nil {
+		fmt.Printf("Error: %s", err)
+		os.Exit(1)
+	}
+
+	defaultPodRequests, err = parseDefaultPodRequests(*defaultPodRequestCPU, *defaultPodRequestMemory)
+	if err != nil {
+		fmt.Printf("Error: %s", err)
+		os.Exit(1)
+	}
+
+	maintenance, err = parseMaintenanceResource(*maintenanceResourceFlag)
+	if err != nil {
+		fmt.Printf("Error: %s", err)
+		os.Exit(1)
+	}
+
+	window, err = parseActiveWindow(*activeWindowFlag, *timezone)
+	if err != nil {
+		fmt.Printf("Error: %s", err)
+		os.Exit(1)
+	}
+
+	skippedOwners, err = parseOwnerKinds(*skipPodsOwnedBy)
+	if err != nil {
+		fmt.Printf("Error: %s", err)
+		os.Exit(1)
+	}
+
+	if *optimizeNodeGroups && *nodeGroupLabel == "" {
+		fmt.Printf("Error: --node-group-label must be set when optimizing node groups")
+		os.Exit(1)
+	}
+
+	excludedTargets, err = parseSelector(*excludeTargetSelector)
+	if err != nil {
+		fmt.Printf("Error: the exclude target selector is not valid: %s", err)
+		os.Exit(1)
+	}
+
+	protectedPods, err = parseSelector(*podExcludeSelector)
+	if err != nil {
+		fmt.Printf("Error: the pod exclude selector is not valid: %s", err)
+		os.Exit(1)
+	}
+
+	prices, err = parsePriceMap(*priceMapFlag)
+	if err != nil {
+		fmt.Printf("Error: %s", err)
+		os.Exit(1)
+	}
+
+	if *enableAdminAPI && *adminAPISecret == "" {
+		fmt.Printf("Error: --admin-api-secret must be set when the admin API is enabled")
+		os.Exit(1)
+	}
+
+	if (*publishURL != "" || *slackWebhookURL != "") && *publishBufferSize < 1 {
+		fmt.Printf("Error: --publish-buffer-size must be at least 1")
+		os.Exit(1)
+	}
+
+	if *spotHeadroomPercent < 0 || *spotHeadroomPercent >= 100 {
+		fmt.Printf("Error: --spot-headroom-percent must be at least 0 and less than 100")
+		os.Exit(1)
+	}
+
+	if *minOnDemandNodes < 0 {
+		fmt.Printf("Error: --min-on-demand-nodes must not be negative")
+		os.Exit(1)
+	}
+
+	if *maxDrainsPerCycle < 1 {
+		fmt.Printf("Error: --max-drains-per-cycle must be at least 1")
+		os.Exit(1)
+	}
+
+	if *kubeAPIQPS <= 0 || *kubeAPIBurst <= 0 {
+		fmt.Printf("Error: --kube-api-qps and --kube-api-burst must be positive")
+		os.Exit(1)
+	}
+
+	if scaler.DrainConcurrency < 0 {
+		fmt.Printf("Error: --drain-concurrency must not be negative")
+		os.Exit(1)
+	}
+
+	if *evictionRetryTime <= 0 {
+		fmt.Printf("Error: --eviction-retry-time must be greater than 0")
+		os.Exit(1)
+	}
+
+	if *overrideGracePeriod < -1 {
+		fmt.Printf("Error: --override-grace-period must be -1 or at least 0")
+		os.Exit(1)
+	}
+
+	err = validateTLSFlags(*tlsCertFile, *tlsKeyFile, *tlsClientCAFile)
+	if err != nil {
+		fmt.Printf("Error: %s", err)
+		os.Exit(1)
+	}
+	tlsConfig, err := newTLSConfig(*tlsClientCAFile)
+	if err != nil {
+		fmt.Printf("Error: %s", err)
+		os.Exit(1)
+	}
+
+	if *logFormat == logFormatJSON {
+		logs, err = startJSONLogging()
+		if err != nil {
+			fmt.Printf("Error: failed to start JSON logging: %s", err)
+			os.Exit(1)
+		}
+	}
+
 	glog.Infof("Running Rescheduler")
+	glog.Infof("Version %s, commit %s, built %s", VERSION, gitCommit, buildDate)
+	metrics.UpdateBuildInfo(VERSION, gitCommit)
+
+	dedupLog = newDedupLogger(*logDedupWindow)
+	drainPublisher = newPublisher(*publishURL, *slackWebhookURL, *publishBufferSize)
+
+	reschedulerNamespace = getReschedulerNamespace(*reschedulerNamespaceFlag, *inCluster, serviceAccountNamespaceFile)
+	glog.V(2).Infof("Using namespace %s for rescheduler resources", reschedulerNamespace)
 
 	// Register metrics from metrics.go
+	// Serve from our own mux, as importing pprof registers it on the default one
 	go func() {
-		http.Handle("/metrics", prometheus.Handler())
-		err := http.ListenAndServe(*listenAddress, nil)
+		mux := http.NewServeMux()
+		metricsHandler := prometheus.Handler()
+		if *tlsClientCAFile != "" {
+			metricsHandler = requireClientCert(metricsHandler)
+		}
+		mux.Handle("/metrics", metricsHandler)
+		mux.Handle("/healthz", newHealthzHandler(health, 2**housekeepingInterval))
+		mux.Handle("/readyz", newReadyzHandler(ready))
+		mux.Handle("/plan", newPlanHandler(plans))
+		mux.Handle("/version", newVersionHandler())
+		if *enableAdminAPI {
+			mux.Handle("/drain", newForceDrainHandler(*adminAPISecret, forceDrainRequests))
+		}
+		if *enablePprof && *pprofAddress == "" {
+			registerPprof(mux)
+		}
+		server := &http.Server{Addr: *listenAddress, Handler: mux, TLSConfig: tlsConfig}
+		var err error
+		if *tlsCertFile != "" {
+			err = server.ListenAndServeTLS(*tlsCertFile, *tlsKeyFile)
+		} else {
+			err = server.ListenAndServe()
+		}
 		glog.Fatalf("Failed to start metrics: %v", err)
 	}()
 
+	// Serve pprof on its own address if one is given
+	if *enablePprof && *pprofAddress != "" {
+		go func() {
+			mux := http.NewServeMux()
+			registerPprof(mux)
+			err := http.ListenAndServe(*pprofAddress, mux)
+			glog.Fatalf("Failed to start pprof: %v", err)
+		}()
+	}
+
 	kubeClient, err := createKubeClient(flags, *inCluster)
 	if err != nil {
 		glog.Fatalf("Failed to create kube client: %v", err)
 	}
 
+	// Evict with policy/v1 where it is served, as v1beta1 is removed in newer
+	// Kubernetes versions
+	if version, err := scaler.DetectEvictionVersion(kubeClient.Discovery()); err != nil {
+		glog.Warningf("Failed to detect the eviction API version, using %s: %v", scaler.EvictionVersion, err)
+	} else {
+		scaler.EvictionVersion = version
+		glog.V(2).Infof("Using the policy/%s eviction API", version)
+	}
+
 	recorder := createEventRecorder(kubeClient)
+	shutdown := handleShutdownSignals(*shutdownGracePeriod)
 
 	// Allows active/standy HA.
 	// Prevent multiple pods running the algorithm simultaneously.
@@ -143,17 +759,22 @@ func main() {
 	if !leaderElection.LeaderElect {
 		// Leader election not enabled.
 		// Execute main logic.
-		run(kubeClient, recorder)
+		run(kubeClient, recorder, shutdown)
+		glog.Flush()
 	} else {
 		id, err := os.Hostname()
 		if err != nil {
 			glog.Fatalf("Unable to get hostname: %v", err)
 		}
+		// Report readiness while waiting to become leader
+		connectivityStop := make(chan struct{})
+		go checkConnectivity(kubeClient, ready, *housekeepingInterval, connectivityStop)
+
 		// Leader election process
 		kube_leaderelection.RunOrDie(kube_leaderelection.LeaderElectionConfig{
 			Lock: &resourcelock.EndpointsLock{
 				EndpointsMeta: metav1.ObjectMeta{
-					Namespace: *namespace,
+					Namespace: reschedulerNamespace,
 					Name:      "k8s-spot-rescheduler",
 				},
 				Client: kubeClient.CoreV1(),
@@ -169,7 +790,11 @@ func main() {
 				OnStartedLeading: func(_ <-chan struct{}) {
 					// Since we are committing a suicide after losing
 					// mastership, we can safely ignore the argument.
-					run(kubeClient, recorder)
+					close(connectivityStop)
+					run(kubeClient, recorder, shutdown)
+					// Exit rather than carry on renewing the lease
+					glog.Flush()
+					os.Exit(0)
 				},
 				OnStoppedLeading: func() {
 					glog.Fatalf("Lost leader status, terminating.")
@@ -181,152 +806,664 @@ func main() {
 
 }
 
-func run(kubeClient kube_client.Interface, recorder kube_record.EventRecorder) {
+func run(kubeClient kube_client.Interface, recorder kube_record.EventRecorder, shutdown <-chan struct{}) {
 
 	stopChannel := make(chan struct{})
 
 	// Predicate checker from K8s scheduler works out if a Pod could schedule onto a node
-	predicateChecker, err := simulator.NewPredicateChecker(kubeClient, stopChannel)
+	predicateStop := make(chan struct{})
+	predicateChecker, err := simulator.NewPredicateChecker(kubeClient, predicateStop)
 	if err != nil {
 		glog.Fatalf("Failed to create predicate checker: %v", err)
 	}
 
+	// Periodically rebuild the predicate checker to pick up scheduler changes
+	var predicateRefreshes <-chan time.Time
+	if *predicateRefreshInterval > 0 {
+		ticker := time.NewTicker(*predicateRefreshInterval)
+		defer ticker.Stop()
+		predicateRefreshes = ticker.C
+	}
+	refreshedPredicates := make(chan refreshedPredicateChecker)
+
 	nodeLister := kube_utils.NewReadyNodeLister(kubeClient, stopChannel)
 	podDisruptionBudgetLister := kube_utils.NewPodDisruptionBudgetLister(kubeClient, stopChannel)
 	unschedulablePodLister := kube_utils.NewUnschedulablePodLister(kubeClient, stopChannel)
 
+	// Serve the pods on each node from a watch, rather than listing them for
+	// every node in every cycle
+	nodes.Pods = nodes.NewPodCache(kubeClient, stopChannel)
+	if !nodes.Pods.WaitForSync(shutdown) {
+		return
+	}
+
 	// Set nextDrainTime to now to ensure we start processing straight away.
 	nextDrainTime := time.Now()
 
-	for {
-		select {
-		// Run forever, every housekeepingInterval seconds
-		case <-time.After(*housekeepingInterval):
-			{
-				// Don't do anything if we are waiting for the drain delay timer
-				if time.Until(nextDrainTime) > 0 {
-					glog.V(2).Infof("Waiting %s for drain delay timer.", time.Until(nextDrainTime).Round(time.Second))
-					continue
-				}
-
-				// Don't run if pods are unschedulable.
-				// Attempt to not make things worse.
-				unschedulablePods, err := unschedulablePodLister.List()
-				if err != nil {
-					glog.Errorf("Failed to get unschedulable pods: %v", err)
-				}
-				if len(unschedulablePods) > 0 {
-					glog.V(2).Info("Waiting for unschedulable pods to be scheduled.")
-					continue
-				}
-
-				glog.V(3).Info("Starting node processing.")
-
-				// Get all nodes in the cluster
-				allNodes, err := nodeLister.List()
-				if err != nil {
-					glog.Errorf("Failed to list nodes: %v", err)
-					continue
-				}
-
-				// Build a map of nodeInfo structs.
-				// NodeInfo is used to map pods onto nodes and see their available
-				// resources.
-				nodeMap, err := nodes.NewNodeMap(kubeClient, allNodes)
-				if err != nil {
-					glog.Errorf("Failed to build node map; %v", err)
-					continue
-				}
-
-				// Update metrics.
-				metrics.UpdateNodesMap(nodeMap)
+	// Count consecutive drain failures for each node
+	drainFailures := make(map[string]int)
 
-				// Get PodDisruptionBudgets
-				allPDBs, err := podDisruptionBudgetLister.List()
-				if err != nil {
-					glog.Errorf("Failed to list PDBs: %v", err)
-					continue
-				}
+	// Nodes which keep failing to drain are skipped until their backoff expires
+	drainBackoffUntil := make(map[string]time.Time)
 
-				// Get onDemand and spot nodeInfoArrays
-				// These are sorted when the nodeMap is created.
-				onDemandNodeInfos := nodeMap[nodes.OnDemand]
-				spotNodeInfos := nodeMap[nodes.Spot]
+	// With a per-node drain delay, drained nodes are skipped until it expires
+	nodeCooldownUntil := make(map[string]time.Time)
 
-				// Update spot node metrics
-				updateSpotNodeMetrics(spotNodeInfos, allPDBs)
-
-				// No on demand nodes so nothing to do.
-				if len(onDemandNodeInfos) < 1 {
-					glog.V(2).Info("No nodes to process.")
-				}
-
-				// Go through each onDemand node in turn
-				// Build a plan to move pods onto other nodes
-				// In the case that all can be moved, drain the node
-				for _, nodeInfo := range onDemandNodeInfos {
+	// Starts the drain delay after draining a node, for every node or just the
+	// drained node
+	startDrainDelay := func(node *apiv1.Node) {
+		if *perNodeDrainDelay {
+			nodeCooldownUntil[node.Name] = time.Now().Add(*nodeDrainDelay)
+			return
+		}
+		nextDrainTime = time.Now().Add(*nodeDrainDelay)
+	}
 
-					// Get a list of pods that we would need to move onto other nodes
-					allPods, err := autoscaler_drain.GetPodsForDeletionOnNodeDrain(nodeInfo.Pods, allPDBs, *deleteNonReplicatedPods, false, false, false, nil, 0, time.Now())
-					if err != nil {
-						glog.Errorf("Failed to get pods for consideration: %v", err)
-						continue
-					}
+	// Track how often each application has been moved
+	appMoves := newMoveTracker(time.Hour)
 
-					podsForDeletion := make([]*apiv1.Pod, 0)
-					for _, pod := range allPods {
-						controlledByDaemonSet := false
-						for _, owner := range pod.GetOwnerReferences() {
-							if *owner.Controller && owner.Kind == "DaemonSet" {
-								controlledByDaemonSet = true
-								break
-							}
-						}
-
-						if controlledByDaemonSet {
-							glog.V(4).Infof("Ignoring pod %s which is controlled by DaemonSet", podID(pod))
-							continue
-						}
-
-						podsForDeletion = append(podsForDeletion, pod)
-					}
+	// Track how many nodes have been drained in each zone
+	zoneDrains := newRollingCounter(*zoneDrainWindow)
 
-					// Update the number of pods on this node's metrics
-					metrics.UpdateNodePodsCount(nodes.OnDemandNodeLabel, nodeInfo.Node.Name, len(podsForDeletion))
-					if len(podsForDeletion) < 1 {
-						// No pods so should just wait for node to be autoscaled away.
-						glog.V(2).Infof("No pods on %s, skipping.", nodeInfo.Node.Name)
-						continue
-					}
+	// Metrics are updated from the latest snapshot when running separately
+	snapshots := &snapshotStore{}
+	if *metricsInterval > 0 {
+		go runMetricsLoop(snapshots, *metricsInterval, stopChannel)
+	}
 
-					glog.V(2).Infof("Considering %s for removal", nodeInfo.Node.Name)
+	// The cluster topology is summarised once at startup
+	loggedTopology := false
 
-					// Checks whether or not a node can be drained
-					err = canDrainNode(predicateChecker, spotNodeInfos, podsForDeletion)
-					if err != nil {
-						glog.V(2).Infof("Cannot drain node: %v", err)
-						continue
-					}
+	// Track the nodes seen in the last cycle to detect topology changes
+	var knownNodes map[string]struct{}
+	stabilizeUntil := time.Now()
 
-					// If building plan was successful, can drain node.
-					glog.V(2).Infof("All pods on %v can be moved. Will drain node.", nodeInfo.Node.Name)
-					// Drain the node - places eviction on each pod moving them in turn.
-					err = drainNode(kubeClient, recorder, nodeInfo.Node, podsForDeletion, int(maxGracefulTermination.Seconds()), *podEvictionTimeout)
-					if err != nil {
-						glog.Errorf("Failed to drain node: %v", err)
-					}
-					// Add the drain delay to allow system to stabilise
-					nextDrainTime = time.Now().Add(*nodeDrainDelay)
-					break
-				}
+	// Summarise activity between status reports
+	report := &statusReport{}
+	var statusReports <-chan time.Time
+	if *statusReportInterval > 0 {
+		ticker := time.NewTicker(*statusReportInterval)
+		defer ticker.Stop()
+		statusReports = ticker.C
+	}
 
-				glog.V(3).Info("Finished processing nodes.")
-			}
+	// Runs the pre-drain hooks for a plan, which are skipped in dry-run mode
+	// as they may act on the drain
+	preDrainHooks := func(plan *drainPlan) error {
+		if *dryRun {
+			return nil
 		}
+		return runPreDrainHooks(plan, *preDrainHookURL, *preDrainHookRequireAllow, *preDrainHookCommand, *preDrainHookTimeout)
 	}
-}
 
-// Configure the kube client used to access the api, either from kubeconfig or
+	// Evacuates any spot nodes being interrupted, returning whether pods were
+	// evicted from them
+	evacuateInterruptions := func(ctx context.Context) bool {
+		allNodes, err := nodeLister.List()
+		if err != nil {
+			glog.Errorf("Failed to list nodes: %v", err)
+			return false
+		}
+		allPDBs, err := podDisruptionBudgetLister.List()
+		if err != nil {
+			glog.Errorf("Failed to list PDBs: %v", err)
+			return false
+		}
+		return evacuateInterruptedNodes(ctx, kubeClient, recorder, predicateChecker, allNodes, allPDBs)
+	}
+
+	// Drains the node in the plan, returning whether it was drained
+	executeDrainPlan := func(plan *drainPlan) bool {
+		// In dry-run mode only log what would happen, keeping to the same cadence
+		if *dryRun {
+			logDryRun(plan)
+			metrics.UpdateNodeDrainCount("DryRun", "", plan.node.Node.Name)
+			if *maxMovesPerAppPerHour > 0 {
+				appMoves.record(plan.pods, time.Now())
+			}
+			if *maxDrainsPerZone > 0 {
+				zoneDrains.add(nodes.Zone(plan.node.Node), time.Now())
+			}
+			startDrainDelay(plan.node.Node)
+			return true
+		}
+
+		logInfo(2, "Draining node", "node", plan.node.Node.Name, "pods", len(plan.pods))
+		// Optionally check the plan against the pods on the node now and that
+		// the remaining pods still fit as each pod is moved
+		var check scaler.PlacementCheck
+		if *revalidateDuringDrain {
+			pdbs, err := podDisruptionBudgetLister.List()
+			if err != nil {
+				glog.Errorf("Failed to list PDBs: %v", err)
+				return false
+			}
+			plan, err = reconcilePlanPods(kubeClient, predicateChecker, plan, pdbs)
+			if err != nil {
+				glog.Infof("Not draining node %s, its pods have changed: %v", plan.node.Node.Name, err)
+				return false
+			}
+			check = newPlacementCheck(kubeClient, predicateChecker, plan)
+		}
+		health.busy(time.Now().Add(drainDuration(len(plan.pods)) + 2**housekeepingInterval))
+		// Drain the node - places eviction on each pod moving them in turn.
+		err := drainNode(kubeClient, recorder, plan.node.Node, plan.pods, int(maxGracefulTermination.Seconds()), *overrideGracePeriod, *podEvictionTimeout, *evictionRetryTime, check)
+		health.busy(time.Time{})
+		// Nodes are often removed by the cluster autoscaler between planning
+		// and draining, which isn't a failure of the drain
+		if _, gone := err.(*nodeGoneError); gone {
+			glog.Infof("Node %s was removed before it could be drained, skipping drain.", plan.node.Node.Name)
+			return false
+		}
+		_, replacementsMissing := err.(*scaler.ReplacementsNotReadyError)
+		if replacementsMissing {
+			glog.Warningf("Drained node %s, but %v", plan.node.Node.Name, err)
+			err = nil
+		}
+		report.recordDrain(len(plan.pods), err)
+		if publishErr := drainPublisher.Publish(newDrainEvent(plan, err, time.Now())); publishErr != nil {
+			glog.Errorf("Failed to publish drain of node %s: %v", plan.node.Node.Name, publishErr)
+		}
+		// Moves are only needed to enforce the limit, so aren't kept otherwise
+		if *maxMovesPerAppPerHour > 0 {
+			appMoves.record(plan.pods, time.Now())
+		}
+		zone := nodes.Zone(plan.node.Node)
+		if *maxDrainsPerZone > 0 {
+			zoneDrains.add(zone, time.Now())
+		}
+		metrics.UpdateZoneDrainCount(zone)
+		if err != nil {
+			logError("Failed to drain node", "node", plan.node.Node.Name, "reason", scaler.DrainFailureReason(err), "error", err)
+			recordDrainFailure(kubeClient, drainFailures, plan.node.Node)
+			if *maxDrainBackoff > 0 && drainFailures[plan.node.Node.Name] > 0 {
+				backoff := drainBackoff(drainFailures[plan.node.Node.Name], *nodeDrainDelay, *maxDrainBackoff)
+				glog.Infof("Node %s has failed to drain %d times in a row, skipping it for %s.", plan.node.Node.Name, drainFailures[plan.node.Node.Name], backoff)
+				drainBackoffUntil[plan.node.Node.Name] = time.Now().Add(backoff)
+			}
+		} else {
+			logInfo(0, "Drained node", "node", plan.node.Node.Name, "pods", len(plan.pods))
+			metrics.UpdateLastDrain(time.Now())
+			delete(drainFailures, plan.node.Node.Name)
+			delete(drainBackoffUntil, plan.node.Node.Name)
+			// DaemonSet pods stay with the pods a partial drain left behind
+			if *daemonSetPods == daemonSetPodsDelete && len(plan.unplaced) == 0 {
+				deleteDaemonSetPods(kubeClient, recorder, plan.node, *overrideGracePeriod)
+			}
+		}
+		// Add the drain delay to allow system to stabilise
+		startDrainDelay(plan.node.Node)
+		// Give workloads which haven't recovered longer before moving any
+		// more pods, whichever node they are on
+		if replacementsMissing {
+			nextDrainTime = time.Now().Add(2 * *nodeDrainDelay)
+			glog.Infof("Waiting %s before the next drain for the replacements to become Ready.", 2**nodeDrainDelay)
+		}
+		return err == nil
+	}
+
+	// Runs a single housekeeping cycle, recovering from any panic so the
+	// loop carries on
+	reconcile := func() {
+		defer func() { health.beat(time.Now()) }()
+		defer recoverReconcile()
+		defer func() { metrics.UpdateNextDrain(time.Until(nextDrainTime)) }()
+
+		// Bound how long the cycle may plan and wait for
+		ctx, cancel := context.WithCancel(context.Background())
+		if *cycleTimeout > 0 {
+			ctx, cancel = context.WithTimeout(context.Background(), *cycleTimeout)
+		}
+		defer cancel()
+
+		// Don't do anything while in maintenance
+		if maintenancePaused(kubeClient, maintenance) {
+			glog.V(2).Infof("Maintenance annotation %s is set, skipping draining.", MaintenanceAnnotation)
+			return
+		}
+
+		// Spot nodes about to be interrupted can't wait for the drain delay, the
+		// rest of the cycle is left until the next one once pods are moving
+		if *handleSpotInterruptions && evacuateInterruptions(ctx) {
+			return
+		}
+
+		// Don't do anything if we are waiting for the drain delay timer, unless
+		// planning to count the drains deferred by it
+		inCooldown := time.Until(nextDrainTime) > 0
+		if inCooldown && cooldownOverridden(kubeClient, *cooldownOverrideConfigMap) {
+			inCooldown = false
+		}
+		if inCooldown {
+			glog.V(2).Infof("Waiting %s for drain delay timer.", time.Until(nextDrainTime).Round(time.Second))
+			if !*planDuringCooldown {
+				return
+			}
+		}
+
+		// Don't run if pods are unschedulable.
+		// Attempt to not make things worse.
+		unschedulablePods, err := unschedulablePodLister.List()
+		if err != nil {
+			glog.Errorf("Failed to get unschedulable pods: %v", err)
+		}
+		if len(unschedulablePods) > 0 {
+			glog.V(2).Info("Waiting for unschedulable pods to be scheduled.")
+			return
+		}
+
+		// Don't run while the cluster is under scheduling pressure.
+		if *maxPendingPods > 0 {
+			pendingPods, err := countPendingPods(kubeClient)
+			if err != nil {
+				glog.Errorf("Failed to get pending pods: %v", err)
+				return
+			}
+			if pendingPods > *maxPendingPods {
+				glog.V(2).Infof("Waiting for pending pods to be scheduled, %d pods pending.", pendingPods)
+				return
+			}
+		}
+
+		glog.V(3).Info("Starting node processing.")
+
+		// Get all nodes in the cluster
+		allNodes, err := nodeLister.List()
+		ready.record(err)
+		if err != nil {
+			glog.Errorf("Failed to list nodes: %v", err)
+			return
+		}
+
+		// Build a map of nodeInfo structs.
+		// NodeInfo is used to map pods onto nodes and see their available
+		// resources.
+		nodeMapStart := time.Now()
+		nodeMap, err := nodes.NewNodeMap(kubeClient, allNodes)
+		metrics.ObserveNodeMapBuildDuration(time.Since(nodeMapStart))
+		if err != nil {
+			glog.Errorf("Failed to build node map; %v", err)
+			return
+		}
+		if ctx.Err() != nil {
+			glog.Warningf("Cycle timed out after %s while building the node map, skipping draining.", *cycleTimeout)
+			return
+		}
+
+		// Get PodDisruptionBudgets
+		allPDBs, err := podDisruptionBudgetLister.List()
+		ready.record(err)
+		if err != nil {
+			glog.Errorf("Failed to list PDBs: %v", err)
+			return
+		}
+
+		// Get onDemand and spot nodeInfoArrays
+		// These are sorted when the nodeMap is created.
+		onDemandNodeInfos := nodeMap[nodes.OnDemand]
+		spotNodeInfos := nodeMap[nodes.Spot]
+		report.onDemandNodes = len(onDemandNodeInfos)
+		report.spotNodes = len(spotNodeInfos)
+
+		// Update metrics, either now or from the metrics loop
+		snapshot := &clusterSnapshot{allNodes: allNodes, nodeMap: nodeMap, pdbs: allPDBs}
+		if *metricsInterval > 0 {
+			snapshots.set(snapshot)
+		} else {
+			updateClusterMetrics(snapshot)
+		}
+
+		// Log a summary of the topology the first time
+		if !loggedTopology {
+			summary := summarizeTopology(allNodes, nodeMap, allPDBs)
+			summary.log()
+			summary.warnUnmatchedLabels(allNodes)
+			loggedTopology = true
+		}
+
+		// Only drain within the active window, once metrics are updated
+		if window != nil && !window.contains(time.Now()) {
+			glog.V(2).Infof("Outside the active window %s, skipping draining.", *activeWindowFlag)
+			return
+		}
+
+		// No on demand nodes so nothing to do.
+		if len(onDemandNodeInfos) < 1 {
+			glog.V(2).Info("No nodes to process.")
+		}
+
+		// Wait for the cluster to settle if nodes have been added or removed
+		var changed bool
+		knownNodes, changed = nodeSetChanged(knownNodes, allNodes)
+		if changed && *topologyStabilizationDelay > 0 {
+			glog.V(2).Info("Cluster nodes changed, resetting topology stabilization timer.")
+			stabilizeUntil = time.Now().Add(*topologyStabilizationDelay)
+		}
+		stabilizing := time.Until(stabilizeUntil) > 0
+		metrics.UpdateTopologyStabilizing(stabilizing)
+		if stabilizing {
+			glog.V(2).Infof("Waiting %s for topology stabilization.", time.Until(stabilizeUntil).Round(time.Second))
+			return
+		}
+
+		// Go through each onDemand node in turn
+		// Build a plan to move pods onto other nodes
+		// Collect the nodes for which all pods can be moved
+		onDemandNodeInfos = sortByDrainOrder(onDemandNodeInfos, *drainOrder)
+
+		// Consider nodes running mostly BestEffort pods first
+		if *preferBestEffortNodes {
+			onDemandNodeInfos = sortByBestEffort(onDemandNodeInfos)
+		}
+
+		// When optimizing node groups, nodes in the groups closest to being
+		// emptied are considered first
+		var groupPods map[string]int
+		if *optimizeNodeGroups {
+			groupPods = nodeGroupPods(onDemandNodeInfos, allPDBs, *nodeGroupLabel)
+			onDemandNodeInfos = sortByNodeGroup(onDemandNodeInfos, groupPods, *nodeGroupLabel)
+		}
+
+		// Plans drains for the on-demand nodes not yet drained this cycle,
+		// given the spot capacity left by earlier drains. Empty nodes to be
+		// cordoned are gathered separately.
+		drained := make(map[string]bool)
+		var emptyNodes []*apiv1.Node
+		// When planning globally, every node is planned against one model of
+		// the spot capacity, which the nodes drained this cycle are kept in
+		var planner *globalPlanner
+		if *globalPlanning {
+			planner = newGlobalPlanner(predicateChecker, spotNodeInfos)
+		}
+		findCandidates := func(spotNodeInfos nodes.NodeInfoArray) []*drainPlan {
+			emptyNodes = nil
+			candidates := make([]*drainPlan, 0)
+			for _, nodeInfo := range onDemandNodeInfos {
+				if ctx.Err() != nil {
+					glog.Warningf("Cycle timed out after %s while planning drains, skipping the remaining on-demand nodes.", *cycleTimeout)
+					break
+				}
+
+				// Skip nodes already drained this cycle
+				if drained[nodeInfo.Node.Name] {
+					continue
+				}
+
+				// Skip nodes operators have excluded or which have failed to
+				// drain too many times
+				if err := checkNodeDrainable(nodeInfo.Node); err != nil {
+					dedupLog.Infof(2, "%v, skipping.", err)
+					recordSkipEvent(recorder, nodeInfo.Node, err)
+					continue
+				}
+
+				// Skip nodes drained too recently
+				if until, ok := nodeCooldownUntil[nodeInfo.Node.Name]; ok {
+					if time.Now().Before(until) {
+						dedupLog.Infof(2, "Node %s was drained recently, skipping until %s.", nodeInfo.Node.Name, until.Format(time.RFC3339))
+						continue
+					}
+					delete(nodeCooldownUntil, nodeInfo.Node.Name)
+				}
+
+				// Skip nodes backing off after failing to drain
+				if until, ok := drainBackoffUntil[nodeInfo.Node.Name]; ok && time.Now().Before(until) {
+					dedupLog.Infof(2, "Node %s is backing off after failing to drain, skipping until %s.", nodeInfo.Node.Name, until.Format(time.RFC3339))
+					continue
+				}
+
+				// Get a list of pods that we would need to move onto other nodes
+				podsForDeletion, err := getPodsForDeletion(nodeInfo, allPDBs)
+				if err != nil {
+					glog.Errorf("Failed to get pods for consideration: %v", err)
+					continue
+				}
+
+				// Update the number of pods on this node's metrics
+				metrics.UpdateNodePodsCount(nodes.OnDemandNodeLabel, nodeInfo.Node.Name, len(podsForDeletion))
+				if len(podsForDeletion) < 1 {
+					// No pods so should just wait for node to be autoscaled away.
+					// Cordoning keeps new pods off it in the meantime.
+					if *drainEmptyNodes && !*dryRun && !nodeInfo.Node.Spec.Unschedulable {
+						emptyNodes = append(emptyNodes, nodeInfo.Node)
+						continue
+					}
+					dedupLog.Infof(2, "No pods on %s, skipping.", nodeInfo.Node.Name)
+					continue
+				}
+
+				dedupLog.Infow(2, "Considering node for removal", "node", nodeInfo.Node.Name, "pods", len(podsForDeletion))
+
+				err = checkPodsDrainable(kubeClient, podsForDeletion, spotNodeInfos, allPDBs)
+				if err != nil {
+					dedupLog.Infof(2, "Cannot drain node %s: %v", nodeInfo.Node.Name, err)
+					recordSkipEvent(recorder, nodeInfo.Node, err)
+					continue
+				}
+
+				// Spread drains across zones
+				zone := nodes.Zone(nodeInfo.Node)
+				if *maxDrainsPerZone > 0 && zoneDrains.count(zone, time.Now()) >= *maxDrainsPerZone {
+					dedupLog.Infof(2, "Cannot drain node: %d nodes have already been drained in zone %s", *maxDrainsPerZone, zone)
+					continue
+				}
+
+				// Don't move applications which have been moved too often
+				if *maxMovesPerAppPerHour > 0 {
+					if pod := appMoves.limited(podsForDeletion, *maxMovesPerAppPerHour, time.Now()); pod != nil {
+						dedupLog.Infof(2, "Cannot drain node: application of pod %s has been moved %d times in the last hour", podID(pod), *maxMovesPerAppPerHour)
+						continue
+					}
+				}
+
+				// Checks whether or not a node can be drained
+				dedupLog.Eventf(recorder, nodeInfo.Node, apiv1.EventTypeNormal, "ConsideringForDrain", "planning moves for %d pods", len(podsForDeletion))
+				var plan *drainPlan
+				planStart := time.Now()
+				if planner != nil {
+					plan, err = planner.plan(ctx, nodeInfo, podsForDeletion)
+				} else {
+					plan, err = buildDrainPlan(ctx, predicateChecker, nodeInfo, spotNodeInfos, podsForDeletion)
+				}
+				if err != nil && *consolidateOnDemand {
+					dedupLog.Infof(2, "Cannot move all pods onto spot nodes, trying on-demand nodes: %v", err)
+					plan, err = buildConsolidationPlan(ctx, predicateChecker, nodeInfo, spotNodeInfos, nodeMap[nodes.OnDemand], podsForDeletion)
+				}
+				metrics.ObservePlanBuildDuration(time.Since(planStart))
+				if err != nil {
+					dedupLog.Infow(2, "Cannot drain node", "node", nodeInfo.Node.Name, "error", err)
+					if ctx.Err() == nil {
+						dedupLog.Eventf(recorder, nodeInfo.Node, apiv1.EventTypeNormal, "SkippedNoSpotCapacity", "node skipped as its pods can't all be moved: %v", err)
+					}
+					continue
+				}
+
+				dedupLog.Infow(2, "Drain plan built", "node", nodeInfo.Node.Name, "pods", len(plan.pods), "unplaced", len(plan.unplaced))
+				if len(plan.unplaced) > 0 {
+					dedupLog.Eventf(recorder, nodeInfo.Node, apiv1.EventTypeNormal, "DrainPlanReady", "%d of %d pods can be moved", len(plan.pods), len(podsForDeletion))
+				} else {
+					dedupLog.Eventf(recorder, nodeInfo.Node, apiv1.EventTypeNormal, "DrainPlanReady", "all %d pods can be moved", len(plan.pods))
+				}
+				if groupPods != nil {
+					plan.groupPods = groupPods[nodeGroup(nodeInfo.Node, *nodeGroupLabel)]
+				}
+				candidates = append(candidates, plan)
+
+				// In first mode there is no need to evaluate further nodes
+				if *drainSelection == drainSelectionFirst {
+					break
+				}
+			}
+			return candidates
+		}
+
+		// Drain nodes until the limit for the cycle is reached or no more
+		// nodes can be drained
+		// Draining may not leave fewer than the minimum non-empty on-demand nodes
+		nonEmptyOnDemand := countNonEmptyNodes(onDemandNodeInfos, allPDBs)
+		for drains := 0; drains < *maxDrainsPerCycle; drains++ {
+			if drains > 0 {
+				// Waiting for the drain delay here would hold up admin API
+				// requests and the rest of the loop, so the next cycle picks up
+				// the next drain instead
+				if time.Until(nextDrainTime) > 0 {
+					glog.V(2).Infof("Leaving the next drain to a later cycle, the drain delay timer has %s to go.", time.Until(nextDrainTime).Round(time.Second))
+					break
+				}
+				// The earlier drains have used up disruptions allowed by PDBs
+				if allPDBs, err = podDisruptionBudgetLister.List(); err != nil {
+					glog.Errorf("Failed to list PDBs: %v", err)
+					break
+				}
+			}
+
+			// In the case that all pods can be moved, drain the node
+			plan := selectDrainPlan(findCandidates(spotNodeInfos))
+			if ctx.Err() != nil {
+				break
+			}
+			if plan != nil || drains == 0 {
+				plans.record(plan, time.Now())
+			}
+
+			// Empty nodes are cordoned ahead of any drains, each taking the
+			// place of a drain this cycle
+			if len(emptyNodes) > 0 && !inCooldown {
+				node := emptyNodes[0]
+				drained[node.Name] = true
+				if err := cordonEmptyNode(kubeClient, recorder, node); err != nil {
+					glog.Errorf("Failed to cordon empty node %s: %v", node.Name, err)
+				}
+				continue
+			}
+			if plan == nil {
+				break
+			}
+			if inCooldown {
+				glog.V(2).Infof("Node %s can be drained once the drain delay timer expires.", plan.node.Node.Name)
+				metrics.UpdateDrainsDeferredCooldown()
+				return
+			}
+			if *minOnDemandNodes > 0 && len(plan.unplaced) == 0 && nonEmptyOnDemand-1 < *minOnDemandNodes {
+				glog.Infof("Not draining node %s as it would leave fewer than %d non-empty on-demand nodes.", plan.node.Node.Name, *minOnDemandNodes)
+				break
+			}
+
+			// Make sure the node hasn't been removed or reclassified since the
+			// node map was built
+			stillOnDemand, err := isStillOnDemand(kubeClient, plan.node.Node)
+			if err != nil {
+				glog.Errorf("Failed to check node %s before draining: %v", plan.node.Node.Name, err)
+				break
+			} else if !stillOnDemand {
+				glog.Infof("Node %s no longer exists or is no longer on-demand, skipping drain.", plan.node.Node.Name)
+				break
+			} else if drifted, err := findTargetLabelDrift(kubeClient, plan); err != nil {
+				glog.Errorf("Failed to check target nodes for node %s before draining: %v", plan.node.Node.Name, err)
+				break
+			} else if len(drifted) > 0 {
+				metrics.UpdateLabelDriftDetected()
+				glog.Infof("Target nodes %s have been removed or reclassified, skipping drain of node %s until the next cycle.", strings.Join(drifted, ", "), plan.node.Node.Name)
+				break
+			} else if err := preDrainHooks(plan); err != nil {
+				glog.Infof("Not draining node %s: %v", plan.node.Node.Name, err)
+				break
+			}
+			if !executeDrainPlan(plan) {
+				break
+			}
+
+			// Later drains are planned against the spot capacity this drain
+			// used. Consolidation changes on-demand capacity too, so the rest
+			// of the cycle is left until the next one.
+			drained[plan.node.Node.Name] = true
+			if len(plan.unplaced) == 0 {
+				nonEmptyOnDemand--
+			}
+			if plan.onDemandNodeInfos != nil {
+				break
+			}
+			spotNodeInfos = plan.spotNodeInfos
+			if planner != nil {
+				planner.keep(plan)
+			}
+		}
+
+		glog.V(3).Info("Finished processing nodes.")
+	}
+
+	// Plans and drains a node requested through the admin API
+	forceDrain := func(req forceDrainRequest) {
+		defer recoverReconcile()
+		defer close(req.result)
+		if maintenancePaused(kubeClient, maintenance) {
+			req.result <- fmt.Errorf("draining is paused for maintenance")
+			return
+		}
+		plan, err := planForceDrain(kubeClient, predicateChecker, nodeLister, podDisruptionBudgetLister, req.node)
+		if err == nil {
+			err = preDrainHooks(plan)
+		}
+		req.result <- err
+		if err == nil {
+			executeDrainPlan(plan)
+		}
+	}
+
+	// The loop is now running, so is checked by the liveness endpoint
+	health.beat(time.Now())
+
+	// Ready once nodes can be listed, even if the first cycles skip listing
+	allNodes, err := nodeLister.List()
+	ready.record(err)
+	// Otherwise unmatched labels are warned about by the first cycle
+	if err == nil && *strictLabelValidation {
+		if err := checkNodeLabels(allNodes); err != nil {
+			glog.Fatalf("Node labels are misconfigured: %v", err)
+		}
+	}
+	for {
+		select {
+		// Drain nodes requested through the admin API straight away, skipping
+		// the drain delay and node ordering
+		case req := <-forceDrainRequests:
+			forceDrain(req)
+
+		case <-statusReports:
+			report.write(os.Stdout, nextDrainTime, time.Now())
+
+		// Swap in refreshed predicate checkers, stopping the old one
+		case <-predicateRefreshes:
+			go refreshPredicateChecker(kubeClient, refreshedPredicates)
+		case refreshed := <-refreshedPredicates:
+			glog.V(2).Info("Refreshed predicate checker.")
+			close(predicateStop)
+			predicateChecker, predicateStop = refreshed.checker, refreshed.stop
+
+		// Stop between cycles so drains aren't interrupted
+		case <-shutdown:
+			glog.Infof("Stopping rescheduler.")
+			close(predicateStop)
+			close(stopChannel)
+			return
+
+		// Run forever, every housekeepingInterval seconds
+		case <-time.After(*housekeepingInterval):
+			reconcile()
+		}
+	}
+}
+
+// Recovers from a panic during a housekeeping cycle, logging it with a stack
+// trace so the rescheduler can carry on with the next cycle.
+func recoverReconcile() {
+	if r := recover(); r != nil {
+		glog.Errorf("Recovered from panic: %v\n%s", r, debug.Stack())
+		metrics.UpdatePanicsCount()
+	}
+}
+
+// Configure the kube client used to access the api, either from kubeconfig or
 //from pod environment if running in the cluster
 func createKubeClient(flags *flag.FlagSet, inCluster bool) (kube_client.Interface, error) {
 	var config *kube_restclient.Config
@@ -343,9 +1480,31 @@ func createKubeClient(flags *flag.FlagSet, inCluster bool) (kube_client.Interfac
 		return nil, fmt.Errorf("error connecting to the client: %v", err)
 	}
 	config.ContentType = *contentType
+	config.QPS = float32(*kubeAPIQPS)
+	config.Burst = *kubeAPIBurst
 	return kube_client.NewForConfigOrDie(config), nil
 }
 
+// Works out the namespace for rescheduler-owned resources. An explicitly set
+// namespace is used first, then the service account's namespace when running in
+// the cluster, falling back to the namespace flag.
+func getReschedulerNamespace(configured string, inCluster bool, namespaceFile string) string {
+	if configured != "" {
+		return configured
+	}
+	if inCluster {
+		data, err := ioutil.ReadFile(namespaceFile)
+		if err != nil {
+			glog.Warningf("Failed to detect namespace from %s, using %s: %v", namespaceFile, *namespace, err)
+			return *namespace
+		}
+		if detected := strings.TrimSpace(string(data)); detected != "" {
+			return detected
+		}
+	}
+	return *namespace
+}
+
 // Create an event broadcaster so that we can call events when we modify the system
 func createEventRecorder(client kube_client.Interface) kube_record.EventRecorder {
 	eventBroadcaster := kube_record.NewBroadcaster()
@@ -356,56 +1515,758 @@ func createEventRecorder(client kube_client.Interface) kube_record.EventRecorder
 
 // Determines if any of the nodes meet the predicates that allow the Pod to be
 // scheduled on the node, and returns the node if it finds a suitable one.
-// Currently sorts nodes by most requested CPU in an attempt to fill fuller
-// nodes first (Attempting to bin pack)
+// Nodes are sorted by priority and then most requested CPU in an attempt to
+// fill fuller nodes first (Attempting to bin pack). With the best-fit target
+// selection, the node of the highest priority left with the least free CPU
+// after placing the pod is chosen instead, and with the worst-fit target
+// selection the one left with the most free CPU.
 func findSpotNodeForPod(predicateChecker *simulator.PredicateChecker, nodeInfos []*nodes.NodeInfo, pod *apiv1.Pod) *nodes.NodeInfo {
+	// Pretend a copy of the pod isn't scheduled, leaving the pod itself intact
+	// for eviction
+	simulatedPod := pod.DeepCopy()
+	simulatedPod.Spec.NodeName = ""
+
+	// Give pods without requests the default requests, so they don't fit trivially
+	simulatedPod = withDefaultRequests(simulatedPod)
+
+	var bestFit *nodes.NodeInfo
+	var bestFree float64
 	for _, nodeInfo := range nodeInfos {
-		kubeNodeInfo := schedulercache.NewNodeInfo(nodeInfo.Pods...)
-		kubeNodeInfo.SetNode(nodeInfo.Node)
+		// Leave room for pods such as new DaemonSets
+		if !hasFreePodSlots(nodeInfo, *minFreePodSlots+1) {
+			continue
+		}
+		// Leave headroom for bursty workloads
+		if !hasHeadroom(nodeInfo, simulatedPod, *spotHeadroomPercent) {
+			continue
+		}
 
-		// Pretend pod isn't scheduled
-		pod.Spec.NodeName = ""
+		kubeNodeInfo := schedulercache.NewNodeInfo(withDefaultRequestsAll(nodeInfo.Pods)...)
+		kubeNodeInfo.SetNode(nodeInfo.Node)
 
 		// Check with the schedulers predicates to find a node to schedule on
-		if err := predicateChecker.CheckPredicates(pod, nil, kubeNodeInfo, true); err == nil {
+		if err := predicateChecker.CheckPredicates(simulatedPod, nil, kubeNodeInfo, true); err != nil {
+			continue
+		}
+		if *packingStrategy == packingStrategyFirstFit {
 			return nodeInfo
 		}
+		free := freeAfterPlacing(nodeInfo, simulatedPod)
+		if bestFit == nil {
+			bestFit, bestFree = nodeInfo, free
+			continue
+		}
+		priority, bestPriority := nodes.SpotPriority(nodeInfo.Node), nodes.SpotPriority(bestFit.Node)
+		if priority != bestPriority {
+			if priority > bestPriority {
+				bestFit, bestFree = nodeInfo, free
+			}
+			continue
+		}
+		if *packingStrategy == packingStrategyWorstFit && free > bestFree {
+			bestFit, bestFree = nodeInfo, free
+		}
+		if *packingStrategy == packingStrategyBestFit && free < bestFree {
+			bestFit, bestFree = nodeInfo, free
+		}
+	}
+	return bestFit
+}
+
+// Works out the fraction of the node's allocatable CPU and memory which would
+// be left free after placing the pod on it, averaged over the two.
+func freeAfterPlacing(nodeInfo *nodes.NodeInfo, pod *apiv1.Pod) float64 {
+	requested := nodeRequests(nodeInfo)
+	podRequested := nodes.PodRequests(pod)
+	allocatable := nodeInfo.AllocatableResources()
+
+	var free float64
+	if cpu := allocatable.Cpu().MilliValue(); cpu > 0 {
+		free += float64(cpu-requested.Cpu().MilliValue()-podRequested.Cpu().MilliValue()) / float64(cpu)
+	}
+	if memory := allocatable.Memory().Value(); memory > 0 {
+		free += float64(memory-requested.Memory().Value()-podRequested.Memory().Value()) / float64(memory)
+	}
+	return free / 2
+}
+
+// Gets the list of pods that would need to be moved off the node to drain it.
+// Pods controlled by a DaemonSet are ignored as they can't be moved.
+func getPodsForDeletion(nodeInfo *nodes.NodeInfo, pdbs []*policyv1.PodDisruptionBudget) ([]*apiv1.Pod, error) {
+	allPods, err := autoscaler_drain.GetPodsForDeletionOnNodeDrain(nodeInfo.Pods, pdbs, *deleteNonReplicatedPods, false, false, false, nil, 0, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	podsForDeletion := make([]*apiv1.Pod, 0)
+	for _, pod := range allPods {
+		if isDaemonSetPod(pod) {
+			glog.V(4).Infof("Ignoring pod %s which is controlled by DaemonSet", podID(pod))
+			continue
+		}
+
+		podsForDeletion = append(podsForDeletion, pod)
+	}
+	return podsForDeletion, nil
+}
+
+// skipError is returned by the drain checks for reasons which are recorded as
+// an Event on the node, as well as logged.
+type skipError struct {
+	err   error
+	event string
+}
+
+func (e *skipError) Error() string {
+	return e.err.Error()
+}
+
+// Records the Event for the reason a node was skipped, if it has one.
+func recordSkipEvent(recorder kube_record.EventRecorder, node *apiv1.Node, err error) {
+	if skipErr, ok := err.(*skipError); ok {
+		dedupLog.Eventf(recorder, node, apiv1.EventTypeNormal, "ReschedulerSkipped", "%s", skipErr.event)
+	}
+}
+
+// Returns an error if the node has been excluded from draining by an operator,
+// or has failed to drain too many times.
+func checkNodeDrainable(node *apiv1.Node) error {
+	if nodes.IsExcluded(node) {
+		return &skipError{
+			err:   fmt.Errorf("node %s has annotation %s", node.Name, nodes.ExcludeAnnotation),
+			event: fmt.Sprintf("node skipped as it has annotation %s", nodes.ExcludeAnnotation),
+		}
+	}
+	if nodes.IsDrainSkipped(node) {
+		return fmt.Errorf("node %s has annotation %s", node.Name, nodes.DrainSkippedAnnotation)
 	}
 	return nil
 }
 
+// Returns an error if any of the pods to move off a node may not be moved onto
+// the spot nodes, whichever spot node they would move to.
+func checkPodsDrainable(kubeClient kube_client.Interface, pods []*apiv1.Pod, spotNodeInfos nodes.NodeInfoArray, pdbs []*policyv1.PodDisruptionBudget) error {
+	// Checks that every PodDisruptionBudget covering the pods allows them to
+	// be disrupted
+	if err := checkPDBs(pods, pdbs); err != nil {
+		return err
+	}
+	// Pods matching the exclude selector must stay where they are
+	if err := checkProtectedPods(pods, protectedPods); err != nil {
+		return &skipError{err: err, event: fmt.Sprintf("node skipped as it runs a protected pod: %v", err)}
+	}
+	// Some pods may be pinned to their node
+	if err := checkPinnedPods(pods); err != nil {
+		return err
+	}
+	// Pods may be pinned to their node by their volumes
+	if err := checkVolumeNodeAffinity(kubeClient, pods, spotNodeInfos); err != nil {
+		return err
+	}
+	// Don't move pods which have only just started
+	return checkPodAge(pods, *minPodAge, time.Now())
+}
+
+// Determines if the pod is controlled by a DaemonSet.
+func isDaemonSetPod(pod *apiv1.Pod) bool {
+	for _, owner := range pod.GetOwnerReferences() {
+		if owner.Controller != nil && *owner.Controller && owner.Kind == "DaemonSet" {
+			return true
+		}
+	}
+	return false
+}
+
+// Deletes the DaemonSet pods on a drained node. Each pod is deleted once, as
+// retrying would only chase the replacements created by the DaemonSet.
+func deleteDaemonSetPods(kubeClient kube_client.Interface, recorder kube_record.EventRecorder, nodeInfo *nodes.NodeInfo, overrideGracePeriod int) {
+	pods := make([]*apiv1.Pod, 0)
+	for _, pod := range nodeInfo.Pods {
+		if isDaemonSetPod(pod) {
+			pods = append(pods, pod)
+		}
+	}
+	if len(pods) == 0 {
+		return
+	}
+
+	glog.V(2).Infof("Deleting %d DaemonSet pods from node %s.", len(pods), nodeInfo.Node.Name)
+	if err := scaler.DeletePods(pods, kubeClient, recorder, overrideGracePeriod); err != nil {
+		glog.Errorf("Failed to delete DaemonSet pods from node %s: %v", nodeInfo.Node.Name, err)
+	}
+}
+
+// Determines if the node can hold at least the given number of extra pods
+// within its allocatable pod capacity.
+func hasFreePodSlots(nodeInfo *nodes.NodeInfo, slots int) bool {
+	allocatable := nodeInfo.Node.Status.Allocatable.Pods().Value()
+	return allocatable-int64(len(nodeInfo.Pods)) >= int64(slots)
+}
+
+// Determines if the node's requested CPU and memory would stay within
+// (100 - headroomPercent)% of its allocatable after placing the pod.
+func hasHeadroom(nodeInfo *nodes.NodeInfo, pod *apiv1.Pod, headroomPercent float64) bool {
+	if headroomPercent <= 0 {
+		return true
+	}
+	requested := nodeRequests(nodeInfo)
+	podRequested := nodes.PodRequests(pod)
+	requestedCPU := requested.Cpu().MilliValue() + podRequested.Cpu().MilliValue()
+	requestedMemory := requested.Memory().Value() + podRequested.Memory().Value()
+
+	usable := 1 - headroomPercent/100
+	allocatable := nodeInfo.AllocatableResources()
+	return float64(requestedCPU) <= float64(allocatable.Cpu().MilliValue())*usable &&
+		float64(requestedMemory) <= float64(allocatable.Memory().Value())*usable
+}
+
 // Goes through a list of pods and works out new nodes to place them on.
-// Returns an error if any of the pods won't fit onto existing spot nodes.
-func canDrainNode(predicateChecker *simulator.PredicateChecker, nodeInfos nodes.NodeInfoArray, pods []*apiv1.Pod) error {
-	// Create a copy of the nodeInfos so that we can modify the list
-	nodePlan := nodeInfos.CopyNodeInfos()
+// Returns an error if any of the pods won't fit onto existing spot nodes, or
+// when draining partially only if none of them will, leaving the plan's pods
+// as those which fit. The spot nodeInfos are copied so the plan can be built
+// without modifying them.
+func buildDrainPlan(ctx context.Context, predicateChecker *simulator.PredicateChecker, nodeInfo *nodes.NodeInfo, spotNodeInfos nodes.NodeInfoArray, pods []*apiv1.Pod) (*drainPlan, error) {
+	return planPods(ctx, predicateChecker, nodeInfo, spotNodeInfos, nil, pods)
+}
 
-	for _, pod := range pods {
-		// Works out if a spot node is available for rescheduling
-		spotNodeInfo := findSpotNodeForPod(predicateChecker, nodePlan, pod)
-		if spotNodeInfo == nil {
-			return fmt.Errorf("pod %s can't be rescheduled on any existing spot node", podID(pod))
+// Works out new nodes for the pods like buildDrainPlan, but places pods which
+// don't fit onto any spot node onto the other on-demand nodes instead, so that
+// on-demand nodes can be consolidated.
+func buildConsolidationPlan(ctx context.Context, predicateChecker *simulator.PredicateChecker, nodeInfo *nodes.NodeInfo, spotNodeInfos nodes.NodeInfoArray, onDemandNodeInfos nodes.NodeInfoArray, pods []*apiv1.Pod) (*drainPlan, error) {
+	others := make(nodes.NodeInfoArray, 0, len(onDemandNodeInfos))
+	for _, onDemandNodeInfo := range onDemandNodeInfos {
+		if onDemandNodeInfo.Node.Name != nodeInfo.Node.Name {
+			others = append(others, onDemandNodeInfo)
 		}
-		glog.V(4).Infof("Pod %s can be rescheduled on %v, adding to plan.", podID(pod), spotNodeInfo.Node.ObjectMeta.Name)
-		spotNodeInfo.AddPod(pod)
 	}
+	// Fill the fullest on-demand nodes first
+	sort.SliceStable(others, func(i, j int) bool {
+		return others[i].RequestedCPU > others[j].RequestedCPU
+	})
+	return planPods(ctx, predicateChecker, nodeInfo, spotNodeInfos, others, pods)
+}
 
-	return nil
+// Builds a plan placing each of the pods onto a spot node, falling back to the
+// on-demand nodes if given. The nodeInfos are copied so the plan can be built
+// without modifying them.
+func planPods(ctx context.Context, predicateChecker *simulator.PredicateChecker, nodeInfo *nodes.NodeInfo, spotNodeInfos nodes.NodeInfoArray, onDemandNodeInfos nodes.NodeInfoArray, pods []*apiv1.Pod) (*drainPlan, error) {
+	plan := &drainPlan{
+		node:          nodeInfo,
+		pods:          make([]*apiv1.Pod, 0, len(pods)),
+		targets:       make(map[*apiv1.Pod]*nodes.NodeInfo),
+		spotNodeInfos: spotNodeInfos.CopyNodeInfos(),
+	}
+	if onDemandNodeInfos != nil {
+		plan.onDemandNodeInfos = onDemandNodeInfos.CopyNodeInfos()
+	}
+
+	// Only consider spot nodes that may receive rescheduled pods
+	targets := filterTargetNodes(plan.spotNodeInfos)
+
+	// Placing the largest pods first packs them more tightly
+	var unplacedErr error
+	for _, pod := range sortByRequests(pods) {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("planning the drain of node %s was cut short: %v", nodeInfo.Node.Name, err)
+		}
+
+		targetNodeInfo, err := placePod(predicateChecker, targets, plan.onDemandNodeInfos, pod)
+		if err != nil {
+			// When draining partially, pods which don't fit stay where they are
+			if !*allowPartialDrain {
+				return nil, err
+			}
+			glog.V(4).Infof("Leaving pod %s on %s: %v", podID(pod), nodeInfo.Node.Name, err)
+			if unplacedErr == nil {
+				unplacedErr = err
+			}
+			plan.unplaced = append(plan.unplaced, pod)
+			continue
+		}
+		glog.V(4).Infof("Pod %s can be rescheduled on %v, adding to plan.", podID(pod), targetNodeInfo.Node.ObjectMeta.Name)
+		targetNodeInfo.AddPod(pod)
+		plan.targets[pod] = targetNodeInfo
+		plan.pods = append(plan.pods, pod)
+	}
+
+	if len(plan.pods) == 0 && unplacedErr != nil {
+		return nil, fmt.Errorf("none of the pods on node %s can be rescheduled: %v", nodeInfo.Node.Name, unplacedErr)
+	}
+	return plan, nil
+}
+
+// Works out the node a pod should move to, preferring the spot nodes and
+// falling back to the on-demand nodes if given.
+func placePod(predicateChecker *simulator.PredicateChecker, spotNodeInfos nodes.NodeInfoArray, onDemandNodeInfos nodes.NodeInfoArray, pod *apiv1.Pod) (*nodes.NodeInfo, error) {
+	// Gated pods can't be scheduled anywhere until their gates are removed
+	if hasSchedulingGates(pod) {
+		return nil, fmt.Errorf("pod %s has scheduling gates and can't be rescheduled", podID(pod))
+	}
+
+	// Works out if a spot node is available for rescheduling
+	targetNodeInfo := findSpotNodeForPod(predicateChecker, spotNodeInfos, pod)
+	if targetNodeInfo == nil && onDemandNodeInfos != nil {
+		targetNodeInfo = findSpotNodeForPod(predicateChecker, onDemandNodeInfos, pod)
+		if targetNodeInfo == nil {
+			return nil, fmt.Errorf("pod %s can't be rescheduled on any existing spot or on-demand node", podID(pod))
+		}
+	}
+	if targetNodeInfo == nil {
+		return nil, fmt.Errorf("pod %s can't be rescheduled on any existing spot node", podID(pod))
+	}
+	return targetNodeInfo, nil
+}
+
+// Determines if the pod is held back by scheduling gates. The API types used
+// here predate spec.schedulingGates, so the PodScheduled condition the
+// scheduler sets on gated pods is checked instead.
+func hasSchedulingGates(pod *apiv1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == apiv1.PodScheduled && condition.Status == apiv1.ConditionFalse && condition.Reason == schedulingGatedReason {
+			return true
+		}
+	}
+	return false
+}
+
+// Removes spot nodes matching the exclude target selector, spot nodes which
+// are still warming up, and spot nodes being interrupted when handling
+// interruptions, from the list of potential targets for pods.
+func filterTargetNodes(spotNodeInfos nodes.NodeInfoArray) nodes.NodeInfoArray {
+	if excludedTargets == nil && *spotNodeWarmup <= 0 && !*handleSpotInterruptions {
+		return spotNodeInfos
+	}
+
+	now := time.Now()
+	targets := make(nodes.NodeInfoArray, 0, len(spotNodeInfos))
+	for _, nodeInfo := range spotNodeInfos {
+		if excludedTargets != nil && excludedTargets.Matches(labels.Set(nodeInfo.Node.Labels)) {
+			glog.V(4).Infof("Excluding spot node %s as a target", nodeInfo.Node.Name)
+			continue
+		}
+		if isWarmingUp(nodeInfo.Node, *spotNodeWarmup, now) {
+			glog.V(4).Infof("Excluding spot node %s as a target while it warms up", nodeInfo.Node.Name)
+			continue
+		}
+		if *handleSpotInterruptions && nodes.IsInterrupted(nodeInfo.Node) {
+			glog.V(4).Infof("Excluding spot node %s as a target as it is being interrupted", nodeInfo.Node.Name)
+			continue
+		}
+		targets = append(targets, nodeInfo)
+	}
+	return targets
+}
+
+// Determines if the node joined or became ready within the warmup period.
+func isWarmingUp(node *apiv1.Node, warmup time.Duration, now time.Time) bool {
+	if warmup <= 0 {
+		return false
+	}
+
+	since := node.CreationTimestamp.Time
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == apiv1.NodeReady && condition.LastTransitionTime.After(since) {
+			since = condition.LastTransitionTime.Time
+		}
+	}
+	return now.Sub(since) < warmup
+}
+
+// Updates the plan with the pods on the node according to the live API. Pods
+// which have gone are dropped from the plan and pods which have arrived since
+// the plan was built are added to it, returning an error if they can't be moved.
+func reconcilePlanPods(kubeClient kube_client.Interface, predicateChecker *simulator.PredicateChecker, plan *drainPlan, pdbs []*policyv1.PodDisruptionBudget) (*drainPlan, error) {
+	nodeMap, err := nodes.NewLiveNodeMap(kubeClient, []*apiv1.Node{plan.node.Node})
+	if err != nil {
+		return plan, fmt.Errorf("failed to refresh node: %v", err)
+	}
+	if len(nodeMap[nodes.OnDemand]) != 1 {
+		return plan, fmt.Errorf("node is no longer on-demand")
+	}
+	livePods, err := getPodsForDeletion(nodeMap[nodes.OnDemand][0], pdbs)
+	if err != nil {
+		return plan, err
+	}
+
+	planned := make(map[string]*apiv1.Pod, len(plan.pods))
+	for _, pod := range plan.pods {
+		planned[podID(pod)] = pod
+	}
+	unplaced := make(map[string]bool, len(plan.unplaced))
+	for _, pod := range plan.unplaced {
+		unplaced[podID(pod)] = true
+	}
+
+	reconciled := *plan
+	reconciled.pods = make([]*apiv1.Pod, 0, len(livePods))
+	newPods := make([]*apiv1.Pod, 0)
+	for _, pod := range livePods {
+		if plannedPod, ok := planned[podID(pod)]; ok {
+			reconciled.pods = append(reconciled.pods, plannedPod)
+			continue
+		}
+		// Pods left out of a partial drain stay where they are
+		if unplaced[podID(pod)] {
+			continue
+		}
+		newPods = append(newPods, pod)
+	}
+	if dropped := len(plan.pods) - (len(reconciled.pods)); dropped > 0 {
+		glog.V(2).Infof("%d pods planned to move from %s have already gone", dropped, plan.node.Node.Name)
+	}
+	if len(newPods) == 0 {
+		return &reconciled, nil
+	}
+
+	// Place the new pods alongside the pods already planned
+	if err := checkProtectedPods(newPods, protectedPods); err != nil {
+		return plan, err
+	}
+	if err := checkPinnedPods(newPods); err != nil {
+		return plan, err
+	}
+	if err := checkVolumeNodeAffinity(kubeClient, newPods, plan.spotNodeInfos); err != nil {
+		return plan, err
+	}
+	if err := checkPDBs(newPods, pdbs); err != nil {
+		return plan, err
+	}
+	reconciled.targets = make(map[*apiv1.Pod]*nodes.NodeInfo, len(plan.targets)+len(newPods))
+	for pod, target := range plan.targets {
+		reconciled.targets[pod] = target
+	}
+	targets := filterTargetNodes(reconciled.spotNodeInfos)
+	for _, pod := range newPods {
+		if hasSchedulingGates(pod) {
+			return plan, fmt.Errorf("new pod %s has scheduling gates and can't be rescheduled", podID(pod))
+		}
+		target := findSpotNodeForPod(predicateChecker, targets, pod)
+		if target == nil && reconciled.onDemandNodeInfos != nil {
+			target = findSpotNodeForPod(predicateChecker, reconciled.onDemandNodeInfos, pod)
+		}
+		if target == nil && *allowPartialDrain {
+			glog.V(4).Infof("Leaving new pod %s on %s, it can't be rescheduled on any existing node", podID(pod), plan.node.Node.Name)
+			reconciled.unplaced = append(reconciled.unplaced, pod)
+			continue
+		}
+		if target == nil {
+			return plan, fmt.Errorf("new pod %s can't be rescheduled on any existing node", podID(pod))
+		}
+		target.AddPod(pod)
+		reconciled.targets[pod] = target
+		reconciled.pods = append(reconciled.pods, pod)
+	}
+	glog.V(2).Infof("Added %d pods which arrived on %s to the plan", len(newPods), plan.node.Node.Name)
+	return &reconciled, nil
+}
+
+// Creates a check which rebuilds the plan's target nodes from the live API and
+// verifies the pods remaining on the on-demand node can still all be moved
+// onto them.
+func newPlacementCheck(kubeClient kube_client.Interface, predicateChecker *simulator.PredicateChecker, plan *drainPlan) scaler.PlacementCheck {
+	targetNodes := make([]*apiv1.Node, 0, len(plan.spotNodeInfos)+len(plan.onDemandNodeInfos))
+	for _, spotNodeInfo := range plan.spotNodeInfos {
+		targetNodes = append(targetNodes, spotNodeInfo.Node)
+	}
+	for _, onDemandNodeInfo := range plan.onDemandNodeInfos {
+		targetNodes = append(targetNodes, onDemandNodeInfo.Node)
+	}
+
+	return func(remaining []*apiv1.Pod) error {
+		nodeMap, err := nodes.NewLiveNodeMap(kubeClient, targetNodes)
+		if err != nil {
+			return fmt.Errorf("failed to refresh target nodes: %v", err)
+		}
+		var checked *drainPlan
+		if plan.onDemandNodeInfos != nil {
+			checked, err = buildConsolidationPlan(context.Background(), predicateChecker, plan.node, nodeMap[nodes.Spot], nodeMap[nodes.OnDemand], remaining)
+		} else {
+			checked, err = buildDrainPlan(context.Background(), predicateChecker, plan.node, nodeMap[nodes.Spot], remaining)
+		}
+		if err != nil {
+			return err
+		}
+		// The pods still to be evicted must all fit, even when draining partially
+		if len(checked.unplaced) > 0 {
+			return fmt.Errorf("pod %s can no longer be rescheduled", podID(checked.unplaced[0]))
+		}
+		return nil
+	}
+}
+
+// Works out the longest a drain of the given number of pods should take.
+// Pods are drained one at a time when revalidating during drains or keeping
+// to the priority order, and in batches with a drain concurrency limit.
+func drainDuration(pods int) time.Duration {
+	perDrain := *podEvictionTimeout + *maxGracefulTermination + scaler.MaxPreStopGracePeriod
+	if *revalidateDuringDrain || evictsInPriorityOrderSequentially() {
+		perDrain *= time.Duration(pods)
+	} else if scaler.DrainConcurrency > 0 {
+		perDrain *= time.Duration((pods + scaler.DrainConcurrency - 1) / scaler.DrainConcurrency)
+	}
+	return perDrain + scaler.ReplacementReadyTimeout
+}
+
+// Determines if pods are evicted one at a time to keep to the priority order,
+// as there is no concurrency limit to start them in order.
+func evictsInPriorityOrderSequentially() bool {
+	return *respectPodPriority && scaler.DrainConcurrency == 0
+}
+
+// Logs the pods that would be evicted by the plan and the spot nodes they
+// would move to.
+func logDryRun(plan *drainPlan) {
+	logInfo(0, "Dry run: would drain node", "node", plan.node.Node.Name, "pods", len(plan.pods))
+	for _, pod := range plan.pods {
+		target := "unknown"
+		if nodeInfo, ok := plan.targets[pod]; ok {
+			target = nodeInfo.Node.Name
+		}
+		logInfo(0, "Dry run: would evict pod", "pod", podID(pod), "target", target)
+	}
+}
+
+// nodeGoneError is returned by drainNode when the node was removed before it
+// could be drained.
+type nodeGoneError struct {
+	node string
+}
+
+func (e *nodeGoneError) Error() string {
+	return fmt.Sprintf("node %s no longer exists", e.node)
 }
 
 // Performs a drain on given node and updates the nextDrainTime variable.
-// Returns an error if the drain fails.
-func drainNode(kubeClient kube_client.Interface, recorder kube_record.EventRecorder, node *apiv1.Node, pods []*apiv1.Pod, maxGracefulTermination int, podEvictionTimeout time.Duration) error {
-	err := scaler.DrainNode(node, pods, kubeClient, recorder, maxGracefulTermination, podEvictionTimeout, scaler.EvictionRetryTime)
+// Returns an error if the drain fails, which is a nodeGoneError if the node no
+// longer exists.
+func drainNode(kubeClient kube_client.Interface, recorder kube_record.EventRecorder, node *apiv1.Node, pods []*apiv1.Pod, maxGracefulTermination int, overrideGracePeriod int, podEvictionTimeout time.Duration, evictionRetryTime time.Duration, check scaler.PlacementCheck) error {
+	instanceType := nodes.InstanceType(node)
+	// Evict the least important pods first, so the most important stay
+	// longest if the drain fails part way
+	if *respectPodPriority {
+		pods = sortByPodPriority(pods)
+		// Without a concurrency limit every eviction would start at once,
+		// ignoring the order, so evict one pod at a time instead
+		if check == nil && evictsInPriorityOrderSequentially() {
+			check = func([]*apiv1.Pod) error { return nil }
+		}
+	}
+	for _, pod := range pods {
+		if autoscaler_drain.HasLocalStorage(pod) {
+			glog.Warningf("Evicting pod %s from node %s, data in its local storage will be lost.", podID(pod), node.Name)
+		}
+	}
+
+	cordoned, err := cordonNode(kubeClient, node)
+	if errors.IsNotFound(err) {
+		metrics.UpdateNodeDrainCount("Skipped", scaler.DrainReasonNodeGone, node.Name)
+		return &nodeGoneError{node: node.Name}
+	}
 	if err != nil {
-		metrics.UpdateNodeDrainCount("Failure", node.Name)
+		recorder.Eventf(node, apiv1.EventTypeWarning, "ReschedulerFailed", "failed to cordon the node: %v", err)
+		metrics.UpdateNodeDrainCount("Failure", scaler.DrainFailureReason(err), node.Name)
+		metrics.UpdateInstanceTypeDrainCount("Failure", instanceType)
+		return err
+	}
+	// The node is left schedulable whether or not the drain succeeds, in case
+	// its capacity is required again
+	if cordoned {
+		defer func() {
+			if err := uncordonNode(kubeClient, node); err != nil && !errors.IsNotFound(err) {
+				glog.Errorf("Failed to uncordon node %s: %v", node.Name, err)
+				recorder.Eventf(node, apiv1.EventTypeWarning, "ReschedulerFailed", "failed to uncordon the node: %v", err)
+			}
+		}()
+	}
+
+	err = scaler.DrainNode(node, pods, kubeClient, recorder, maxGracefulTermination, overrideGracePeriod, podEvictionTimeout, evictionRetryTime, check)
+	// The node is still drained when replacements are missing, so the error is
+	// returned after counting it as drained
+	if _, ok := err.(*scaler.ReplacementsNotReadyError); ok {
+		metrics.UpdateReplacementsNotReady(node.Name)
+	} else if scaler.DrainFailureReason(err) == scaler.DrainReasonNodeGone {
+		metrics.UpdateNodeDrainCount("Skipped", scaler.DrainReasonNodeGone, node.Name)
+		return &nodeGoneError{node: node.Name}
+	} else if err != nil {
+		metrics.UpdateNodeDrainCount("Failure", scaler.DrainFailureReason(err), node.Name)
+		metrics.UpdateInstanceTypeDrainCount("Failure", instanceType)
 		return err
 	}
 
-	metrics.UpdateNodeDrainCount("Success", node.Name)
+	metrics.UpdateNodeDrainCount("Success", "", node.Name)
+	metrics.UpdateInstanceTypeDrainCount("Success", instanceType)
+	metrics.UpdateReclaimedResources(
+		float64(node.Status.Allocatable.Cpu().MilliValue())/1000,
+		float64(node.Status.Allocatable.Memory().Value())/(1024*1024*1024))
+	if saving, ok := prices.hourlySaving(instanceType); ok {
+		metrics.UpdateEstimatedHourlySavings(instanceType, saving)
+	} else if *priceMapFlag != "" {
+		glog.V(2).Infof("No on-demand price for instance type %s of node %s, not estimating savings.", instanceType, node.Name)
+	}
+	return err
+}
+
+// Cordons an on-demand node without any pods to move and leaves it cordoned
+// for the cluster autoscaler to remove.
+func cordonEmptyNode(kubeClient kube_client.Interface, recorder kube_record.EventRecorder, node *apiv1.Node) error {
+	cordoned, err := cordonNode(kubeClient, node)
+	if err != nil {
+		recorder.Eventf(node, apiv1.EventTypeWarning, "ReschedulerFailed", "failed to cordon the empty node: %v", err)
+		return err
+	}
+	if cordoned {
+		glog.Infof("Cordoned node %s as it has no pods to move.", node.Name)
+		recorder.Event(node, apiv1.EventTypeNormal, "ReschedulerCordonedEmpty", "node cordoned as it has no pods to move, so it can be scaled down")
+	}
 	return nil
 }
 
+// Marks the node as unschedulable so that no new pods are placed on it while
+// it is drained. Returns false if the node was already cordoned, in which case
+// it should be left as it was found.
+func cordonNode(kubeClient kube_client.Interface, node *apiv1.Node) (bool, error) {
+	freshNode, err := kubeClient.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	if err != nil {
+		metrics.UpdateNodeCordon("cordon", err)
+		return false, err
+	}
+	if freshNode.Spec.Unschedulable {
+		glog.V(2).Infof("Node %s is already cordoned", node.Name)
+		return false, nil
+	}
+	freshNode.Spec.Unschedulable = true
+	_, err = kubeClient.CoreV1().Nodes().Update(freshNode)
+	metrics.UpdateNodeCordon("cordon", err)
+	if err != nil {
+		return false, err
+	}
+	glog.V(2).Infof("Cordoned node %s", node.Name)
+	return true, nil
+}
+
+// Marks the node as schedulable again after it has been cordoned by
+// cordonNode.
+func uncordonNode(kubeClient kube_client.Interface, node *apiv1.Node) error {
+	freshNode, err := kubeClient.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	if err != nil {
+		metrics.UpdateNodeCordon("uncordon", err)
+		return err
+	}
+	freshNode.Spec.Unschedulable = false
+	_, err = kubeClient.CoreV1().Nodes().Update(freshNode)
+	metrics.UpdateNodeCordon("uncordon", err)
+	if err == nil {
+		glog.V(2).Infof("Uncordoned node %s", node.Name)
+	}
+	return err
+}
+
+// Counts the nodes running pods which would need to be moved to drain them.
+func countNonEmptyNodes(nodeInfos nodes.NodeInfoArray, pdbs []*policyv1.PodDisruptionBudget) int {
+	count := 0
+	for _, nodeInfo := range nodeInfos {
+		pods, err := getPodsForDeletion(nodeInfo, pdbs)
+		if err != nil || len(pods) > 0 {
+			count++
+		}
+	}
+	return count
+}
+
+// Counts the pods across the cluster which are in the Pending phase.
+func countPendingPods(kubeClient kube_client.Interface) (int, error) {
+	pendingPods, err := kubeClient.CoreV1().Pods(apiv1.NamespaceAll).List(
+		metav1.ListOptions{FieldSelector: fields.SelectorFromSet(fields.Set{"status.phase": string(apiv1.PodPending)}).String()})
+	if err != nil {
+		return 0, err
+	}
+	return len(pendingPods.Items), nil
+}
+
+// Fetches the latest version of the node and determines whether it still
+// exists and is still classed as on-demand.
+func isStillOnDemand(kubeClient kube_client.Interface, node *apiv1.Node) (bool, error) {
+	freshNode, err := kubeClient.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return nodes.IsOnDemand(freshNode), nil
+}
+
+// Fetches the latest version of each of the plan's target nodes and returns
+// the names of those which no longer exist or are no longer classed the same
+// way as when the plan was built.
+func findTargetLabelDrift(kubeClient kube_client.Interface, plan *drainPlan) ([]string, error) {
+	checked := make(map[string]bool)
+	drifted := make([]string, 0)
+	for _, target := range plan.targets {
+		node := target.Node
+		if checked[node.Name] {
+			continue
+		}
+		checked[node.Name] = true
+
+		freshNode, err := kubeClient.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			drifted = append(drifted, node.Name)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if nodes.IsSpot(freshNode) != nodes.IsSpot(node) || nodes.IsOnDemand(freshNode) != nodes.IsOnDemand(node) {
+			drifted = append(drifted, node.Name)
+		}
+	}
+	sort.Strings(drifted)
+	return drifted, nil
+}
+
+// Counts a failed drain for the node and, once maxNodeDrainAttempts is reached,
+// annotates the node so that it is skipped until an operator intervenes.
+func recordDrainFailure(kubeClient kube_client.Interface, drainFailures map[string]int, node *apiv1.Node) {
+	drainFailures[node.Name]++
+	if *maxNodeDrainAttempts < 1 || drainFailures[node.Name] < *maxNodeDrainAttempts {
+		return
+	}
+
+	glog.Warningf("Node %s failed to drain %d times, it will be skipped until annotation %s is removed.", node.Name, drainFailures[node.Name], nodes.DrainSkippedAnnotation)
+	err := nodes.MarkDrainSkipped(node, kubeClient)
+	if err != nil {
+		glog.Errorf("Failed to mark node %s as skipped: %v", node.Name, err)
+		return
+	}
+	delete(drainFailures, node.Name)
+}
+
+// Works out how long to skip a node for after it has failed to drain the given
+// number of consecutive times, doubling from base after each failure up to max.
+func drainBackoff(failures int, base time.Duration, max time.Duration) time.Duration {
+	backoff := base
+	for i := 1; i < failures && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		return max
+	}
+	return backoff
+}
+
+// Counts the on-demand nodes which have been marked as skipped and updates the
+// metrics system.
+func updateDrainSkippedMetrics(onDemandNodeInfos nodes.NodeInfoArray) {
+	skipped := 0
+	for _, nodeInfo := range onDemandNodeInfos {
+		if nodes.IsDrainSkipped(nodeInfo.Node) {
+			skipped++
+		}
+	}
+	metrics.UpdateDrainSkippedNodesCount(skipped)
+}
+
 // Goes through a list of NodeInfos and updates the metrics system with the
 // number of pods that the rescheduler understands (So not daemonsets for
 // instance) that are on each of the nodes, labelling them as spot nodes.
@@ -414,7 +2275,7 @@ func updateSpotNodeMetrics(spotNodeInfos nodes.NodeInfoArray, pdbs []*policyv1.P
 		// Get a list of pods that are on the node (Only the types considered by the rescheduler)
 		podsOnNode, err := autoscaler_drain.GetPodsForDeletionOnNodeDrain(nodeInfo.Pods, pdbs, *deleteNonReplicatedPods, false, false, false, nil, 0, time.Now())
 		if err != nil {
-			glog.Errorf("Failed to update metrics on spot node %s: %v", nodeInfo.Node.Name, err)
+			dedupLog.Errorf("Failed to update metrics on spot node %s: %v", nodeInfo.Node.Name, err)
 			continue
 		}
 		metrics.UpdateNodePodsCount(nodes.SpotNodeLabel, nodeInfo.Node.Name, len(podsOnNode))
@@ -422,6 +2283,48 @@ func updateSpotNodeMetrics(spotNodeInfos nodes.NodeInfoArray, pdbs []*policyv1.P
 	}
 }
 
+// Checks every PodDisruptionBudget that selects each of the pods and returns an
+// error if any of them does not currently allow a disruption.
+// A pod may be covered by more than one PDB, so the most restrictive applies.
+func checkPDBs(pods []*apiv1.Pod, pdbs []*policyv1.PodDisruptionBudget) error {
+	for _, pdb := range pdbs {
+		selector, err := metav1.LabelSelectorAsSelector(pdb.Spec.Selector)
+		if err != nil {
+			return fmt.Errorf("failed to parse selector for PDB %s/%s: %v", pdb.Namespace, pdb.Name, err)
+		}
+		for _, pod := range pods {
+			if pod.Namespace != pdb.Namespace || !selector.Matches(labels.Set(pod.Labels)) {
+				continue
+			}
+			if pdb.Status.PodDisruptionsAllowed < 1 {
+				return fmt.Errorf("pod %s is protected by PDB %s/%s which allows no disruptions", podID(pod), pdb.Namespace, pdb.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// Builds the set of node names and determines whether it differs from the
+// previous set. The first set seen is never considered a change.
+func nodeSetChanged(previous map[string]struct{}, allNodes []*apiv1.Node) (map[string]struct{}, bool) {
+	current := make(map[string]struct{}, len(allNodes))
+	for _, node := range allNodes {
+		current[node.Name] = struct{}{}
+	}
+	if previous == nil {
+		return current, false
+	}
+	if len(previous) != len(current) {
+		return current, true
+	}
+	for name := range current {
+		if _, found := previous[name]; !found {
+			return current, true
+		}
+	}
+	return current, false
+}
+
 // Returns the pods Namespace/Name as a string
 func podID(pod *apiv1.Pod) string {
 	return fmt.Sprintf("%s/%s", pod.Namespace, pod.Name)
@@ -433,9 +2336,48 @@ func validateArgs(OnDemandNodeLabel string, SpotNodeLabel string) error {
 		return fmt.Errorf("the on demand node label is not correctly formatted: expected '<label_name>' or '<label_name>=<label_value>', but got %s", OnDemandNodeLabel)
 	}
 
-	if len(strings.Split(SpotNodeLabel, "=")) > 2 {
-		return fmt.Errorf("the spot node label is not correctly formatted: expected '<label_name>' or '<label_name>=<label_value>', but got %s", SpotNodeLabel)
+	for _, label := range strings.Split(SpotNodeLabel, ",") {
+		label = strings.TrimSpace(label)
+		if label == "" || len(strings.Split(label, "=")) > 2 {
+			return fmt.Errorf("the spot node label is not correctly formatted: expected '<label_name>' or '<label_name>=<label_value>', but got %s", SpotNodeLabel)
+		}
 	}
 
 	return nil
 }
+
+// Checks that the drain selection mode provided as an argument is known.
+func validateDrainSelection(selection string) error {
+	switch selection {
+	case drainSelectionFirst, drainSelectionBest:
+		return nil
+	}
+	return fmt.Errorf("the drain selection is not valid: expected '%s' or '%s', but got %s", drainSelectionFirst, drainSelectionBest, selection)
+}
+
+// Checks that the packing strategy provided as an argument is known.
+func validatePackingStrategy(strategy string) error {
+	switch strategy {
+	case packingStrategyFirstFit, packingStrategyBestFit, packingStrategyWorstFit:
+		return nil
+	}
+	return fmt.Errorf("the packing strategy is not valid: expected '%s', '%s' or '%s', but got %s", packingStrategyFirstFit, packingStrategyBestFit, packingStrategyWorstFit, strategy)
+}
+
+// Checks that the DaemonSet pod behaviour provided as an argument is known.
+func validateDaemonSetPods(action string) error {
+	switch action {
+	case daemonSetPodsIgnore, daemonSetPodsDelete:
+		return nil
+	}
+	return fmt.Errorf("the daemonset pods behaviour is not valid: expected '%s' or '%s', but got %s", daemonSetPodsIgnore, daemonSetPodsDelete, action)
+}
+
+// Parses a label selector provided as an argument. An empty selector returns
+// nil rather than a selector matching everything.
+func parseSelector(selector string) (labels.Selector, error) {
+	if selector == "" {
+		return nil, nil
+	}
+	return labels.Parse(selector)
+}
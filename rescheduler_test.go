@@ -17,15 +17,35 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/pusher/k8s-spot-rescheduler/nodes"
+	"github.com/pusher/k8s-spot-rescheduler/scaler"
 	"github.com/stretchr/testify/assert"
 	apiv1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	simulator "k8s.io/autoscaler/cluster-autoscaler/simulator"
+	"k8s.io/client-go/kubernetes/fake"
+	core "k8s.io/client-go/testing"
+	kube_record "k8s.io/client-go/tools/record"
+	"k8s.io/kubernetes/pkg/scheduler/factory"
 )
 
 func TestFindSpotNodeForPod(t *testing.T) {
@@ -70,71 +90,1680 @@ func TestFindSpotNodeForPod(t *testing.T) {
 
 }
 
+func TestFindSpotNodeForPodMinFreePodSlots(t *testing.T) {
+	predicateChecker := simulator.NewTestPredicateChecker()
+
+	smallNode := createTestNode("small", 2000)
+	smallNode.Status.Allocatable[apiv1.ResourcePods] = *resource.NewQuantity(3, resource.DecimalSI)
+	smallNode.Status.Capacity = smallNode.Status.Allocatable
+	nodeInfos := []*nodes.NodeInfo{
+		createTestNodeInfo(smallNode, []*apiv1.Pod{createTestPod("p1", 100)}, 100),
+		createTestNodeInfo(createTestNode("large", 2000), []*apiv1.Pod{}, 0),
+	}
+	pod := createTestPod("pod1", 100)
+
+	*minFreePodSlots = 1
+	node := findSpotNodeForPod(predicateChecker, nodeInfos, pod)
+	assert.Equal(t, "small", node.Node.Name)
+
+	*minFreePodSlots = 2
+	node = findSpotNodeForPod(predicateChecker, nodeInfos, pod)
+	assert.Equal(t, "large", node.Node.Name, "expected the small node to be skipped to keep two slots free")
+
+	*minFreePodSlots = 0
+}
+
+func TestFindSpotNodeForPodBestFit(t *testing.T) {
+	predicateChecker := simulator.NewTestPredicateChecker()
+
+	// Sorted by most requested CPU, the large node comes first
+	nodeInfos := []*nodes.NodeInfo{
+		createTestNodeInfo(createTestNode("large", 4000), []*apiv1.Pod{createTestPod("p1", 1500)}, 1500),
+		createTestNodeInfo(createTestNode("small", 1000), []*apiv1.Pod{createTestPod("p2", 500)}, 500),
+	}
+	pod := createTestPod("pod1", 300)
+
+	node := findSpotNodeForPod(predicateChecker, nodeInfos, pod)
+	assert.Equal(t, "large", node.Node.Name)
+
+	*packingStrategy = packingStrategyBestFit
+	node = findSpotNodeForPod(predicateChecker, nodeInfos, pod)
+	assert.Equal(t, "small", node.Node.Name, "expected the node leaving the least free CPU to be chosen")
+
+	*packingStrategy = packingStrategyWorstFit
+	node = findSpotNodeForPod(predicateChecker, nodeInfos, pod)
+	assert.Equal(t, "large", node.Node.Name, "expected the node leaving the most free CPU to be chosen")
+
+	// Memory counts as well as CPU
+	memoryPod := createTestPod("memory", 500)
+	memoryPod.Spec.Containers[0].Resources.Requests[apiv1.ResourceMemory] = *resource.NewQuantity(1024*1024*1024, resource.DecimalSI)
+	nodeInfos = []*nodes.NodeInfo{
+		createTestNodeInfo(createTestNode("cpu", 2000), []*apiv1.Pod{createTestPod("p3", 500)}, 500),
+		createTestNodeInfo(createTestNode("memory", 2000), []*apiv1.Pod{memoryPod}, 500),
+	}
+	*packingStrategy = packingStrategyBestFit
+	node = findSpotNodeForPod(predicateChecker, nodeInfos, pod)
+	assert.Equal(t, "memory", node.Node.Name, "expected the node leaving the least free memory to be chosen")
+
+	*packingStrategy = packingStrategyWorstFit
+	node = findSpotNodeForPod(predicateChecker, nodeInfos, pod)
+	assert.Equal(t, "cpu", node.Node.Name, "expected the node leaving the most free memory to be chosen")
+
+	*packingStrategy = packingStrategyFirstFit
+}
+
+func TestBuildDrainPlanDecreasing(t *testing.T) {
+	predicateChecker := simulator.NewTestPredicateChecker()
+	*packingStrategy = packingStrategyBestFit
+	defer func() { *packingStrategy = packingStrategyFirstFit }()
+
+	spotNodeInfos := []*nodes.NodeInfo{
+		createTestNodeInfo(createTestNode("large", 1000), []*apiv1.Pod{}, 0),
+		createTestNodeInfo(createTestNode("small", 600), []*apiv1.Pod{}, 0),
+	}
+	onDemandNodeInfo := createTestNodeInfo(createTestNode("node1", 2000), []*apiv1.Pod{}, 0)
+
+	// Placing the small pod first would take the small node, leaving nowhere
+	// for the medium pod once the large pod is placed
+	small, medium, large := createTestPod("small", 200), createTestPod("medium", 500), createTestPod("large", 800)
+	plan, err := buildDrainPlan(context.Background(), predicateChecker, onDemandNodeInfo, spotNodeInfos, []*apiv1.Pod{small, medium, large})
+	assert.NoError(t, err)
+	assert.Equal(t, []*apiv1.Pod{large, medium, small}, plan.pods, "expected the largest pods to be placed first")
+	assert.Equal(t, "large", plan.targets[large].Node.Name)
+	assert.Equal(t, "small", plan.targets[medium].Node.Name)
+}
+
+func TestValidatePackingStrategy(t *testing.T) {
+	assert.NoError(t, validatePackingStrategy(packingStrategyFirstFit))
+	assert.NoError(t, validatePackingStrategy(packingStrategyBestFit))
+	assert.NoError(t, validatePackingStrategy(packingStrategyWorstFit))
+	assert.Error(t, validatePackingStrategy(targetSelectionMostRequested))
+}
+
+func TestFindSpotNodeForPodHeadroom(t *testing.T) {
+	predicateChecker := simulator.NewTestPredicateChecker()
+
+	nodeInfos := []*nodes.NodeInfo{
+		createTestNodeInfo(createTestNode("spot", 1000), []*apiv1.Pod{createTestPod("p1", 500)}, 500),
+	}
+	pod := createTestPod("pod1", 300)
+
+	*spotHeadroomPercent = 10
+	defer func() { *spotHeadroomPercent = 0 }()
+	assert.NotNil(t, findSpotNodeForPod(predicateChecker, nodeInfos, pod), "expected 80% requested to leave enough headroom")
+
+	*spotHeadroomPercent = 25
+	assert.Nil(t, findSpotNodeForPod(predicateChecker, nodeInfos, pod), "expected 80% requested not to leave enough headroom")
+}
+
+func TestFindSpotNodeForPodDefaultRequests(t *testing.T) {
+	predicateChecker := simulator.NewTestPredicateChecker()
+
+	newPod := func(name string) *apiv1.Pod {
+		pod := createTestPod(name, 0)
+		pod.Spec.Containers[0].Resources.Requests = nil
+		return pod
+	}
+	nodeInfos := []*nodes.NodeInfo{
+		createTestNodeInfo(createTestNode("node1", 1000), []*apiv1.Pod{newPod("p1"), newPod("p2")}, 0),
+	}
+	pod := newPod("pod1")
+
+	node := findSpotNodeForPod(predicateChecker, nodeInfos, pod)
+	assert.NotNil(t, node, "expected a pod without requests to fit")
+
+	var err error
+	defaultPodRequests, err = parseDefaultPodRequests("400m", "0")
+	assert.NoError(t, err)
+	defer func() { defaultPodRequests = apiv1.ResourceList{} }()
+
+	node = findSpotNodeForPod(predicateChecker, nodeInfos, pod)
+	assert.Nil(t, node, "expected the default requests to stop the pod fitting")
+	assert.Nil(t, pod.Spec.Containers[0].Resources.Requests, "expected the pod not to be modified")
+}
+
+func TestIsStillOnDemand(t *testing.T) {
+	nodes.OnDemandNodeLabel = "kubernetes.io/role=worker"
+	nodes.SpotNodeLabel = "kubernetes.io/role=spot-worker"
+
+	onDemandNode := createTestNode("on-demand", 2000)
+	onDemandNode.Labels = map[string]string{"kubernetes.io/role": "worker"}
+	relabelledNode := createTestNode("relabelled", 2000)
+	relabelledNode.Labels = map[string]string{"kubernetes.io/role": "spot-worker"}
+	deletedNode := createTestNode("deleted", 2000)
+
+	fakeClient := fake.NewSimpleClientset(onDemandNode, relabelledNode)
+
+	stillOnDemand, err := isStillOnDemand(fakeClient, onDemandNode)
+	assert.NoError(t, err)
+	assert.True(t, stillOnDemand)
+
+	stillOnDemand, err = isStillOnDemand(fakeClient, relabelledNode)
+	assert.NoError(t, err)
+	assert.False(t, stillOnDemand, "expected a relabelled node not to be on-demand")
+
+	stillOnDemand, err = isStillOnDemand(fakeClient, deletedNode)
+	assert.NoError(t, err, "expected a deleted node not to be an error")
+	assert.False(t, stillOnDemand, "expected a deleted node not to be on-demand")
+}
+
+func TestInMaintenance(t *testing.T) {
+	reschedulerNamespace = "kube-system"
+	kubeClient := fake.NewSimpleClientset(
+		&apiv1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "kube-system",
+				Name:        "rescheduler",
+				Annotations: map[string]string{MaintenanceAnnotation: "true"},
+			},
+		},
+		&apiv1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "ops",
+				Annotations: map[string]string{MaintenanceAnnotation: "false"},
+			},
+		},
+	)
+
+	check := func(resource string) bool {
+		parsed, err := parseMaintenanceResource(resource)
+		assert.NoError(t, err)
+		paused, err := inMaintenance(kubeClient, parsed)
+		assert.NoError(t, err)
+		return paused
+	}
+	assert.True(t, check("configmap/rescheduler"))
+	assert.False(t, check("namespace/ops"))
+	assert.False(t, check("configmap/missing"))
+	assert.False(t, check(""))
+
+	_, err := parseMaintenanceResource("deployment/rescheduler")
+	assert.Error(t, err)
+	_, err = parseMaintenanceResource("configmap")
+	assert.Error(t, err)
+}
+
+func TestGetReschedulerNamespace(t *testing.T) {
+	namespaceFile, err := ioutil.TempFile("", "namespace")
+	assert.NoError(t, err)
+	defer os.Remove(namespaceFile.Name())
+	_, err = namespaceFile.WriteString("spot-rescheduler\n")
+	assert.NoError(t, err)
+	namespaceFile.Close()
+
+	assert.Equal(t, "configured", getReschedulerNamespace("configured", true, namespaceFile.Name()))
+	assert.Equal(t, "spot-rescheduler", getReschedulerNamespace("", true, namespaceFile.Name()))
+	assert.Equal(t, *namespace, getReschedulerNamespace("", false, namespaceFile.Name()))
+	assert.Equal(t, *namespace, getReschedulerNamespace("", true, "/does/not/exist"))
+}
+
 func TestNodeLabelValidation(t *testing.T) {
 	onDemandLabel := "foo.bar/role=worker"
 	spotLabel := "foo.bar/node-role"
 
-	err := validateArgs(onDemandLabel, spotLabel)
+	err := validateArgs(onDemandLabel, spotLabel)
+	assert.NoError(t, err)
+
+	onDemandLabel = "foo.bar/broken=worker=true"
+	err = validateArgs(onDemandLabel, spotLabel)
+	assert.EqualError(t, err, "the on demand node label is not correctly formatted: expected '<label_name>' or '<label_name>=<label_value>', but got foo.bar/broken=worker=true")
+
+	onDemandLabel = "foo.bar/role=worker"
+	spotLabel = "foo.bar/node-role=spot=fail"
+	err = validateArgs(onDemandLabel, spotLabel)
+	assert.EqualError(t, err, "the spot node label is not correctly formatted: expected '<label_name>' or '<label_name>=<label_value>', but got foo.bar/node-role=spot=fail")
+
+	spotLabel = "foo.bar/node-role=spot-a, foo.bar/node-role=spot-b"
+	err = validateArgs(onDemandLabel, spotLabel)
+	assert.NoError(t, err)
+
+	spotLabel = "foo.bar/node-role=spot-a,foo.bar/node-role=spot=fail"
+	err = validateArgs(onDemandLabel, spotLabel)
+	assert.Error(t, err)
+}
+
+func TestBuildDrainPlan(t *testing.T) {
+	predicateChecker := simulator.NewTestPredicateChecker()
+
+	pods1 := []*apiv1.Pod{
+		createTestPod("p1n1", 100),
+		createTestPod("p2n1", 300),
+	}
+	pods2 := []*apiv1.Pod{
+		createTestPod("p1n2", 500),
+		createTestPod("p2n2", 300),
+	}
+	pods3 := []*apiv1.Pod{
+		createTestPod("p1n3", 500),
+		createTestPod("p2n3", 500),
+		createTestPod("p3n3", 300),
+	}
+
+	spotNodeInfos := []*nodes.NodeInfo{
+		createTestNodeInfo(createTestNode("node3", 2000), pods3, 1300),
+		createTestNodeInfo(createTestNode("node2", 1100), pods2, 800),
+		createTestNodeInfo(createTestNode("node1", 500), pods1, 400),
+	}
+
+	podsForDeletion1 := []*apiv1.Pod{
+		createTestPod("pod1", 500),
+		createTestPod("pod2", 300),
+		createTestPod("pod1", 100),
+		createTestPod("pod2", 100),
+		createTestPod("pod1", 100),
+	}
+	podsForDeletion2 := []*apiv1.Pod{
+		createTestPod("pod1", 500),
+		createTestPod("pod2", 400),
+		createTestPod("pod1", 100),
+		createTestPod("pod2", 100),
+		createTestPod("pod1", 100),
+	}
+
+	onDemandNodeInfo := createTestNodeInfo(createTestNode("node4", 2000), podsForDeletion1, 1100)
+
+	plan1, err1 := buildDrainPlan(context.Background(), predicateChecker, onDemandNodeInfo, spotNodeInfos, podsForDeletion1)
+	if err1 != nil {
+		assert.Fail(t, "buildDrainPlan should be successful with podsForDeletion1", "%v", err1)
+	}
+	assert.Equal(t, len(podsForDeletion1), len(plan1.targets))
+
+	// The original spot nodes should not be modified by the plan
+	assert.Equal(t, 3, len(spotNodeInfos[0].Pods))
+	assert.Equal(t, 2, len(spotNodeInfos[1].Pods))
+	assert.Equal(t, 2, len(spotNodeInfos[2].Pods))
+
+	_, err2 := buildDrainPlan(context.Background(), predicateChecker, onDemandNodeInfo, spotNodeInfos, podsForDeletion2)
+	if err2 == nil {
+		assert.Fail(t, "buildDrainPlan should fail with podsForDeletion2, too much requested CPU.")
+	}
+}
+
+func TestBuildDrainPlanAfterDrain(t *testing.T) {
+	predicateChecker := simulator.NewTestPredicateChecker()
+
+	spotNodeInfos := []*nodes.NodeInfo{
+		createTestNodeInfo(createTestNode("spot1", 1000), []*apiv1.Pod{}, 0),
+		createTestNodeInfo(createTestNode("spot2", 1000), []*apiv1.Pod{}, 0),
+	}
+	pods1 := []*apiv1.Pod{createTestPod("p1n1", 700)}
+	pods2 := []*apiv1.Pod{createTestPod("p1n2", 700)}
+	pods3 := []*apiv1.Pod{createTestPod("p1n3", 700)}
+	onDemandNodeInfo1 := createTestNodeInfo(createTestNode("node1", 2000), pods1, 700)
+	onDemandNodeInfo2 := createTestNodeInfo(createTestNode("node2", 2000), pods2, 700)
+	onDemandNodeInfo3 := createTestNodeInfo(createTestNode("node3", 2000), pods3, 700)
+
+	plan1, err := buildDrainPlan(context.Background(), predicateChecker, onDemandNodeInfo1, spotNodeInfos, pods1)
+	assert.NoError(t, err)
+
+	// Later drains in the cycle are planned against the spot nodes the
+	// drain before them used, so their pods go elsewhere
+	spotNodeInfos = plan1.spotNodeInfos
+	plan2, err := buildDrainPlan(context.Background(), predicateChecker, onDemandNodeInfo2, spotNodeInfos, pods2)
+	assert.NoError(t, err)
+	assert.NotEqual(t, plan1.targets[pods1[0]].Node.Name, plan2.targets[pods2[0]].Node.Name)
+
+	spotNodeInfos = plan2.spotNodeInfos
+	_, err = buildDrainPlan(context.Background(), predicateChecker, onDemandNodeInfo3, spotNodeInfos, pods3)
+	assert.Error(t, err, "expected no spot capacity to be left for a third drain")
+}
+
+func TestBuildDrainPlanCandidatesAfterDrain(t *testing.T) {
+	predicateChecker := simulator.NewTestPredicateChecker()
+
+	spotNodeInfos := []*nodes.NodeInfo{
+		createTestNodeInfo(createTestNode("spot1", 2000), []*apiv1.Pod{createTestPod("p1s1", 100), createTestPod("p2s1", 100)}, 200),
+	}
+	pods1 := []*apiv1.Pod{createTestPod("p1n1", 100)}
+	podX := createTestPod("x", 100)
+	podY := createTestPod("y", 100)
+	onDemandNodeInfo1 := createTestNodeInfo(createTestNode("node1", 2000), pods1, 100)
+	onDemandNodeInfoX := createTestNodeInfo(createTestNode("nodeX", 2000), []*apiv1.Pod{podX}, 100)
+	onDemandNodeInfoY := createTestNodeInfo(createTestNode("nodeY", 2000), []*apiv1.Pod{podY}, 100)
+
+	plan1, err := buildDrainPlan(context.Background(), predicateChecker, onDemandNodeInfo1, spotNodeInfos, pods1)
+	assert.NoError(t, err)
+
+	// Candidates for the next drain are planned against the same spot nodes,
+	// so mustn't overwrite each other's placements
+	spotNodeInfos = plan1.spotNodeInfos
+	planX, err := buildDrainPlan(context.Background(), predicateChecker, onDemandNodeInfoX, spotNodeInfos, []*apiv1.Pod{podX})
+	assert.NoError(t, err)
+	planY, err := buildDrainPlan(context.Background(), predicateChecker, onDemandNodeInfoY, spotNodeInfos, []*apiv1.Pod{podY})
+	assert.NoError(t, err)
+
+	assert.Equal(t, podX, planX.spotNodeInfos[0].Pods[3])
+	assert.Equal(t, podY, planY.spotNodeInfos[0].Pods[3])
+	assert.Equal(t, 3, len(spotNodeInfos[0].Pods))
+}
+
+func TestBuildDrainPlanPartial(t *testing.T) {
+	predicateChecker := simulator.NewTestPredicateChecker()
+	*allowPartialDrain = true
+	defer func() { *allowPartialDrain = false }()
+
+	spotNodeInfos := []*nodes.NodeInfo{
+		createTestNodeInfo(createTestNode("spot", 1000), []*apiv1.Pod{}, 0),
+	}
+	onDemandNodeInfo := createTestNodeInfo(createTestNode("node1", 2000), []*apiv1.Pod{}, 0)
+	pods := []*apiv1.Pod{createTestPod("pod1", 600), createTestPod("pod2", 600), createTestPod("pod3", 300)}
+
+	// Only the pods which fit are moved
+	plan, err := buildDrainPlan(context.Background(), predicateChecker, onDemandNodeInfo, spotNodeInfos, pods)
+	assert.NoError(t, err)
+	assert.Equal(t, []*apiv1.Pod{pods[0], pods[2]}, plan.pods)
+	assert.Equal(t, []*apiv1.Pod{pods[1]}, plan.unplaced)
+	assert.Equal(t, 2, len(plan.targets))
+
+	// Full drains are preferred over partial ones
+	full, err := buildDrainPlan(context.Background(), predicateChecker, onDemandNodeInfo, spotNodeInfos, pods[:1])
+	assert.NoError(t, err)
+	assert.True(t, full.betterThan(plan))
+	assert.False(t, plan.betterThan(full))
+
+	// A plan still needs at least one pod to move
+	_, err = buildDrainPlan(context.Background(), predicateChecker, onDemandNodeInfo, spotNodeInfos, []*apiv1.Pod{createTestPod("pod4", 1500)})
+	assert.Error(t, err)
+
+	*allowPartialDrain = false
+	_, err = buildDrainPlan(context.Background(), predicateChecker, onDemandNodeInfo, spotNodeInfos, pods)
+	assert.Error(t, err, "expected all pods to have to fit by default")
+}
+
+func TestBuildDrainPlanSchedulingGates(t *testing.T) {
+	predicateChecker := simulator.NewTestPredicateChecker()
+
+	spotNodeInfos := []*nodes.NodeInfo{
+		createTestNodeInfo(createTestNode("node1", 2000), []*apiv1.Pod{}, 0),
+	}
+
+	gatedPod := createTestPod("pod2", 100)
+	gatedPod.Status.Conditions = []apiv1.PodCondition{
+		{
+			Type:   apiv1.PodScheduled,
+			Status: apiv1.ConditionFalse,
+			Reason: schedulingGatedReason,
+		},
+	}
+	podsForDeletion := []*apiv1.Pod{createTestPod("pod1", 100), gatedPod}
+	onDemandNodeInfo := createTestNodeInfo(createTestNode("node2", 2000), podsForDeletion, 200)
+
+	_, err := buildDrainPlan(context.Background(), predicateChecker, onDemandNodeInfo, spotNodeInfos, podsForDeletion)
+	assert.Error(t, err, "a node with a gated pod should not be drainable")
+
+	_, err = buildDrainPlan(context.Background(), predicateChecker, onDemandNodeInfo, spotNodeInfos, podsForDeletion[:1])
+	assert.NoError(t, err)
+}
+
+func TestBuildDrainPlanLeavesPodsScheduled(t *testing.T) {
+	predicateChecker := simulator.NewTestPredicateChecker()
+
+	spotNodeInfos := []*nodes.NodeInfo{
+		createTestNodeInfo(createTestNode("node2", 2000), []*apiv1.Pod{}, 0),
+	}
+	pods := []*apiv1.Pod{createTestPod("pod1", 500), createTestPod("pod2", 500)}
+	for _, pod := range pods {
+		pod.Spec.NodeName = "node1"
+	}
+	onDemandNodeInfo := createTestNodeInfo(createTestNode("node1", 2000), pods, 1000)
+
+	plan, err := buildDrainPlan(context.Background(), predicateChecker, onDemandNodeInfo, spotNodeInfos, pods)
+	assert.NoError(t, err)
+	for _, pod := range pods {
+		assert.Equal(t, "node1", pod.Spec.NodeName, "expected pod %s to still be scheduled on its node", pod.Name)
+		assert.Equal(t, "node2", plan.targets[pod].Node.Name)
+	}
+}
+
+func TestBuildDrainPlanCancelled(t *testing.T) {
+	predicateChecker := simulator.NewTestPredicateChecker()
+
+	spotNodeInfos := []*nodes.NodeInfo{
+		createTestNodeInfo(createTestNode("node2", 2000), []*apiv1.Pod{}, 0),
+	}
+	pods := []*apiv1.Pod{createTestPod("pod1", 500)}
+	onDemandNodeInfo := createTestNodeInfo(createTestNode("node1", 2000), pods, 500)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := buildDrainPlan(ctx, predicateChecker, onDemandNodeInfo, spotNodeInfos, pods)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "cut short")
+	}
+	_, err = newGlobalPlanner(predicateChecker, spotNodeInfos).plan(ctx, onDemandNodeInfo, pods)
+	assert.Error(t, err)
+}
+
+func TestBuildDrainPlanExcludedTargets(t *testing.T) {
+	predicateChecker := simulator.NewTestPredicateChecker()
+
+	reservedNode := createTestNode("reserved", 2000)
+	reservedNode.Labels = map[string]string{"dedicated": "batch"}
+	spotNodeInfos := []*nodes.NodeInfo{
+		createTestNodeInfo(reservedNode, []*apiv1.Pod{}, 0),
+		createTestNodeInfo(createTestNode("general", 1000), []*apiv1.Pod{}, 0),
+	}
+
+	pods := []*apiv1.Pod{createTestPod("pod1", 500)}
+	onDemandNodeInfo := createTestNodeInfo(createTestNode("node1", 2000), pods, 500)
+
+	var err error
+	excludedTargets, err = parseSelector("dedicated=batch")
+	assert.NoError(t, err)
+	defer func() { excludedTargets = nil }()
+
+	plan, err := buildDrainPlan(context.Background(), predicateChecker, onDemandNodeInfo, spotNodeInfos, pods)
+	assert.NoError(t, err)
+	assert.Equal(t, "general", plan.targets[pods[0]].Node.Name)
+
+	// Pods that only fit on excluded nodes can't be moved
+	bigPods := []*apiv1.Pod{createTestPod("pod2", 1500)}
+	_, err = buildDrainPlan(context.Background(), predicateChecker, onDemandNodeInfo, spotNodeInfos, bigPods)
+	assert.Error(t, err)
+}
+
+func TestIsWarmingUp(t *testing.T) {
+	now := time.Now()
+
+	node := createTestNode("node1", 2000)
+	node.CreationTimestamp = metav1.NewTime(now.Add(-time.Hour))
+	node.Status.Conditions[0].LastTransitionTime = metav1.NewTime(now.Add(-time.Hour))
+	assert.False(t, isWarmingUp(node, 5*time.Minute, now))
+
+	node.Status.Conditions[0].LastTransitionTime = metav1.NewTime(now.Add(-time.Minute))
+	assert.True(t, isWarmingUp(node, 5*time.Minute, now), "expected a node which just became ready to be warming up")
+
+	node.CreationTimestamp = metav1.NewTime(now.Add(-2 * time.Minute))
+	node.Status.Conditions[0].LastTransitionTime = metav1.Time{}
+	assert.True(t, isWarmingUp(node, 5*time.Minute, now), "expected a new node to be warming up")
+	assert.False(t, isWarmingUp(node, 0, now))
+}
+
+func TestBuildConsolidationPlan(t *testing.T) {
+	predicateChecker := simulator.NewTestPredicateChecker()
+
+	spotNodeInfos := []*nodes.NodeInfo{
+		createTestNodeInfo(createTestNode("spot", 1000), []*apiv1.Pod{createTestPod("p1", 800)}, 800),
+	}
+	onDemandNodeInfo := createTestNodeInfo(createTestNode("node1", 2000), []*apiv1.Pod{}, 0)
+	onDemandNodeInfos := []*nodes.NodeInfo{
+		onDemandNodeInfo,
+		createTestNodeInfo(createTestNode("node2", 2000), []*apiv1.Pod{createTestPod("p2", 1000)}, 1000),
+	}
+
+	pods := []*apiv1.Pod{createTestPod("pod1", 100), createTestPod("pod2", 500)}
+
+	_, err := buildDrainPlan(context.Background(), predicateChecker, onDemandNodeInfo, spotNodeInfos, pods)
+	assert.Error(t, err, "expected the pods not to fit onto the spot node")
+
+	plan, err := buildConsolidationPlan(context.Background(), predicateChecker, onDemandNodeInfo, spotNodeInfos, onDemandNodeInfos, pods)
+	assert.NoError(t, err)
+	assert.Equal(t, "spot", plan.targets[pods[0]].Node.Name, "expected spot nodes to be preferred")
+	assert.Equal(t, "node2", plan.targets[pods[1]].Node.Name)
+	assert.Equal(t, 1, len(onDemandNodeInfos[1].Pods), "expected the on-demand nodes not to be modified")
+
+	_, err = buildConsolidationPlan(context.Background(), predicateChecker, onDemandNodeInfo, spotNodeInfos, onDemandNodeInfos, []*apiv1.Pod{createTestPod("pod3", 1500)})
+	assert.Error(t, err, "expected the node being drained not to be a target")
+}
+
+func TestSpotInterruptions(t *testing.T) {
+	predicateChecker := simulator.NewTestPredicateChecker()
+	nodes.SpotInterruptionTaint = "aws-node-termination-handler/spot-itn"
+	defer func() { nodes.SpotInterruptionTaint = "" }()
+
+	interruptedNode := createTestNode("interrupted", 2000)
+	interruptedNode.Spec.Taints = []apiv1.Taint{{Key: "aws-node-termination-handler/spot-itn", Effect: apiv1.TaintEffectNoSchedule}}
+	spotNodeInfos := []*nodes.NodeInfo{
+		createTestNodeInfo(interruptedNode, []*apiv1.Pod{}, 0),
+		createTestNodeInfo(createTestNode("spot", 1000), []*apiv1.Pod{createTestPod("p1", 500)}, 500),
+	}
+	onDemandNodeInfos := []*nodes.NodeInfo{
+		createTestNodeInfo(createTestNode("on-demand", 2000), []*apiv1.Pod{}, 0),
+	}
+
+	interrupted, remaining := splitInterruptedNodes(spotNodeInfos)
+	assert.Equal(t, 1, len(interrupted))
+	assert.Equal(t, "interrupted", interrupted[0].Node.Name)
+	assert.Equal(t, 1, len(remaining))
+	assert.Equal(t, "spot", remaining[0].Node.Name)
+
+	// Pods move onto the remaining spot nodes first, then back onto on-demand
+	pods := []*apiv1.Pod{createTestPod("pod1", 400), createTestPod("pod2", 400)}
+	plan, err := buildConsolidationPlan(context.Background(), predicateChecker, interrupted[0], remaining, onDemandNodeInfos, pods)
+	assert.NoError(t, err)
+	assert.Equal(t, "spot", plan.targets[pods[0]].Node.Name)
+	assert.Equal(t, "on-demand", plan.targets[pods[1]].Node.Name)
+
+	// Interrupted nodes are never targets when handling interruptions
+	*handleSpotInterruptions = true
+	defer func() { *handleSpotInterruptions = false }()
+	targets := filterTargetNodes(spotNodeInfos)
+	assert.Equal(t, 1, len(targets))
+	assert.Equal(t, "spot", targets[0].Node.Name)
+}
+
+func TestReconcilePlanPods(t *testing.T) {
+	predicateChecker := simulator.NewTestPredicateChecker()
+
+	controller := true
+	newPod := func(name string, cpu int64) *apiv1.Pod {
+		pod := createTestPod(name, cpu)
+		pod.Namespace = "default"
+		pod.Spec.NodeName = "node1"
+		pod.OwnerReferences = []metav1.OwnerReference{
+			{APIVersion: "v1", Kind: "ReplicationController", Name: "rc", Controller: &controller},
+		}
+		return pod
+	}
+	node := createTestNode("node1", 2000)
+	node.Labels = map[string]string{"kubernetes.io/role": "worker"}
+	gone := newPod("gone", 100)
+	staying := newPod("staying", 100)
+
+	spotNodeInfos := []*nodes.NodeInfo{createTestNodeInfo(createTestNode("spot", 1000), []*apiv1.Pod{}, 0)}
+	onDemandNodeInfo := createTestNodeInfo(node, []*apiv1.Pod{gone, staying}, 200)
+	plan, err := buildDrainPlan(context.Background(), predicateChecker, onDemandNodeInfo, spotNodeInfos, []*apiv1.Pod{gone, staying})
+	assert.NoError(t, err)
+
+	// The gone pod is dropped and the small new pod is added
+	arrived := newPod("arrived", 300)
+	kubeClient := fake.NewSimpleClientset(node, staying, arrived)
+	reconciled, err := reconcilePlanPods(kubeClient, predicateChecker, plan, nil)
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(reconciled.pods)) {
+		assert.Equal(t, staying, reconciled.pods[0])
+		assert.Equal(t, "arrived", reconciled.pods[1].Name)
+	}
+	assert.Equal(t, 2, len(plan.pods), "expected the original plan not to be modified")
+
+	// A new pod which doesn't fit invalidates the plan
+	kubeClient = fake.NewSimpleClientset(node, staying, newPod("big", 1500))
+	_, err = reconcilePlanPods(kubeClient, predicateChecker, plan, nil)
+	assert.Error(t, err)
+}
+
+func TestCooldownOverrideUntil(t *testing.T) {
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	reschedulerNamespace = "kube-system"
+	newConfigMap := func(value string) *apiv1.ConfigMap {
+		return &apiv1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   reschedulerNamespace,
+				Name:        "rescheduler",
+				Annotations: map[string]string{CooldownOverrideAnnotation: value},
+			},
+		}
+	}
+
+	until, err := cooldownOverrideUntil(fake.NewSimpleClientset(), "", now)
+	assert.NoError(t, err)
+	assert.True(t, until.IsZero(), "expected no override when disabled")
+
+	until, err = cooldownOverrideUntil(fake.NewSimpleClientset(), "rescheduler", now)
+	assert.NoError(t, err)
+	assert.True(t, until.IsZero(), "expected no override without the configmap")
+
+	until, err = cooldownOverrideUntil(fake.NewSimpleClientset(newConfigMap("2018-06-01T18:00:00Z")), "rescheduler", now)
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(6*time.Hour), until.UTC())
+
+	until, err = cooldownOverrideUntil(fake.NewSimpleClientset(newConfigMap("2018-06-01T06:00:00Z")), "rescheduler", now)
+	assert.NoError(t, err)
+	assert.True(t, until.IsZero(), "expected an expired override to be ignored")
+
+	_, err = cooldownOverrideUntil(fake.NewSimpleClientset(newConfigMap("0")), "rescheduler", now)
+	assert.Error(t, err)
+}
+
+func TestFindTargetLabelDrift(t *testing.T) {
+	predicateChecker := simulator.NewTestPredicateChecker()
+
+	spotNode1 := createTestNode("spot1", 500)
+	spotNode1.Labels = map[string]string{"kubernetes.io/role": "spot-worker"}
+	spotNode2 := createTestNode("spot2", 500)
+	spotNode2.Labels = map[string]string{"kubernetes.io/role": "spot-worker"}
+	spotNodeInfos := []*nodes.NodeInfo{
+		createTestNodeInfo(spotNode1, []*apiv1.Pod{}, 0),
+		createTestNodeInfo(spotNode2, []*apiv1.Pod{}, 0),
+	}
+	pods := []*apiv1.Pod{createTestPod("p1", 400), createTestPod("p2", 400)}
+	onDemandNodeInfo := createTestNodeInfo(createTestNode("node1", 2000), pods, 800)
+	plan, err := buildDrainPlan(context.Background(), predicateChecker, onDemandNodeInfo, spotNodeInfos, pods)
+	assert.NoError(t, err)
+
+	drifted, err := findTargetLabelDrift(fake.NewSimpleClientset(spotNode1, spotNode2), plan)
+	assert.NoError(t, err)
+	assert.Empty(t, drifted)
+
+	relabelled := spotNode2.DeepCopy()
+	relabelled.Labels = map[string]string{"kubernetes.io/role": "worker"}
+	drifted, err = findTargetLabelDrift(fake.NewSimpleClientset(spotNode1, relabelled), plan)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"spot2"}, drifted)
+
+	drifted, err = findTargetLabelDrift(fake.NewSimpleClientset(), plan)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"spot1", "spot2"}, drifted)
+}
+
+func TestCordonNode(t *testing.T) {
+	node := createTestNode("node1", 2000)
+	fakeClient := fake.NewSimpleClientset(node)
+
+	cordoned, err := cordonNode(fakeClient, node)
+	assert.NoError(t, err)
+	assert.True(t, cordoned)
+	freshNode, _ := fakeClient.CoreV1().Nodes().Get("node1", metav1.GetOptions{})
+	assert.True(t, freshNode.Spec.Unschedulable)
+
+	// Nodes cordoned by someone else are left alone
+	cordoned, err = cordonNode(fakeClient, node)
+	assert.NoError(t, err)
+	assert.False(t, cordoned)
+
+	assert.NoError(t, uncordonNode(fakeClient, node))
+	freshNode, _ = fakeClient.CoreV1().Nodes().Get("node1", metav1.GetOptions{})
+	assert.False(t, freshNode.Spec.Unschedulable)
+
+	_, err = cordonNode(fake.NewSimpleClientset(), node)
+	assert.Error(t, err)
+}
+
+func TestCordonEmptyNode(t *testing.T) {
+	node := createTestNode("node1", 2000)
+	fakeClient := fake.NewSimpleClientset(node)
+	recorder := kube_record.NewFakeRecorder(10)
+
+	assert.NoError(t, cordonEmptyNode(fakeClient, recorder, node))
+	freshNode, _ := fakeClient.CoreV1().Nodes().Get("node1", metav1.GetOptions{})
+	assert.True(t, freshNode.Spec.Unschedulable, "expected the node to be left cordoned")
+	assert.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "ReschedulerCordonedEmpty")
+
+	// The event is only emitted the first time
+	assert.NoError(t, cordonEmptyNode(fakeClient, recorder, node))
+	assert.Len(t, recorder.Events, 0)
+
+	assert.Error(t, cordonEmptyNode(fake.NewSimpleClientset(), recorder, node))
+	assert.Contains(t, <-recorder.Events, "ReschedulerFailed")
+}
+
+func TestDrainNodeGone(t *testing.T) {
+	node := createTestNode("node1", 2000)
+	pods := []*apiv1.Pod{createTestPod("pod1", 100)}
+	recorder := kube_record.NewFakeRecorder(100)
+
+	// Nodes removed before they are cordoned are skipped
+	err := drainNode(fake.NewSimpleClientset(), recorder, node, pods, 30, -1, time.Second, time.Millisecond, nil)
+	_, gone := err.(*nodeGoneError)
+	assert.True(t, gone, "expected the drain to be skipped, got %v", err)
+
+	// As are nodes removed once the drain has started
+	fakeClient := fake.NewSimpleClientset(node)
+	gets := 0
+	fakeClient.PrependReactor("get", "nodes", func(action core.Action) (bool, runtime.Object, error) {
+		gets++
+		if gets > 1 {
+			return true, nil, errors.NewNotFound(schema.GroupResource{Resource: "nodes"}, node.Name)
+		}
+		return false, nil, nil
+	})
+	err = drainNode(fakeClient, recorder, node, pods, 30, -1, time.Second, time.Millisecond, nil)
+	_, gone = err.(*nodeGoneError)
+	assert.True(t, gone, "expected the drain to be skipped, got %v", err)
+}
+
+func TestSortByDrainOrder(t *testing.T) {
+	// small has less CPU requested, but a larger fraction of its capacity
+	small := createTestNodeInfo(createTestNode("small", 1000), []*apiv1.Pod{createTestPod("p1", 600)}, 600)
+	small.Node.CreationTimestamp = metav1.NewTime(time.Now())
+	large := createTestNodeInfo(createTestNode("large", 4000), []*apiv1.Pod{createTestPod("p2", 1000)}, 1000)
+	large.Node.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Hour))
+	nodeInfos := nodes.NodeInfoArray{small, large}
+
+	sorted := sortByDrainOrder(nodeInfos, drainOrderLeastUtilized)
+	assert.Equal(t, "large", sorted[0].Node.Name)
+	assert.Equal(t, "small", nodeInfos[0].Node.Name, "expected the nodes not to be modified")
+
+	sorted = sortByDrainOrder(sorted, drainOrderMostUtilized)
+	assert.Equal(t, "small", sorted[0].Node.Name)
+
+	sorted = sortByDrainOrder(nodeInfos, drainOrderOldest)
+	assert.Equal(t, "large", sorted[0].Node.Name)
+
+	// Pods without requests count towards utilization with the default requests
+	empty := createTestNodeInfo(createTestNode("empty", 1000), []*apiv1.Pod{createTestPod("p3", 0)}, 0)
+	empty.Pods[0].Spec.Containers[0].Resources.Requests = nil
+	sorted = sortByDrainOrder(nodes.NodeInfoArray{empty, large}, drainOrderLeastUtilized)
+	assert.Equal(t, "empty", sorted[0].Node.Name)
+
+	var err error
+	defaultPodRequests, err = parseDefaultPodRequests("500m", "0")
+	assert.NoError(t, err)
+	defer func() { defaultPodRequests = apiv1.ResourceList{} }()
+	sorted = sortByDrainOrder(nodes.NodeInfoArray{empty, large}, drainOrderLeastUtilized)
+	assert.Equal(t, "large", sorted[0].Node.Name)
+
+	assert.NoError(t, validateDrainOrder(drainOrderOldest))
+	assert.Error(t, validateDrainOrder("newest"))
+}
+
+func TestCountNonEmptyNodes(t *testing.T) {
+	controller := true
+	daemonSetPod := createTestPod("ds", 100)
+	daemonSetPod.OwnerReferences = []metav1.OwnerReference{
+		{APIVersion: "apps/v1", Kind: "DaemonSet", Name: "ds", Controller: &controller},
+	}
+	replicatedPod := createTestPod("web", 100)
+	replicatedPod.OwnerReferences = []metav1.OwnerReference{
+		{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "web", Controller: &controller},
+	}
+
+	nodeInfos := nodes.NodeInfoArray{
+		createTestNodeInfo(createTestNode("empty", 2000), []*apiv1.Pod{}, 0),
+		createTestNodeInfo(createTestNode("daemonset", 2000), []*apiv1.Pod{daemonSetPod}, 100),
+		createTestNodeInfo(createTestNode("busy", 2000), []*apiv1.Pod{replicatedPod}, 100),
+	}
+	assert.Equal(t, 1, countNonEmptyNodes(nodeInfos, []*policyv1.PodDisruptionBudget{}))
+}
+
+func TestPriceMap(t *testing.T) {
+	prices, err := parsePriceMap("m5.large=0.096, spot:m5.large=0.029,c5.xlarge=0.17")
+	assert.NoError(t, err)
+
+	saving, ok := prices.hourlySaving("m5.large")
+	assert.True(t, ok)
+	assert.InDelta(t, 0.067, saving, 0.0001)
+
+	// Without a spot price the whole on-demand price is saved
+	saving, ok = prices.hourlySaving("c5.xlarge")
+	assert.True(t, ok)
+	assert.InDelta(t, 0.17, saving, 0.0001)
+
+	_, ok = prices.hourlySaving("r5.large")
+	assert.False(t, ok)
+	_, ok = priceMap{}.hourlySaving("m5.large")
+	assert.False(t, ok)
+
+	_, err = parsePriceMap("m5.large")
+	assert.Error(t, err)
+	_, err = parsePriceMap("m5.large=cheap")
+	assert.Error(t, err)
+}
+
+func TestDrainBackoff(t *testing.T) {
+	assert.Equal(t, 10*time.Minute, drainBackoff(1, 10*time.Minute, time.Hour))
+	assert.Equal(t, 20*time.Minute, drainBackoff(2, 10*time.Minute, time.Hour))
+	assert.Equal(t, 40*time.Minute, drainBackoff(3, 10*time.Minute, time.Hour))
+	assert.Equal(t, time.Hour, drainBackoff(4, 10*time.Minute, time.Hour))
+	assert.Equal(t, time.Hour, drainBackoff(100, 10*time.Minute, time.Hour))
+}
+
+func TestGlobalPlanner(t *testing.T) {
+	predicateChecker := simulator.NewTestPredicateChecker()
+
+	spotNodeInfos := []*nodes.NodeInfo{createTestNodeInfo(createTestNode("spot", 1000), []*apiv1.Pod{}, 0)}
+	planner := newGlobalPlanner(predicateChecker, spotNodeInfos)
+
+	pod1 := createTestPod("p1", 600)
+	plan, err := planner.plan(context.Background(), createTestNodeInfo(createTestNode("node1", 2000), []*apiv1.Pod{pod1}, 600), []*apiv1.Pod{pod1})
+	assert.NoError(t, err)
+	assert.Equal(t, "spot", plan.targets[pod1].Node.Name)
+	assert.Equal(t, 0, len(spotNodeInfos[0].Pods), "expected the cycle's spot nodes not to be modified")
+
+	// Plans which aren't kept don't take capacity from other candidates
+	pod2 := createTestPod("p2", 600)
+	other, err := planner.plan(context.Background(), createTestNodeInfo(createTestNode("node2", 2000), []*apiv1.Pod{pod2}, 600), []*apiv1.Pod{pod2})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(other.spotNodeInfos[0].Pods), "expected node1's plan not to be in node2's")
+
+	// The pods assigned from node1 leave no room for node2 once it has been
+	// drained, even though it would fit on its own
+	planner.keep(plan)
+	_, err = planner.plan(context.Background(), createTestNodeInfo(createTestNode("node2", 2000), []*apiv1.Pod{pod2}, 600), []*apiv1.Pod{pod2})
+	assert.Error(t, err)
+	_, err = buildDrainPlan(context.Background(), predicateChecker, createTestNodeInfo(createTestNode("node2", 2000), []*apiv1.Pod{pod2}, 600), spotNodeInfos, []*apiv1.Pod{pod2})
+	assert.NoError(t, err)
+
+	// A node which can't be fully drained leaves the model as it was
+	pod3 := createTestPod("p3", 300)
+	pod4 := createTestPod("p4", 300)
+	_, err = planner.plan(context.Background(), createTestNodeInfo(createTestNode("node3", 2000), []*apiv1.Pod{pod3, pod4}, 600), []*apiv1.Pod{pod3, pod4})
+	assert.Error(t, err)
+	pod5 := createTestPod("p5", 400)
+	plan, err = planner.plan(context.Background(), createTestNodeInfo(createTestNode("node4", 2000), []*apiv1.Pod{pod5}, 400), []*apiv1.Pod{pod5})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(plan.spotNodeInfos[0].Pods))
+}
+
+// recordingPublisher records events and blocks until released.
+type recordingPublisher struct {
+	release chan struct{}
+	events  chan drainEvent
+}
+
+func (p *recordingPublisher) Publish(event drainEvent) error {
+	<-p.release
+	p.events <- event
+	return nil
+}
+
+func TestAsyncPublisher(t *testing.T) {
+	next := &recordingPublisher{release: make(chan struct{}), events: make(chan drainEvent, 10)}
+	pub := newAsyncPublisher(next, 1)
+
+	plan := &drainPlan{
+		node:    createTestNodeInfo(createTestNode("node1", 2000), []*apiv1.Pod{}, 0),
+		targets: map[*apiv1.Pod]*nodes.NodeInfo{},
+	}
+	// The first event is being published, the second is buffered and the
+	// third is dropped, without blocking
+	assert.NoError(t, pub.Publish(newDrainEvent(plan, nil, time.Now())))
+	for len(pub.events) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.NoError(t, pub.Publish(newDrainEvent(plan, nil, time.Now())))
+	assert.Error(t, pub.Publish(newDrainEvent(plan, fmt.Errorf("boom"), time.Now())))
+
+	close(next.release)
+	for i := 0; i < 2; i++ {
+		event := <-next.events
+		assert.Equal(t, "node1", event.Node)
+		assert.Equal(t, drainOutcomeSuccess, event.Outcome)
+	}
+
+	event := newDrainEvent(plan, fmt.Errorf("boom"), time.Now())
+	assert.Equal(t, drainOutcomeFailure, event.Outcome)
+	assert.Equal(t, "boom", event.Error)
+}
+
+func TestSlackPublisher(t *testing.T) {
+	messages := make(chan slackMessage, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var message slackMessage
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&message))
+		messages <- message
+	}))
+	defer server.Close()
+
+	event := drainEvent{
+		Node:    "node1",
+		Pods:    map[string]string{"default/p1": "spot2", "default/p2": "spot1", "default/p3": "spot1"},
+		Outcome: drainOutcomeSuccess,
+	}
+	assert.NoError(t, newSlackPublisher(server.URL).Publish(event))
+	message := <-messages
+	assert.Contains(t, message.Text, "node1")
+	assert.Equal(t, slackColorSuccess, message.Attachments[0].Color)
+	assert.Contains(t, message.Attachments[0].Text, "Pods: 3")
+	assert.Contains(t, message.Attachments[0].Text, "spot1, spot2")
+
+	event.Outcome = drainOutcomeFailure
+	event.Error = "boom"
+	message = newSlackMessage(event)
+	assert.Equal(t, slackColorFailure, message.Attachments[0].Color)
+	assert.Contains(t, message.Attachments[0].Text, "boom")
+}
+
+func TestHealthzHandler(t *testing.T) {
+	health := &loopHealth{}
+	handler := newHealthzHandler(health, time.Minute)
+	check := func() int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, check(), "expected a loop which hasn't started to be healthy")
+
+	health.beat(time.Now())
+	assert.Equal(t, http.StatusOK, check())
+
+	health.beat(time.Now().Add(-2 * time.Minute))
+	assert.Equal(t, http.StatusInternalServerError, check())
+
+	// A long drain isn't a wedged loop
+	health.busy(time.Now().Add(time.Minute))
+	assert.Equal(t, http.StatusOK, check())
+	health.busy(time.Time{})
+	assert.Equal(t, http.StatusInternalServerError, check())
+}
+
+func TestDrainDuration(t *testing.T) {
+	perPod := *podEvictionTimeout + *maxGracefulTermination + scaler.MaxPreStopGracePeriod
+	assert.Equal(t, perPod+scaler.ReplacementReadyTimeout, drainDuration(3), "expected pods to be evicted at once")
+
+	scaler.DrainConcurrency = 2
+	assert.Equal(t, 2*perPod+scaler.ReplacementReadyTimeout, drainDuration(3))
+	scaler.DrainConcurrency = 0
+
+	// Pods evicted in priority order are evicted one at a time, so the loop is
+	// busy until the last of them has had its full timeout
+	*respectPodPriority = true
+	defer func() { *respectPodPriority = false }()
+	assert.Equal(t, 3*perPod+scaler.ReplacementReadyTimeout, drainDuration(3))
+
+	h := &loopHealth{}
+	now := time.Now()
+	h.beat(now)
+	h.busy(now.Add(drainDuration(3)))
+	healthy, _ := h.healthy(now.Add(5*perPod/2), time.Minute)
+	assert.True(t, healthy, "expected the loop to be busy while the third pod is evicted")
+}
+
+func TestPlanHandler(t *testing.T) {
+	pod := createTestPod("pod1", 100)
+	plan := &drainPlan{
+		node:    createTestNodeInfo(createTestNode("node1", 2000), []*apiv1.Pod{pod}, 100),
+		pods:    []*apiv1.Pod{pod},
+		targets: map[*apiv1.Pod]*nodes.NodeInfo{pod: createTestNodeInfo(createTestNode("node2", 2000), []*apiv1.Pod{}, 0)},
+	}
+	l := &latestPlan{}
+	handler := newPlanHandler(l)
+	get := func() planView {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/plan", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var view planView
+		assert.NoError(t, json.NewDecoder(rec.Body).Decode(&view))
+		return view
+	}
+
+	now := time.Now().Round(time.Second)
+	l.record(plan, now)
+	view := get()
+	assert.Equal(t, "node1", view.Node)
+	assert.Equal(t, map[string]string{"kube-system/pod1": "node2"}, view.Pods)
+	assert.True(t, now.Equal(view.Time))
+
+	l.record(nil, now)
+	view = get()
+	assert.Equal(t, "", view.Node)
+	assert.Empty(t, view.Pods)
+}
+
+func TestVersionHandler(t *testing.T) {
+	VERSION, gitCommit, buildDate = "v1.0.0", "abc123", "2017-10-14T12:00:00Z"
+	defer func() { VERSION, gitCommit, buildDate = "undefined", "undefined", "undefined" }()
+
+	rec := httptest.NewRecorder()
+	newVersionHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/version", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var info versionInfo
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &info))
+	assert.Equal(t, versionInfo{Version: "v1.0.0", GitCommit: "abc123", BuildDate: "2017-10-14T12:00:00Z"}, info)
+}
+
+func TestReadyzHandler(t *testing.T) {
+	r := &readiness{}
+	handler := newReadyzHandler(r)
+	check := func() int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusServiceUnavailable, check(), "expected not to be ready before listing")
+	r.record(fmt.Errorf("boom"))
+	assert.Equal(t, http.StatusServiceUnavailable, check())
+
+	r.record(nil)
+	assert.Equal(t, http.StatusOK, check())
+	for i := 0; i < readyFailureThreshold-1; i++ {
+		r.record(fmt.Errorf("boom"))
+	}
+	assert.Equal(t, http.StatusOK, check(), "expected occasional failures to be tolerated")
+	r.record(fmt.Errorf("boom"))
+	assert.Equal(t, http.StatusServiceUnavailable, check())
+
+	r.record(nil)
+	assert.Equal(t, http.StatusOK, check())
+}
+
+func TestTLSConfig(t *testing.T) {
+	assert.NoError(t, validateTLSFlags("", "", ""))
+	assert.NoError(t, validateTLSFlags("tls.crt", "tls.key", "ca.crt"))
+	assert.Error(t, validateTLSFlags("tls.crt", "", ""))
+	assert.Error(t, validateTLSFlags("", "", "ca.crt"))
+
+	config, err := newTLSConfig("")
 	assert.NoError(t, err)
+	assert.Equal(t, tls.NoClientCert, config.ClientAuth)
+	_, err = newTLSConfig("/does/not/exist")
+	assert.Error(t, err)
 
-	onDemandLabel = "foo.bar/broken=worker=true"
-	err = validateArgs(onDemandLabel, spotLabel)
-	assert.EqualError(t, err, "the on demand node label is not correctly formatted: expected '<label_name>' or '<label_name>=<label_value>', but got foo.bar/broken=worker=true")
+	handler := requireClientCert(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
 
-	onDemandLabel = "foo.bar/role=worker"
-	spotLabel = "foo.bar/node-role=spot=fail"
-	err = validateArgs(onDemandLabel, spotLabel)
-	assert.EqualError(t, err, "the spot node label is not correctly formatted: expected '<label_name>' or '<label_name>=<label_value>', but got foo.bar/node-role=spot=fail")
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{&x509.Certificate{}}}}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestSelectDrainPlan(t *testing.T) {
+	plan1 := &drainPlan{
+		node: createTestNodeInfo(createTestNode("node1", 2000), nil, 0),
+		pods: []*apiv1.Pod{createTestPod("pod1", 100), createTestPod("pod2", 100)},
+	}
+	plan2 := &drainPlan{
+		node: createTestNodeInfo(createTestNode("node2", 2000), nil, 0),
+		pods: []*apiv1.Pod{createTestPod("pod3", 100)},
+	}
+	plan3 := &drainPlan{
+		node: createTestNodeInfo(createTestNode("node3", 4000), nil, 0),
+		pods: []*apiv1.Pod{createTestPod("pod4", 100)},
+	}
+	plans := []*drainPlan{plan1, plan2, plan3}
+
+	*drainSelection = drainSelectionFirst
+	assert.Equal(t, plan1, selectDrainPlan(plans))
+
+	// Fewest pods wins, ties are broken by the most allocatable CPU
+	*drainSelection = drainSelectionBest
+	assert.Equal(t, plan3, selectDrainPlan(plans))
 
+	assert.Nil(t, selectDrainPlan([]*drainPlan{}))
+	*drainSelection = drainSelectionFirst
 }
 
-func TestCanDrainNode(t *testing.T) {
-	predicateChecker := simulator.NewTestPredicateChecker()
+func TestSortByNodeGroup(t *testing.T) {
+	newNode := func(name string, group string, pods int) *nodes.NodeInfo {
+		node := createTestNode(name, 2000)
+		node.Labels = map[string]string{"node-group": group}
+		podList := make([]*apiv1.Pod, 0, pods)
+		for i := 0; i < pods; i++ {
+			podList = append(podList, createTestPod(fmt.Sprintf("%s-pod%d", name, i), 100))
+		}
+		return createTestNodeInfo(node, podList, int64(pods*100))
+	}
 
-	pods1 := []*apiv1.Pod{
-		createTestPod("p1n1", 100),
-		createTestPod("p2n1", 300),
+	// The dense node is alone in its group, the small group holds fewer pods
+	nodeInfos := nodes.NodeInfoArray{
+		newNode("dense", "a", 4),
+		newNode("small1", "b", 1),
+		newNode("small2", "b", 1),
 	}
-	pods2 := []*apiv1.Pod{
-		createTestPod("p1n2", 500),
-		createTestPod("p2n2", 300),
+	groupPods := map[string]int{"group/a": 4, "group/b": 2}
+
+	sorted := sortByNodeGroup(nodeInfos, groupPods, "node-group")
+	assert.Equal(t, "small1", sorted[0].Node.Name)
+	assert.Equal(t, "small2", sorted[1].Node.Name)
+	assert.Equal(t, "dense", sorted[2].Node.Name)
+	assert.Equal(t, "dense", nodeInfos[0].Node.Name, "expected the original order to be kept")
+
+	// Plans in emptier groups win even when they move more pods
+	dense := &drainPlan{node: nodeInfos[0], pods: nodeInfos[0].Pods[:1], groupPods: 4}
+	small := &drainPlan{node: nodeInfos[1], pods: nodeInfos[1].Pods, groupPods: 2}
+	assert.True(t, small.betterThan(dense))
+
+	assert.Equal(t, "node/lonely", nodeGroup(createTestNode("lonely", 2000), "node-group"))
+}
+
+func TestQoS(t *testing.T) {
+	guaranteed := createTestPod("guaranteed", 100)
+	guaranteed.Spec.Containers[0].Resources.Requests[apiv1.ResourceMemory] = *resource.NewQuantity(1024, resource.DecimalSI)
+	guaranteed.Spec.Containers[0].Resources.Limits = guaranteed.Spec.Containers[0].Resources.Requests
+	burstable := createTestPod("burstable", 100)
+	bestEffort := createTestPod("besteffort", 0)
+	bestEffort.Spec.Containers[0].Resources.Requests = nil
+
+	assert.NoError(t, checkQoS([]*apiv1.Pod{guaranteed}), "expected all pods to be movable by default")
+
+	*protectGuaranteedPods = true
+	assert.Error(t, checkQoS([]*apiv1.Pod{burstable, guaranteed}))
+	assert.NoError(t, checkQoS([]*apiv1.Pod{burstable, bestEffort}))
+	*protectGuaranteedPods = false
+
+	nodeInfos := nodes.NodeInfoArray{
+		createTestNodeInfo(createTestNode("node1", 2000), []*apiv1.Pod{burstable, bestEffort}, 100),
+		createTestNodeInfo(createTestNode("node2", 2000), []*apiv1.Pod{bestEffort, bestEffort}, 0),
 	}
-	pods3 := []*apiv1.Pod{
-		createTestPod("p1n3", 500),
-		createTestPod("p2n3", 500),
-		createTestPod("p3n3", 300),
+	sorted := sortByBestEffort(nodeInfos)
+	assert.Equal(t, "node2", sorted[0].Node.Name)
+	assert.Equal(t, "node1", sorted[1].Node.Name)
+}
+
+func TestCheckOwners(t *testing.T) {
+	controller := true
+	newPod := func(name string, apiVersion string, kind string) *apiv1.Pod {
+		pod := createTestPod(name, 100)
+		pod.OwnerReferences = []metav1.OwnerReference{
+			{APIVersion: apiVersion, Kind: kind, Name: name + "-owner", Controller: &controller},
+		}
+		return pod
 	}
+	database := newPod("db-0", "databases.example.com/v1alpha1", "PostgresCluster")
+	web := newPod("web-0", "apps/v1", "ReplicaSet")
 
-	spotNodeInfos := []*nodes.NodeInfo{
-		createTestNodeInfo(createTestNode("node3", 2000), pods3, 1300),
-		createTestNodeInfo(createTestNode("node2", 1100), pods2, 800),
-		createTestNodeInfo(createTestNode("node1", 500), pods1, 400),
+	assert.NoError(t, checkOwners([]*apiv1.Pod{database, web}), "expected no owners to be skipped by default")
+
+	var err error
+	skippedOwners, err = parseOwnerKinds([]string{"databases.example.com/PostgresCluster"})
+	assert.NoError(t, err)
+	defer func() { skippedOwners = nil }()
+
+	assert.Error(t, checkOwners([]*apiv1.Pod{web, database}), "expected the custom resource's pod to be pinned")
+	assert.NoError(t, checkOwners([]*apiv1.Pod{web}))
+	assert.NoError(t, checkOwners([]*apiv1.Pod{newPod("db-1", "other.example.com/v1", "PostgresCluster")}), "expected the group to be matched")
+
+	skippedOwners, err = parseOwnerKinds([]string{"ReplicaSet"})
+	assert.NoError(t, err)
+	assert.Error(t, checkOwners([]*apiv1.Pod{web}), "expected a kind without a group to match any group")
+
+	_, err = parseOwnerKinds([]string{"a/b/c"})
+	assert.Error(t, err)
+}
+
+func TestCheckSafeToEvict(t *testing.T) {
+	plain := createTestPod("plain", 100)
+	safe := createTestPod("safe", 100)
+	safe.Annotations = map[string]string{"cluster-autoscaler.kubernetes.io/safe-to-evict": "true"}
+	unsafe := createTestPod("unsafe", 100)
+	unsafe.Annotations = map[string]string{"cluster-autoscaler.kubernetes.io/safe-to-evict": "false"}
+
+	assert.NoError(t, checkSafeToEvict([]*apiv1.Pod{plain, safe}))
+	err := checkSafeToEvict([]*apiv1.Pod{plain, unsafe})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unsafe")
 	}
+	assert.Error(t, checkPinnedPods([]*apiv1.Pod{unsafe}), "expected unsafe pods to be pinned")
+}
 
-	podsForDeletion1 := []*apiv1.Pod{
-		createTestPod("pod1", 500),
-		createTestPod("pod2", 300),
-		createTestPod("pod1", 100),
-		createTestPod("pod2", 100),
-		createTestPod("pod1", 100),
+func TestCheckNamespaces(t *testing.T) {
+	system := createTestPod("system", 100)
+	monitoring := createTestPod("prometheus", 100)
+	monitoring.Namespace = "monitoring"
+	pods := []*apiv1.Pod{system, monitoring}
+
+	assert.NoError(t, checkNamespaces(pods, nil, nil))
+	assert.NoError(t, checkNamespaces(pods, []string{"kube-system", "monitoring"}, nil))
+
+	err := checkNamespaces(pods, nil, []string{"monitoring"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "monitoring/prometheus")
 	}
-	podsForDeletion2 := []*apiv1.Pod{
-		createTestPod("pod1", 500),
-		createTestPod("pod2", 400),
-		createTestPod("pod1", 100),
-		createTestPod("pod2", 100),
-		createTestPod("pod1", 100),
+	err = checkNamespaces(pods, []string{"kube-system"}, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "monitoring/prometheus")
 	}
 
-	err1 := canDrainNode(predicateChecker, spotNodeInfos, podsForDeletion1)
-	if err1 != nil {
-		assert.Fail(t, "canDrainNode should be successful with podsForDeletion1", "%v", err1)
+	// Exclusions win over inclusions
+	assert.Error(t, checkNamespaces([]*apiv1.Pod{monitoring}, []string{"monitoring"}, []string{"monitoring"}))
+}
+
+func TestCheckProtectedPods(t *testing.T) {
+	plain := createTestPod("plain", 100)
+	protected := createTestPod("protected", 100)
+	protected.Labels = map[string]string{"tier": "critical"}
+	pods := []*apiv1.Pod{plain, protected}
+
+	assert.NoError(t, checkProtectedPods(pods, nil))
+
+	selector, err := parseSelector("tier in (critical)")
+	assert.NoError(t, err)
+	assert.NoError(t, checkProtectedPods([]*apiv1.Pod{plain}, selector))
+	err = checkProtectedPods(pods, selector)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "protected")
 	}
+}
 
-	err2 := canDrainNode(predicateChecker, spotNodeInfos, podsForDeletion2)
-	if err2 == nil {
-		assert.Fail(t, "canDrainNode should fail with podsForDeletion2, too much requested CPU.")
+func TestSortByPodPriority(t *testing.T) {
+	high, low := int32(1000), int32(-10)
+	critical := createTestPod("critical", 100)
+	critical.Spec.Priority = &high
+	batch := createTestPod("batch", 100)
+	batch.Spec.Priority = &low
+	plain := createTestPod("plain", 100)
+	pods := []*apiv1.Pod{critical, plain, batch}
+
+	sorted := sortByPodPriority(pods)
+	assert.Equal(t, []*apiv1.Pod{batch, plain, critical}, sorted)
+	assert.Equal(t, critical, pods[0], "expected the pods not to be modified")
+}
+
+func TestDrainNodePodPriorityOrder(t *testing.T) {
+	*respectPodPriority = true
+	defer func() { *respectPodPriority = false }()
+
+	high, low := int32(1000), int32(-10)
+	critical := createTestPod("critical", 100)
+	critical.Spec.Priority = &high
+	batch := createTestPod("batch", 100)
+	batch.Spec.Priority = &low
+	plain := createTestPod("plain", 100)
+
+	node := createTestNode("node1", 2000)
+	fakeClient := fake.NewSimpleClientset(node)
+	evicted := make([]string, 0)
+	fakeClient.PrependReactor("create", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		evicted = append(evicted, action.(core.CreateAction).GetObject().(*policyv1.Eviction).Name)
+		return true, nil, nil
+	})
+	// Evicted pods are gone straight away
+	fakeClient.PrependReactor("get", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.NewNotFound(schema.GroupResource{Resource: "pods"}, action.(core.GetAction).GetName())
+	})
+
+	// Pods are evicted in priority order even without a concurrency limit
+	err := drainNode(fakeClient, kube_record.NewFakeRecorder(100), node, []*apiv1.Pod{critical, plain, batch}, 30, -1, time.Second, time.Millisecond, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"batch", "plain", "critical"}, evicted)
+}
+
+func TestCheckLocalStorage(t *testing.T) {
+	plain := createTestPod("plain", 100)
+	cache := createTestPod("cache", 100)
+	cache.Spec.Volumes = []apiv1.Volume{
+		{Name: "scratch", VolumeSource: apiv1.VolumeSource{EmptyDir: &apiv1.EmptyDirVolumeSource{}}},
+	}
+
+	assert.NoError(t, checkLocalStorage([]*apiv1.Pod{plain}, false))
+	err := checkLocalStorage([]*apiv1.Pod{plain, cache}, false)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "cache")
+	}
+	assert.NoError(t, checkLocalStorage([]*apiv1.Pod{plain, cache}, true))
+}
+
+func TestCheckPVCs(t *testing.T) {
+	plain := createTestPod("plain", 100)
+	stateful := createTestPod("stateful", 100)
+	stateful.Spec.Volumes = []apiv1.Volume{
+		{Name: "config", VolumeSource: apiv1.VolumeSource{ConfigMap: &apiv1.ConfigMapVolumeSource{}}},
+		{Name: "data", VolumeSource: apiv1.VolumeSource{PersistentVolumeClaim: &apiv1.PersistentVolumeClaimVolumeSource{ClaimName: "data-0"}}},
+	}
+
+	assert.NoError(t, checkPVCs([]*apiv1.Pod{plain, stateful}, false))
+	assert.NoError(t, checkPVCs([]*apiv1.Pod{plain}, true))
+	err := checkPVCs([]*apiv1.Pod{plain, stateful}, true)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "data-0")
+	}
+}
+
+func TestCheckPodAge(t *testing.T) {
+	now := time.Now()
+
+	oldPod := createTestPod("old", 100)
+	oldPod.CreationTimestamp = metav1.NewTime(now.Add(-time.Hour))
+	startTime := metav1.NewTime(now.Add(-30 * time.Minute))
+	oldPod.Status.StartTime = &startTime
+
+	newPod := createTestPod("new", 100)
+	newPod.CreationTimestamp = metav1.NewTime(now.Add(-time.Minute))
+
+	assert.NoError(t, checkPodAge([]*apiv1.Pod{oldPod, newPod}, 0, now))
+	assert.NoError(t, checkPodAge([]*apiv1.Pod{oldPod}, 10*time.Minute, now))
+	assert.Error(t, checkPodAge([]*apiv1.Pod{oldPod, newPod}, 10*time.Minute, now), "expected the young pod to block the drain")
+	assert.Error(t, checkPodAge([]*apiv1.Pod{oldPod}, time.Hour, now), "expected the start time to be used over the creation time")
+}
+
+func TestCheckPDBs(t *testing.T) {
+	pod1 := createTestPod("pod1", 100)
+	pod1.Labels = map[string]string{"app": "foo", "tier": "web"}
+	pod2 := createTestPod("pod2", 100)
+	pod2.Labels = map[string]string{"app": "bar"}
+
+	allowing := createTestPDB("allowing", map[string]string{"app": "foo"}, 1)
+	blocking := createTestPDB("blocking", map[string]string{"tier": "web"}, 0)
+	unrelated := createTestPDB("unrelated", map[string]string{"app": "baz"}, 0)
+
+	err := checkPDBs([]*apiv1.Pod{pod1, pod2}, []*policyv1.PodDisruptionBudget{allowing, unrelated})
+	assert.NoError(t, err)
+
+	// pod1 is matched by both PDBs, the one allowing no disruptions must win
+	// regardless of the order the PDBs are listed in.
+	err = checkPDBs([]*apiv1.Pod{pod1, pod2}, []*policyv1.PodDisruptionBudget{allowing, blocking})
+	assert.EqualError(t, err, "pod kube-system/pod1 is protected by PDB kube-system/blocking which allows no disruptions")
+
+	err = checkPDBs([]*apiv1.Pod{pod1, pod2}, []*policyv1.PodDisruptionBudget{blocking, allowing})
+	assert.EqualError(t, err, "pod kube-system/pod1 is protected by PDB kube-system/blocking which allows no disruptions")
+}
+
+func TestNodeSetChanged(t *testing.T) {
+	node1 := createTestNode("node1", 2000)
+	node2 := createTestNode("node2", 2000)
+	node3 := createTestNode("node3", 2000)
+
+	known, changed := nodeSetChanged(nil, []*apiv1.Node{node1, node2})
+	assert.False(t, changed, "expected the first set of nodes not to be a change")
+
+	known, changed = nodeSetChanged(known, []*apiv1.Node{node2, node1})
+	assert.False(t, changed, "expected the same nodes in a different order not to be a change")
+
+	known, changed = nodeSetChanged(known, []*apiv1.Node{node1, node3})
+	assert.True(t, changed, "expected a replaced node to be a change")
+
+	_, changed = nodeSetChanged(known, []*apiv1.Node{node1})
+	assert.True(t, changed, "expected a removed node to be a change")
+}
+
+func TestMoveTracker(t *testing.T) {
+	controller := true
+	ownedPod := func(name string, uid types.UID) *apiv1.Pod {
+		pod := createTestPod(name, 100)
+		pod.OwnerReferences = []metav1.OwnerReference{
+			{Kind: "ReplicaSet", Name: string(uid), UID: uid, Controller: &controller},
+		}
+		return pod
+	}
+	pod1 := ownedPod("pod1", "app1")
+	pod2 := ownedPod("pod2", "app1")
+	pod3 := ownedPod("pod3", "app2")
+	orphan := createTestPod("orphan", 100)
+
+	tracker := newMoveTracker(time.Hour)
+	now := time.Now()
+
+	// Two pods from the same application count as a single move
+	tracker.record([]*apiv1.Pod{pod1, pod2, orphan}, now.Add(-90*time.Minute))
+	tracker.record([]*apiv1.Pod{pod1, pod2}, now.Add(-30*time.Minute))
+	tracker.record([]*apiv1.Pod{pod1, pod3}, now.Add(-10*time.Minute))
+
+	assert.Equal(t, 2, tracker.count("app1", now), "expected moves older than the window to be forgotten")
+	assert.Equal(t, 1, tracker.count("app2", now))
+
+	assert.Nil(t, tracker.limited([]*apiv1.Pod{pod1, pod3, orphan}, 3, now))
+	assert.Equal(t, pod1, tracker.limited([]*apiv1.Pod{orphan, pod3, pod1}, 2, now))
+	assert.Equal(t, pod3, tracker.limited([]*apiv1.Pod{pod3}, 1, now))
+}
+
+func TestRollingCounterForgetsOldKeys(t *testing.T) {
+	counter := newRollingCounter(time.Hour)
+	now := time.Now()
+
+	counter.add("zone-a", now.Add(-3*time.Hour))
+	counter.add("zone-b", now.Add(-2*time.Hour))
+	counter.add("zone-b", now.Add(-30*time.Minute))
+
+	// Keys which are never counted again are still forgotten
+	counter.add("zone-c", now)
+	assert.Len(t, counter.events, 2)
+	assert.NotContains(t, counter.events, "zone-a")
+	assert.Len(t, counter.events["zone-b"], 1)
+	assert.Equal(t, 1, counter.count("zone-c", now))
+}
+
+func TestForceDrainHandler(t *testing.T) {
+	requests := make(chan forceDrainRequest, 1)
+	handler := newForceDrainHandler("secret", requests)
+
+	serve := func(method string, url string, token string) int {
+		req := httptest.NewRequest(method, url, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusMethodNotAllowed, serve("GET", "/drain?node=node1", "secret"))
+	assert.Equal(t, http.StatusUnauthorized, serve("POST", "/drain?node=node1", ""))
+	assert.Equal(t, http.StatusUnauthorized, serve("POST", "/drain?node=node1", "wrong"))
+	assert.Equal(t, http.StatusBadRequest, serve("POST", "/drain", "secret"))
+
+	// Answer the requests as the main loop would
+	go func() {
+		req := <-requests
+		assert.Equal(t, "node1", req.node)
+		req.result <- fmt.Errorf("cannot drain")
+		req = <-requests
+		req.result <- nil
+	}()
+	assert.Equal(t, http.StatusConflict, serve("POST", "/drain?node=node1", "secret"))
+	assert.Equal(t, http.StatusAccepted, serve("POST", "/drain?node=node1", "secret"))
+}
+
+func TestDrainableChecks(t *testing.T) {
+	node := createTestNode("node1", 2000)
+	assert.NoError(t, checkNodeDrainable(node))
+
+	// Forced drains are refused for nodes the main loop skips
+	nodes.OnDemandNodeLabel = "kubernetes.io/role=worker"
+	node.Labels = map[string]string{"kubernetes.io/role": "worker"}
+	node.Annotations = map[string]string{nodes.DrainSkippedAnnotation: "true"}
+	_, err := planForceDrain(fake.NewSimpleClientset(node), nil, nil, nil, "node1")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), nodes.DrainSkippedAnnotation)
+	}
+
+	node.Annotations = map[string]string{nodes.ExcludeAnnotation: "true"}
+	err = checkNodeDrainable(node)
+	_, ok := err.(*skipError)
+	assert.True(t, ok, "expected an Event to be recorded for excluded nodes")
+
+	// As are pods the main loop leaves alone
+	protected := createTestPod("protected", 100)
+	protected.Labels = map[string]string{"tier": "critical"}
+	selector, err := parseSelector("tier in (critical)")
+	assert.NoError(t, err)
+	protectedPods = selector
+	defer func() { protectedPods = nil }()
+	assert.NoError(t, checkPodsDrainable(fake.NewSimpleClientset(), []*apiv1.Pod{createTestPod("plain", 100)}, nil, nil))
+	err = checkPodsDrainable(fake.NewSimpleClientset(), []*apiv1.Pod{protected}, nil, nil)
+	_, ok = err.(*skipError)
+	assert.True(t, ok, "expected protected pods to be refused, got %v", err)
+}
+
+func TestCheckNodeLabels(t *testing.T) {
+	nodes.OnDemandNodeLabel = "kubernetes.io/role=worker"
+	nodes.SpotNodeLabel = "kubernetes.io/role=spot-worker"
+	onDemandNode := createTestNode("on-demand", 2000)
+	onDemandNode.Labels = map[string]string{"kubernetes.io/role": "worker"}
+	spotNode := createTestNode("spot", 2000)
+	spotNode.Labels = map[string]string{"kubernetes.io/role": "spot-worker"}
+
+	assert.NoError(t, checkNodeLabels([]*apiv1.Node{onDemandNode, spotNode}))
+
+	err := checkNodeLabels([]*apiv1.Node{spotNode})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "--on-demand-node-label")
+	}
+	err = checkNodeLabels([]*apiv1.Node{onDemandNode, createTestNode("unlabelled", 2000)})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "--spot-node-label")
+	}
+}
+
+func TestDisablePredicates(t *testing.T) {
+	provider, err := factory.GetAlgorithmProvider(factory.DefaultProvider)
+	assert.NoError(t, err)
+	assert.True(t, provider.FitPredicateKeys.Has("MatchInterPodAffinity"))
+	defer factory.InsertPredicateKeyToAlgoProvider(factory.DefaultProvider, "MatchInterPodAffinity")
+
+	assert.NoError(t, disablePredicates(""))
+
+	// Nothing is disabled if any name is invalid
+	assert.Error(t, disablePredicates("MatchInterPodAffinity,NoSuchPredicate"))
+	assert.True(t, provider.FitPredicateKeys.Has("MatchInterPodAffinity"))
+
+	assert.NoError(t, disablePredicates(" MatchInterPodAffinity "))
+	assert.False(t, provider.FitPredicateKeys.Has("MatchInterPodAffinity"))
+	assert.True(t, provider.FitPredicateKeys.Has("GeneralPredicates"), "expected other predicates to be kept")
+
+	// Predicates which are no longer run can't be disabled
+	assert.Error(t, disablePredicates("MatchInterPodAffinity"))
+}
+
+func TestMinNodesEstimate(t *testing.T) {
+	nodeMap := nodes.Map{
+		nodes.OnDemand: {
+			createTestNodeInfo(createTestNode("node1", 4000), []*apiv1.Pod{}, 1500),
+			createTestNodeInfo(createTestNode("node2", 2000), []*apiv1.Pod{}, 1000),
+		},
+		nodes.Spot: {
+			createTestNodeInfo(createTestNode("node3", 2000), []*apiv1.Pod{}, 1600),
+		},
+	}
+	assert.Equal(t, 2, minNodesEstimate(nodeMap))
+
+	assert.Equal(t, 0, minNodesEstimate(nodes.Map{}))
+}
+
+func TestRecoverReconcile(t *testing.T) {
+	assert.NotPanics(t, func() {
+		defer recoverReconcile()
+		var nodeInfo *nodes.NodeInfo
+		_ = nodeInfo.Node.Name
+	})
+}
+
+func TestRunPreDrainHooks(t *testing.T) {
+	pod := createTestPod("pod1", 100)
+	plan := &drainPlan{
+		node:    createTestNodeInfo(createTestNode("node1", 2000), []*apiv1.Pod{pod}, 100),
+		pods:    []*apiv1.Pod{pod},
+		targets: map[*apiv1.Pod]*nodes.NodeInfo{pod: createTestNodeInfo(createTestNode("node2", 2000), []*apiv1.Pod{}, 0)},
+	}
+
+	status := http.StatusOK
+	var received preDrainHookRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	assert.NoError(t, runPreDrainHooks(plan, "", false, "", time.Second))
+
+	assert.NoError(t, runPreDrainHooks(plan, server.URL, false, "", time.Second))
+	assert.Equal(t, "node1", received.Node)
+	assert.Equal(t, map[string]string{"kube-system/pod1": "node2"}, received.Pods)
+
+	status = http.StatusForbidden
+	assert.Error(t, runPreDrainHooks(plan, server.URL, false, "", time.Second))
+
+	assert.NoError(t, runPreDrainHooks(plan, "", false, "true", time.Second))
+	assert.Error(t, runPreDrainHooks(plan, "", false, "false", time.Second))
+}
+
+func TestPreDrainHookRequireAllow(t *testing.T) {
+	pod := createTestPod("pod1", 100)
+	plan := &drainPlan{
+		node:    createTestNodeInfo(createTestNode("node1", 2000), []*apiv1.Pod{pod}, 100),
+		pods:    []*apiv1.Pod{pod},
+		targets: map[*apiv1.Pod]*nodes.NodeInfo{},
+	}
+
+	status := http.StatusOK
+	response := `{"allow": true}`
+	delay := time.Duration(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.WriteHeader(status)
+		w.Write([]byte(response))
+	}))
+	defer server.Close()
+
+	assert.NoError(t, runPreDrainHooks(plan, server.URL, true, "", time.Second))
+
+	response = `{"allow": false, "reason": "change freeze"}`
+	err := runPreDrainHooks(plan, server.URL, true, "", time.Second)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "change freeze")
 	}
+
+	// A 200 without an approval denies the drain, unless approval isn't required
+	response = `ok`
+	assert.Error(t, runPreDrainHooks(plan, server.URL, true, "", time.Second))
+	assert.NoError(t, runPreDrainHooks(plan, server.URL, false, "", time.Second))
+
+	status, response = http.StatusInternalServerError, `{"allow": true}`
+	assert.Error(t, runPreDrainHooks(plan, server.URL, true, "", time.Second))
+
+	status, delay = http.StatusOK, 200*time.Millisecond
+	assert.Error(t, runPreDrainHooks(plan, server.URL, true, "", 50*time.Millisecond))
+}
+
+func TestDedupLogger(t *testing.T) {
+	logger := newDedupLogger(time.Minute)
+	now := time.Now()
+
+	msg, ok := logger.filter("No pods on node1, skipping.", now)
+	assert.True(t, ok)
+	assert.Equal(t, "No pods on node1, skipping.", msg)
+
+	_, ok = logger.filter("No pods on node1, skipping.", now.Add(10*time.Second))
+	assert.False(t, ok, "expected a repeated message to be suppressed")
+	_, ok = logger.filter("No pods on node1, skipping.", now.Add(20*time.Second))
+	assert.False(t, ok)
+
+	_, ok = logger.filter("No pods on node2, skipping.", now.Add(20*time.Second))
+	assert.True(t, ok, "expected a different message to be logged")
+
+	msg, ok = logger.filter("No pods on node1, skipping.", now.Add(time.Minute))
+	assert.True(t, ok, "expected the message to be logged again after the window")
+	assert.Equal(t, "No pods on node1, skipping. (repeated 2 times)", msg)
+
+	_, ok = newDedupLogger(0).filter("No pods on node1, skipping.", now)
+	assert.True(t, ok)
+
+	// Messages logged before the logger is built aren't suppressed
+	var unset *dedupLogger
+	_, ok = unset.filter("No pods on node1, skipping.", now)
+	assert.True(t, ok)
+	_, ok = unset.filter("No pods on node1, skipping.", now)
+	assert.True(t, ok)
+}
+
+func TestJSONLogger(t *testing.T) {
+	var out bytes.Buffer
+	now := time.Date(2017, 10, 14, 12, 0, 0, 0, time.UTC)
+	logger := &jsonLogger{out: &out, now: func() time.Time { return now }}
+
+	logger.writeGlogLine("W1014 11:59:58.123456   12345 rescheduler.go:42] Failed to list PDBs")
+	logger.writeGlogLine("goroutine 1 [running]:")
+	logger.log("info", now, "Drain plan built", "node", "node1", "pods", 3, "error", fmt.Errorf("boom"))
+
+	lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+	assert.Equal(t, 3, len(lines))
+	var entry map[string]interface{}
+	assert.NoError(t, json.Unmarshal(lines[0], &entry))
+	assert.Equal(t, "warning", entry["level"])
+	assert.Equal(t, "2017-10-14T11:59:58.123456Z", entry["ts"])
+	assert.Equal(t, "Failed to list PDBs", entry["msg"])
+	assert.Equal(t, "rescheduler.go:42", entry["caller"])
+
+	// Lines without a header are logged as they are
+	entry = nil
+	assert.NoError(t, json.Unmarshal(lines[1], &entry))
+	assert.Equal(t, "info", entry["level"])
+	assert.Equal(t, "goroutine 1 [running]:", entry["msg"])
+
+	entry = nil
+	assert.NoError(t, json.Unmarshal(lines[2], &entry))
+	assert.Equal(t, "node1", entry["node"])
+	assert.Equal(t, float64(3), entry["pods"])
+	assert.Equal(t, "boom", entry["error"])
+
+	assert.Equal(t, `Cannot drain node node=node1 error="no space left"`, formatKeysAndValues("Cannot drain node", "node", "node1", "error", fmt.Errorf("no space left")))
+	assert.Error(t, validateLogFormat("yaml"))
+}
+
+func TestStatusReport(t *testing.T) {
+	report := &statusReport{onDemandNodes: 3, spotNodes: 5}
+	report.recordDrain(4, nil)
+	report.recordDrain(2, fmt.Errorf("eviction failed"))
+
+	now := time.Now()
+	var out bytes.Buffer
+	report.write(&out, now.Add(5*time.Minute), now)
+	assert.Equal(t, "Status: on-demand nodes: 3, spot nodes: 5, pods moved: 4, drains succeeded: 1, drains failed: 1, cooldown remaining: 5m0s\n", out.String())
+
+	out.Reset()
+	report.write(&out, now.Add(-time.Minute), now)
+	assert.Equal(t, "Status: on-demand nodes: 3, spot nodes: 5, pods moved: 0, drains succeeded: 0, drains failed: 0, cooldown remaining: 0s\n", out.String())
 }
 
 func createTestPod(name string, cpu int64) *apiv1.Pod {
@@ -191,3 +1820,119 @@ func createTestNodeInfo(node *apiv1.Node, pods []*apiv1.Pod, requests int64) *no
 	}
 	return nodeInfo
 }
+
+func createTestPDB(name string, selector map[string]string, disruptionsAllowed int32) *policyv1.PodDisruptionBudget {
+	return &policyv1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "kube-system",
+			Name:      name,
+		},
+		Spec: policyv1.PodDisruptionBudgetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: selector},
+		},
+		Status: policyv1.PodDisruptionBudgetStatus{
+			PodDisruptionsAllowed: disruptionsAllowed,
+		},
+	}
+}
+
+func TestActiveWindow(t *testing.T) {
+	at := func(value string) time.Time {
+		// 2024-01-01 is a Monday
+		now, err := time.Parse("2006-01-02 15:04", value)
+		assert.NoError(t, err)
+		return now
+	}
+
+	w, err := parseActiveWindow("", "UTC")
+	assert.NoError(t, err)
+	assert.Nil(t, w)
+
+	w, err = parseActiveWindow("09:00-17:00", "UTC")
+	assert.NoError(t, err)
+	assert.True(t, w.contains(at("2024-01-01 09:00")))
+	assert.True(t, w.contains(at("2024-01-06 16:59")))
+	assert.False(t, w.contains(at("2024-01-01 17:00")))
+	assert.False(t, w.contains(at("2024-01-01 08:59")))
+
+	// Windows past midnight belong to the day they start on
+	w, err = parseActiveWindow("Mon-Fri 22:00-02:00", "UTC")
+	assert.NoError(t, err)
+	assert.True(t, w.contains(at("2024-01-01 23:00")))
+	assert.True(t, w.contains(at("2024-01-06 01:00")), "expected Friday night to carry into Saturday")
+	assert.False(t, w.contains(at("2024-01-06 23:00")))
+	assert.False(t, w.contains(at("2024-01-01 01:00")), "expected Sunday night not to be in the window")
+
+	// Day ranges can wrap around the week
+	w, err = parseActiveWindow("sat-sun 10:00-12:00", "UTC")
+	assert.NoError(t, err)
+	assert.True(t, w.contains(at("2024-01-07 11:00")))
+	assert.False(t, w.contains(at("2024-01-01 11:00")))
+
+	w, err = parseActiveWindow("09:00-17:00", "America/New_York")
+	if err == nil {
+		assert.True(t, w.contains(at("2024-01-01 15:00")))
+		assert.False(t, w.contains(at("2024-01-01 09:00")))
+	}
+
+	for _, invalid := range []string{"9-5", "09:00", "09:00-09:00", "Funday 09:00-17:00", "Mon Tue 09:00-17:00", "25:00-26:00"} {
+		_, err = parseActiveWindow(invalid, "UTC")
+		assert.Error(t, err, "expected %q to be invalid", invalid)
+	}
+	_, err = parseActiveWindow("09:00-17:00", "Nowhere/Special")
+	assert.Error(t, err)
+}
+
+func TestCheckVolumeNodeAffinity(t *testing.T) {
+	pinnedTo := func(name string, hostname string) *apiv1.PersistentVolume {
+		return &apiv1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: apiv1.PersistentVolumeSpec{
+				PersistentVolumeSource: apiv1.PersistentVolumeSource{Local: &apiv1.LocalVolumeSource{Path: "/mnt/disks/ssd1"}},
+				NodeAffinity: &apiv1.VolumeNodeAffinity{
+					Required: &apiv1.NodeSelector{
+						NodeSelectorTerms: []apiv1.NodeSelectorTerm{{
+							MatchExpressions: []apiv1.NodeSelectorRequirement{
+								{Key: "kubernetes.io/hostname", Operator: apiv1.NodeSelectorOpIn, Values: []string{hostname}},
+							},
+						}},
+					},
+				},
+			},
+		}
+	}
+	claim := func(name string, volumeName string) *apiv1.PersistentVolumeClaim {
+		return &apiv1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: name},
+			Spec:       apiv1.PersistentVolumeClaimSpec{VolumeName: volumeName},
+		}
+	}
+	withClaim := func(pod *apiv1.Pod, claimName string) *apiv1.Pod {
+		pod.Spec.Volumes = []apiv1.Volume{{
+			Name:         "data",
+			VolumeSource: apiv1.VolumeSource{PersistentVolumeClaim: &apiv1.PersistentVolumeClaimVolumeSource{ClaimName: claimName}},
+		}}
+		return pod
+	}
+
+	fakeClient := fake.NewSimpleClientset(
+		pinnedTo("local-node1", "node1"), claim("local", "local-node1"),
+		pinnedTo("local-spot1", "spot1"), claim("movable", "local-spot1"),
+		claim("unbound", ""),
+	)
+	spot1 := createTestNode("spot1", 2000)
+	spot1.Labels = map[string]string{"kubernetes.io/hostname": "spot1"}
+	spotNodeInfos := nodes.NodeInfoArray{createTestNodeInfo(spot1, []*apiv1.Pod{}, 0)}
+
+	plain := createTestPod("plain", 100)
+	assert.NoError(t, checkVolumeNodeAffinity(fakeClient, []*apiv1.Pod{plain}, spotNodeInfos))
+	assert.NoError(t, checkVolumeNodeAffinity(fakeClient, []*apiv1.Pod{withClaim(createTestPod("p1", 100), "movable")}, spotNodeInfos))
+	assert.NoError(t, checkVolumeNodeAffinity(fakeClient, []*apiv1.Pod{withClaim(createTestPod("p2", 100), "unbound")}, spotNodeInfos))
+
+	err := checkVolumeNodeAffinity(fakeClient, []*apiv1.Pod{plain, withClaim(createTestPod("p3", 100), "local")}, spotNodeInfos)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "local-node1")
+	}
+
+	assert.Error(t, checkVolumeNodeAffinity(fakeClient, []*apiv1.Pod{withClaim(createTestPod("p4", 100), "missing")}, spotNodeInfos))
+}
@@ -18,7 +18,9 @@ limitations under the License.
 package scaler
 
 import (
+	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
@@ -27,7 +29,10 @@ import (
 	policyv1 "k8s.io/api/policy/v1beta1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/autoscaler/cluster-autoscaler/utils/deletetaint"
+	"k8s.io/client-go/discovery"
 	kube_client "k8s.io/client-go/kubernetes"
 	kube_record "k8s.io/client-go/tools/record"
 )
@@ -35,47 +40,293 @@ import (
 const (
 	// EvictionRetryTime is the time after CA retries failed pod eviction.
 	EvictionRetryTime = 10 * time.Second
+
+	// EvictionVersionV1 sends evictions with the policy/v1 API, served from
+	// Kubernetes 1.22.
+	EvictionVersionV1 = "v1"
+	// EvictionVersionV1beta1 sends evictions with the policy/v1beta1 API.
+	EvictionVersionV1beta1 = "v1beta1"
+
+	// DrainReasonTimeout is the reason for drains whose pods weren't evicted
+	// or gone in time.
+	DrainReasonTimeout = "timeout"
+	// DrainReasonPDB is the reason for drains whose evictions were refused by
+	// a PodDisruptionBudget.
+	DrainReasonPDB = "pdb"
+	// DrainReasonAPIError is the reason for drains which failed on any other
+	// API error.
+	DrainReasonAPIError = "api-error"
+	// DrainReasonNodeGone is the reason for drains of nodes which no longer exist.
+	DrainReasonNodeGone = "node-gone"
+	// DrainReasonPlacement is the reason for drains aborted because the
+	// remaining pods no longer fit elsewhere.
+	DrainReasonPlacement = "placement"
+)
+
+// DrainError is returned by DrainNode when a drain fails, classifying why.
+type DrainError struct {
+	Reason string
+	Err    error
+}
+
+func (e *DrainError) Error() string {
+	return e.Err.Error()
+}
+
+// DrainFailureReason returns one of the DrainReasons for an error returned by
+// a drain.
+func DrainFailureReason(err error) string {
+	if drainErr, ok := err.(*DrainError); ok {
+		return drainErr.Reason
+	}
+	if errors.IsNotFound(err) {
+		return DrainReasonNodeGone
+	}
+	return DrainReasonAPIError
+}
+
+// podEvictionError is returned when a pod couldn't be evicted in time, keeping
+// the last error from the API server.
+type podEvictionError struct {
+	pod  *apiv1.Pod
+	last error
+}
+
+func (e *podEvictionError) Error() string {
+	return fmt.Sprintf("Failed to evict pod %s/%s within allowed timeout (last error: %v)", e.pod.Namespace, e.pod.Name, e.last)
+}
+
+// Works out the reason for evictions failing, which is a PodDisruptionBudget
+// if any were refused by one.
+func evictionFailureReason(errs []error) string {
+	reason := DrainReasonAPIError
+	for _, err := range errs {
+		evictionErr, ok := err.(*podEvictionError)
+		if !ok {
+			continue
+		}
+		if errors.IsTooManyRequests(evictionErr.last) {
+			return DrainReasonPDB
+		}
+		if errors.IsTimeout(evictionErr.last) || errors.IsServerTimeout(evictionErr.last) {
+			reason = DrainReasonTimeout
+		}
+	}
+	return reason
+}
+
+// evictionResult is the outcome of evicting a pod.
+type evictionResult struct {
+	pod       *apiv1.Pod
+	startedAt time.Time
+	evictedAt time.Time
+	// gone is set if the pod had already gone, so wasn't evicted.
+	gone bool
+	err  error
+}
+
+// PlacementCheck is called during a drain with the pods still to be evicted,
+// and returns an error if they can no longer all be moved off the node.
+type PlacementCheck func(remaining []*apiv1.Pod) error
+
+var (
+	// MaxPreStopGracePeriod is the longest grace period given to pods with a
+	// PreStop hook that declare a termination grace period longer than the
+	// overridden grace period. Zero disables the extension.
+	MaxPreStopGracePeriod time.Duration
+
+	// MaxInflightEvictions is the most evictions that may be in progress at
+	// once across all drains. Zero means unlimited.
+	MaxInflightEvictions int
+
+	// maxEvictionBackoff is the longest wait between retries of an eviction
+	// refused because of a PodDisruptionBudget.
+	maxEvictionBackoff = 2 * time.Minute
+
+	// DrainConcurrency is the most evictions that may be in progress at once
+	// within a single drain. Zero means unlimited.
+	DrainConcurrency int
+
+	// ReplacementReadyTimeout is how long to wait at the end of a drain for the
+	// evicted pods' controllers to have Ready replacements before the node's
+	// taint is removed. Zero disables the wait.
+	ReplacementReadyTimeout time.Duration
+
+	// EvictionVersion is the policy API version evictions are sent with.
+	EvictionVersion = EvictionVersionV1beta1
+
+	inflightEvictions = newEvictionLimiter()
+
+	// replacementPollInterval is how often replacement pods are checked.
+	replacementPollInterval = 5 * time.Second
 )
 
+// evictionLimiter is a counting semaphore shared by all drains which limits
+// the number of evictions in progress at once.
+type evictionLimiter struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	inflight int
+}
+
+func newEvictionLimiter() *evictionLimiter {
+	l := &evictionLimiter{}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// Blocks until fewer than limit evictions are in progress, then takes a slot.
+func (l *evictionLimiter) acquire(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for limit > 0 && l.inflight >= limit {
+		l.cond.Wait()
+	}
+	l.inflight++
+	metrics.UpdateInflightEvictions(l.inflight)
+}
+
+// Gives a slot back and wakes any evictions waiting for one.
+func (l *evictionLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inflight--
+	metrics.UpdateInflightEvictions(l.inflight)
+	l.cond.Broadcast()
+}
+
 // Originally from https://github.com/kubernetes/autoscaler/blob/bf59e3daa5922c0e44027fa211948b50cb6b7a12/cluster-autoscaler/core/scale_down.go#L690-L723
+// A negative gracePeriodSec leaves the pod's own termination grace period in place.
+// Returns whether the pod had already gone, so wasn't evicted.
 func evictPod(podToEvict *apiv1.Pod, client kube_client.Interface, recorder kube_record.EventRecorder,
-	maxGracefulTerminationSec int, retryUntil time.Time, waitBetweenRetries time.Duration) error {
+	gracePeriodSec int, retryUntil time.Time, waitBetweenRetries time.Duration) (bool, error) {
+	inflightEvictions.acquire(MaxInflightEvictions)
+	defer inflightEvictions.release()
+
 	recorder.Eventf(podToEvict, apiv1.EventTypeNormal, "Rescheduler", "deleting pod from on-demand node")
-	maxGraceful64 := int64(maxGracefulTerminationSec)
+	deleteOptions := &metav1.DeleteOptions{}
+	if gracePeriodSec >= 0 {
+		gracePeriod64 := int64(gracePeriodSec)
+		deleteOptions.GracePeriodSeconds = &gracePeriod64
+	}
 	var lastError error
-	for first := true; first || time.Now().Before(retryUntil); time.Sleep(waitBetweenRetries) {
+	wait := waitBetweenRetries
+	for first := true; first || time.Now().Before(retryUntil); time.Sleep(wait) {
 		first = false
 		eviction := &policyv1.Eviction{
 			ObjectMeta: metav1.ObjectMeta{
 				Namespace: podToEvict.Namespace,
 				Name:      podToEvict.Name,
 			},
-			DeleteOptions: &metav1.DeleteOptions{
-				GracePeriodSeconds: &maxGraceful64,
-			},
+			DeleteOptions: deleteOptions,
 		}
-		lastError = client.Core().Pods(podToEvict.Namespace).Evict(eviction)
+		lastError = evict(client, eviction)
 		if lastError == nil {
-			return nil
+			return false, nil
+		}
+		// Pods removed since the drain was planned, such as those garbage
+		// collected from a deleted node, don't need evicting
+		if errors.IsNotFound(lastError) {
+			glog.V(2).Infof("Pod %s/%s no longer exists, skipping its eviction", podToEvict.Namespace, podToEvict.Name)
+			return true, nil
 		}
+		wait = evictionRetryWait(lastError, wait, waitBetweenRetries, retryUntil)
 	}
 	glog.Errorf("Failed to evict pod %s, error: %v", podToEvict.Name, lastError)
 	recorder.Eventf(podToEvict, apiv1.EventTypeWarning, "ReschedulerFailed", "failed to delete pod from on-demand node")
-	return fmt.Errorf("Failed to evict pod %s/%s within allowed timeout (last error: %v)", podToEvict.Namespace, podToEvict.Name, lastError)
+	return false, &podEvictionError{pod: podToEvict, last: lastError}
+}
+
+// Evicts the pod with the EvictionVersion of the policy API. The vendored
+// client only has the v1beta1 Eviction type, which has the same fields as the
+// v1 one, so v1 evictions are posted to the eviction subresource directly.
+func evict(client kube_client.Interface, eviction *policyv1.Eviction) error {
+	if EvictionVersion != EvictionVersionV1 {
+		return client.Core().Pods(eviction.Namespace).Evict(eviction)
+	}
+
+	eviction = eviction.DeepCopy()
+	eviction.APIVersion = "policy/v1"
+	eviction.Kind = "Eviction"
+	body, err := json.Marshal(eviction)
+	if err != nil {
+		return fmt.Errorf("failed to encode eviction of pod %s/%s: %v", eviction.Namespace, eviction.Name, err)
+	}
+	return client.CoreV1().RESTClient().Post().
+		Namespace(eviction.Namespace).
+		Resource("pods").
+		Name(eviction.Name).
+		SubResource("eviction").
+		SetHeader("Content-Type", "application/json").
+		Body(body).
+		Do().
+		Error()
+}
+
+// DetectEvictionVersion works out the policy API version the API server serves
+// evictions with, from the eviction subresource of pods. API servers which
+// don't report a version are assumed to serve v1beta1.
+func DetectEvictionVersion(client discovery.DiscoveryInterface) (string, error) {
+	resources, err := client.ServerResourcesForGroupVersion("v1")
+	if err != nil {
+		return "", fmt.Errorf("failed to discover the eviction API: %v", err)
+	}
+	for _, resource := range resources.APIResources {
+		if resource.Name == "pods/eviction" && resource.Group == "policy" && resource.Version == EvictionVersionV1 {
+			return EvictionVersionV1, nil
+		}
+	}
+	return EvictionVersionV1beta1, nil
+}
+
+// Works out how long to wait before retrying an eviction. The API server
+// refuses evictions which would violate a PodDisruptionBudget with 429 Too Many
+// Requests, so those are retried with an exponential backoff from
+// waitBetweenRetries up to maxEvictionBackoff, giving the budget time to
+// recover. Other errors are retried after waitBetweenRetries. The wait never
+// runs past retryUntil.
+func evictionRetryWait(err error, lastWait time.Duration, waitBetweenRetries time.Duration, retryUntil time.Time) time.Duration {
+	wait := waitBetweenRetries
+	if errors.IsTooManyRequests(err) {
+		glog.V(2).Infof("Eviction refused, retrying after backoff: %v", err)
+		wait = lastWait * 2
+		if wait < waitBetweenRetries {
+			wait = waitBetweenRetries
+		}
+		if wait > maxEvictionBackoff {
+			wait = maxEvictionBackoff
+		}
+	}
+	if remaining := time.Until(retryUntil); wait > remaining {
+		wait = remaining
+	}
+	if wait < 0 {
+		return 0
+	}
+	return wait
 }
 
 // DrainNode performs drain logic on the node. Marks the node as unschedulable and later removes all pods, giving
-// them up to MaxGracefulTerminationTime to finish.
+// them up to MaxGracefulTerminationTime to finish. Pods are evicted with overrideGracePeriodSec as their grace
+// period, or with their own termination grace period when it is negative.
+// If a PlacementCheck is given, pods are evicted one at a time and the check is run before each eviction after the
+// first, aborting the drain if the remaining pods no longer fit elsewhere.
 //
 // Originally from https://github.com/kubernetes/autoscaler/blob/bf59e3daa5922c0e44027fa211948b50cb6b7a12/cluster-autoscaler/core/scale_down.go#L725-L783
 func DrainNode(node *apiv1.Node, pods []*apiv1.Pod, client kube_client.Interface, recorder kube_record.EventRecorder,
-	maxGracefulTerminationSec int, maxPodEvictionTime time.Duration, waitBetweenRetries time.Duration) error {
+	maxGracefulTerminationSec int, overrideGracePeriodSec int, maxPodEvictionTime time.Duration, waitBetweenRetries time.Duration, check PlacementCheck) error {
 
 	drainSuccessful := false
 	toEvict := len(pods)
 	if err := deletetaint.MarkToBeDeleted(node, client); err != nil {
+		reason := DrainFailureReason(err)
+		// The error doesn't keep why the node couldn't be fetched, so check
+		// whether it has been removed
+		if _, getErr := client.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{}); errors.IsNotFound(getErr) {
+			reason = DrainReasonNodeGone
+		}
 		recorder.Eventf(node, apiv1.EventTypeWarning, "ReschedulerFailed", "failed to mark the node as draining/unschedulable: %v", err)
-		return err
+		return &DrainError{Reason: reason, Err: err}
 	}
 
 	// If we fail to evict all the pods from the node we want to remove delete taint
@@ -88,58 +339,348 @@ func DrainNode(node *apiv1.Node, pods []*apiv1.Pod, client kube_client.Interface
 
 	recorder.Eventf(node, apiv1.EventTypeNormal, "Rescheduler", "marked the node as draining/unschedulable")
 
-	retryUntil := time.Now().Add(maxPodEvictionTime)
-	confirmations := make(chan error, toEvict)
+	if check != nil {
+		if err := evictPodsSequentially(node, pods, client, recorder, maxGracefulTerminationSec, overrideGracePeriodSec, maxPodEvictionTime, waitBetweenRetries, check); err != nil {
+			return err
+		}
+		glog.V(4).Infof("All pods removed from %s", node.Name)
+		replacementsErr := waitForReplacements(node, pods, client, recorder)
+		// Let the defered function know there is no need for cleanup
+		drainSuccessful = true
+		recorder.Eventf(node, apiv1.EventTypeNormal, "Rescheduler", "marked the node as drained/schedulable")
+		deletetaint.CleanToBeDeleted(node, client)
+		return replacementsErr
+	}
+
+	// Pods given extra time for PreStop hooks need longer to be removed
+	var extraGrace time.Duration
+	confirmations := make(chan evictionResult, toEvict)
+	// Limits the evictions in progress for this drain when DrainConcurrency is set
+	var slots chan struct{}
+	if DrainConcurrency > 0 {
+		slots = make(chan struct{}, DrainConcurrency)
+	}
 	for _, pod := range pods {
-		go func(podToEvict *apiv1.Pod) {
-			confirmations <- evictPod(podToEvict, client, recorder, maxGracefulTerminationSec, retryUntil, waitBetweenRetries)
-		}(pod)
+		gracePeriodSec := podGracePeriod(pod, overrideGracePeriodSec)
+		terminationSec := podTerminationWait(pod, gracePeriodSec, maxGracefulTerminationSec)
+		if extra := time.Duration(terminationSec-maxGracefulTerminationSec) * time.Second; extra > extraGrace {
+			extraGrace = extra
+		}
+		// Slots are taken in turn so pods are evicted in the order given
+		if slots != nil {
+			slots <- struct{}{}
+		}
+		go func(podToEvict *apiv1.Pod, gracePeriodSec int) {
+			if slots != nil {
+				defer func() { <-slots }()
+			}
+			// Each pod gets the full maxPodEvictionTime from when its eviction starts
+			startedAt := time.Now()
+			gone, err := evictPod(podToEvict, client, recorder, gracePeriodSec, startedAt.Add(maxPodEvictionTime), waitBetweenRetries)
+			confirmations <- evictionResult{pod: podToEvict, startedAt: startedAt, evictedAt: time.Now(), gone: gone, err: err}
+		}(pod, gracePeriodSec)
 	}
 
 	evictionErrs := make([]error, 0)
+	evictedAt := make(map[*apiv1.Pod]time.Time, toEvict)
+	var lastStarted time.Time
 
 	for range pods {
 		select {
-		case err := <-confirmations:
-			if err != nil {
-				evictionErrs = append(evictionErrs, err)
-			} else {
+		case result := <-confirmations:
+			if result.startedAt.After(lastStarted) {
+				lastStarted = result.startedAt
+			}
+			if result.err != nil {
+				evictionErrs = append(evictionErrs, result.err)
+			} else if !result.gone {
+				evictedAt[result.pod] = result.evictedAt
 				metrics.UpdateEvictionsCount()
+				metrics.UpdatePodsMoved(node.Name)
 			}
-		case <-time.After(retryUntil.Sub(time.Now()) + 5*time.Second):
-			return fmt.Errorf("Failed to drain node %s/%s: timeout when waiting for creating evictions", node.Namespace, node.Name)
+		case <-time.After(maxPodEvictionTime + 5*time.Second):
+			return &DrainError{Reason: DrainReasonTimeout, Err: fmt.Errorf("Failed to drain node %s/%s: timeout when waiting for creating evictions", node.Namespace, node.Name)}
 		}
 	}
 	if len(evictionErrs) != 0 {
-		return fmt.Errorf("Failed to drain node %s/%s, due to following errors: %v", node.Namespace, node.Name, evictionErrs)
+		return &DrainError{Reason: evictionFailureReason(evictionErrs), Err: fmt.Errorf("Failed to drain node %s/%s, due to following errors: %v", node.Namespace, node.Name, utilerrors.NewAggregate(evictionErrs))}
 	}
 
 	// Evictions created successfully, wait for the remainder of maxPodEvictionTime to see if pods have been evicted
-	var allGone bool
-	for time.Now().Before(retryUntil.Add(5 * time.Second)) {
-		allGone = true
-		for _, pod := range pods {
+	if waitForPodsGone(node, pods, client, lastStarted.Add(maxPodEvictionTime+extraGrace+5*time.Second), evictedAt) {
+		glog.V(4).Infof("All pods removed from %s", node.Name)
+		replacementsErr := waitForReplacements(node, pods, client, recorder)
+		// Let the defered function know there is no need for cleanup
+		drainSuccessful = true
+		recorder.Eventf(node, apiv1.EventTypeNormal, "Rescheduler", "marked the node as drained/schedulable")
+		deletetaint.CleanToBeDeleted(node, client)
+		return replacementsErr
+	}
+	return &DrainError{Reason: DrainReasonTimeout, Err: fmt.Errorf("Failed to drain node %s/%s: pods remaining after timeout", node.Namespace, node.Name)}
+}
+
+// DeletePods deletes each of the pods once, without retrying or waiting for
+// them to go. This is used for pods, such as those controlled by a DaemonSet,
+// which would be recreated straight away and so can't be evicted.
+// Pods are given overrideGracePeriodSec to terminate, or their own termination grace period when it is negative.
+func DeletePods(pods []*apiv1.Pod, client kube_client.Interface, recorder kube_record.EventRecorder, overrideGracePeriodSec int) error {
+	deleteErrs := make([]error, 0)
+	for _, pod := range pods {
+		deleteOptions := &metav1.DeleteOptions{}
+		if gracePeriodSec := int64(podGracePeriod(pod, overrideGracePeriodSec)); gracePeriodSec >= 0 {
+			deleteOptions.GracePeriodSeconds = &gracePeriodSec
+		}
+		recorder.Eventf(pod, apiv1.EventTypeNormal, "Rescheduler", "deleting pod from drained on-demand node")
+		err := client.CoreV1().Pods(pod.Namespace).Delete(pod.Name, deleteOptions)
+		if err != nil && !errors.IsNotFound(err) {
+			deleteErrs = append(deleteErrs, fmt.Errorf("failed to delete pod %s/%s: %v", pod.Namespace, pod.Name, err))
+		}
+	}
+	if len(deleteErrs) != 0 {
+		return fmt.Errorf("%v", deleteErrs)
+	}
+	return nil
+}
+
+// Evicts the pods one at a time, waiting for each to be removed before running the placement check for the
+// pods that remain.
+func evictPodsSequentially(node *apiv1.Node, pods []*apiv1.Pod, client kube_client.Interface, recorder kube_record.EventRecorder,
+	maxGracefulTerminationSec int, overrideGracePeriodSec int, maxPodEvictionTime time.Duration, waitBetweenRetries time.Duration, check PlacementCheck) error {
+
+	for i, pod := range pods {
+		if i > 0 {
+			if err := check(pods[i:]); err != nil {
+				recorder.Eventf(node, apiv1.EventTypeWarning, "ReschedulerFailed", "remaining pods no longer fit on other nodes: %v", err)
+				return &DrainError{Reason: DrainReasonPlacement, Err: fmt.Errorf("Failed to drain node %s/%s: remaining pods can no longer be moved: %v", node.Namespace, node.Name, err)}
+			}
+		}
+
+		gracePeriodSec := podGracePeriod(pod, overrideGracePeriodSec)
+		retryUntil := time.Now().Add(maxPodEvictionTime)
+		gone, err := evictPod(pod, client, recorder, gracePeriodSec, retryUntil, waitBetweenRetries)
+		if err != nil {
+			return &DrainError{Reason: evictionFailureReason([]error{err}), Err: fmt.Errorf("Failed to drain node %s/%s, due to following errors: %v", node.Namespace, node.Name, err)}
+		}
+		if gone {
+			continue
+		}
+		metrics.UpdateEvictionsCount()
+		metrics.UpdatePodsMoved(node.Name)
+		evictedAt := map[*apiv1.Pod]time.Time{pod: time.Now()}
+
+		terminationSec := podTerminationWait(pod, gracePeriodSec, maxGracefulTerminationSec)
+		if !waitForPodsGone(node, []*apiv1.Pod{pod}, client, retryUntil.Add(time.Duration(terminationSec)*time.Second+5*time.Second), evictedAt) {
+			return &DrainError{Reason: DrainReasonTimeout, Err: fmt.Errorf("Failed to drain node %s/%s: pod %s/%s remaining after timeout", node.Namespace, node.Name, pod.Namespace, pod.Name)}
+		}
+	}
+	return nil
+}
+
+// Waits until none of the pods are running on the node, returning false if some remain at the deadline.
+// The time each pod took to go after being evicted is logged and recorded in the metrics system.
+func waitForPodsGone(node *apiv1.Node, pods []*apiv1.Pod, client kube_client.Interface, until time.Time, evictedAt map[*apiv1.Pod]time.Time) bool {
+	remaining := pods
+	for time.Now().Before(until) {
+		stillRunning := make([]*apiv1.Pod, 0, len(remaining))
+		for _, pod := range remaining {
 			podreturned, err := client.Core().Pods(pod.Namespace).Get(pod.Name, metav1.GetOptions{})
 			if err == nil && (podreturned != nil && podreturned.Spec.NodeName == node.Name) {
 				glog.Errorf("Not deleted yet %v", podreturned.Name)
-				allGone = false
-				break
+				stillRunning = append(stillRunning, pod)
+				continue
 			}
 			if err != nil && !errors.IsNotFound(err) {
 				glog.Errorf("Failed to check pod %s/%s: %v", pod.Namespace, pod.Name, err)
-				allGone = false
-				break
+				stillRunning = append(stillRunning, pod)
+				continue
 			}
+			recordPodGone(pod, evictedAt)
 		}
-		if allGone {
-			glog.V(4).Infof("All pods removed from %s", node.Name)
-			// Let the defered function know there is no need for cleanup
-			drainSuccessful = true
-			recorder.Eventf(node, apiv1.EventTypeNormal, "Rescheduler", "marked the node as drained/schedulable")
-			deletetaint.CleanToBeDeleted(node, client)
-			return nil
+		remaining = stillRunning
+		if len(remaining) == 0 {
+			return true
 		}
 		time.Sleep(5 * time.Second)
 	}
-	return fmt.Errorf("Failed to drain node %s/%s: pods remaining after timeout", node.Namespace, node.Name)
+	return false
+}
+
+// ReplacementsNotReadyError is returned by DrainNode when the node was drained
+// but the controllers of the evicted pods didn't have Ready replacements within
+// ReplacementReadyTimeout.
+type ReplacementsNotReadyError struct {
+	Node    string
+	Timeout time.Duration
+}
+
+func (e *ReplacementsNotReadyError) Error() string {
+	return fmt.Sprintf("replacements for pods evicted from %s were not all Ready within %s", e.Node, e.Timeout)
+}
+
+// Waits up to ReplacementReadyTimeout for the controllers of the evicted pods
+// to have Ready replacements, so the node isn't released while capacity is
+// still missing. The drain carries on if they aren't Ready in time, returning
+// a ReplacementsNotReadyError.
+func waitForReplacements(node *apiv1.Node, pods []*apiv1.Pod, client kube_client.Interface, recorder kube_record.EventRecorder) error {
+	if ReplacementReadyTimeout <= 0 {
+		return nil
+	}
+	if !waitForReplacementsReady(node, pods, client, time.Now().Add(ReplacementReadyTimeout)) {
+		glog.Warningf("Replacements for pods evicted from %s were not all Ready within %s", node.Name, ReplacementReadyTimeout)
+		recorder.Eventf(node, apiv1.EventTypeWarning, "ReschedulerFailed", "replacement pods were not all Ready within %s", ReplacementReadyTimeout)
+		return &ReplacementsNotReadyError{Node: node.Name, Timeout: ReplacementReadyTimeout}
+	}
+	return nil
+}
+
+// Waits until each controller owning the evicted pods has at least as many
+// Ready pods off the node, other than the evicted ones, as pods were evicted
+// from it. Pods without a controller have no replacement and are ignored.
+// Returns false if replacements are still missing at the deadline.
+func waitForReplacementsReady(node *apiv1.Node, pods []*apiv1.Pod, client kube_client.Interface, until time.Time) bool {
+	evicted := make(map[types.UID]bool, len(pods))
+	wanted := make(map[types.UID]int)
+	namespaces := make(map[types.UID]string)
+	for _, pod := range pods {
+		evicted[pod.UID] = true
+		if owner := metav1.GetControllerOf(pod); owner != nil {
+			wanted[owner.UID]++
+			namespaces[owner.UID] = pod.Namespace
+		}
+	}
+	if len(wanted) == 0 {
+		return true
+	}
+
+	for {
+		ready, err := countReadyReplacements(node, namespaces, evicted, client)
+		if err != nil {
+			glog.Errorf("Failed to check replacement pods for %s: %v", node.Name, err)
+		} else {
+			missing := 0
+			for owner, count := range wanted {
+				if ready[owner] < count {
+					missing += count - ready[owner]
+				}
+			}
+			if missing == 0 {
+				return true
+			}
+			glog.V(4).Infof("Waiting for %d replacement pods for %s to be Ready", missing, node.Name)
+		}
+		if !time.Now().Add(replacementPollInterval).Before(until) {
+			return false
+		}
+		time.Sleep(replacementPollInterval)
+	}
+}
+
+// Counts the Ready pods of each owner which aren't on the node and weren't evicted.
+func countReadyReplacements(node *apiv1.Node, namespaces map[types.UID]string, evicted map[types.UID]bool, client kube_client.Interface) (map[types.UID]int, error) {
+	listed := make(map[string]bool)
+	ready := make(map[types.UID]int)
+	for _, namespace := range namespaces {
+		if listed[namespace] {
+			continue
+		}
+		listed[namespace] = true
+
+		podList, err := client.CoreV1().Pods(namespace).List(metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for i := range podList.Items {
+			pod := &podList.Items[i]
+			controller := metav1.GetControllerOf(pod)
+			if controller == nil || namespaces[controller.UID] == "" || evicted[pod.UID] || pod.Spec.NodeName == node.Name {
+				continue
+			}
+			if isPodReady(pod) {
+				ready[controller.UID]++
+			}
+		}
+	}
+	return ready, nil
+}
+
+// Determines if the pod has the Ready condition.
+func isPodReady(pod *apiv1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == apiv1.PodReady {
+			return condition.Status == apiv1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// Logs and records how long the pod took to go after it was evicted.
+func recordPodGone(pod *apiv1.Pod, evictedAt map[*apiv1.Pod]time.Time) {
+	evicted, ok := evictedAt[pod]
+	if !ok {
+		return
+	}
+	duration := time.Since(evicted)
+	kind := ownerKind(pod)
+	glog.V(2).Infof("Pod %s/%s (%s) removed %s after eviction", pod.Namespace, pod.Name, kind, duration.Round(time.Second))
+	metrics.ObservePodEvictionDuration(kind, duration)
+}
+
+// Returns the kind of the pod's controller, or "None" if it has no controller.
+func ownerKind(pod *apiv1.Pod) string {
+	if owner := metav1.GetControllerOf(pod); owner != nil {
+		return owner.Kind
+	}
+	return "None"
+}
+
+// Works out the grace period to give a pod when evicting it, returning -1 to
+// leave the pod's own termination grace period in place when the grace period
+// isn't overridden.
+// Pods with a PreStop hook are given their own termination grace period, up to
+// MaxPreStopGracePeriod, when it is longer than the overridden grace period.
+func podGracePeriod(pod *apiv1.Pod, overrideGracePeriodSec int) int {
+	if overrideGracePeriodSec < 0 {
+		return -1
+	}
+	if MaxPreStopGracePeriod <= 0 || !hasPreStopHook(pod) || pod.Spec.TerminationGracePeriodSeconds == nil {
+		return overrideGracePeriodSec
+	}
+
+	gracePeriodSec := int(*pod.Spec.TerminationGracePeriodSeconds)
+	if capSec := int(MaxPreStopGracePeriod.Seconds()); gracePeriodSec > capSec {
+		gracePeriodSec = capSec
+	}
+	if gracePeriodSec <= overrideGracePeriodSec {
+		return overrideGracePeriodSec
+	}
+
+	glog.V(2).Infof("Extending grace period of pod %s/%s to %ds for its PreStop hook", pod.Namespace, pod.Name, gracePeriodSec)
+	return gracePeriodSec
+}
+
+// Works out how long to wait for a pod evicted with the given grace period to
+// terminate. Pods left with their own termination grace period are waited for
+// up to the max graceful termination.
+func podTerminationWait(pod *apiv1.Pod, gracePeriodSec int, maxGracefulTerminationSec int) int {
+	if gracePeriodSec >= 0 {
+		return gracePeriodSec
+	}
+	gracePeriodSec = apiv1.DefaultTerminationGracePeriodSeconds
+	if pod.Spec.TerminationGracePeriodSeconds != nil {
+		gracePeriodSec = int(*pod.Spec.TerminationGracePeriodSeconds)
+	}
+	if gracePeriodSec > maxGracefulTerminationSec {
+		return maxGracefulTerminationSec
+	}
+	return gracePeriodSec
+}
+
+// Determines if any of the containers in the pod have a PreStop hook
+func hasPreStopHook(pod *apiv1.Pod) bool {
+	for _, container := range pod.Spec.Containers {
+		if container.Lifecycle != nil && container.Lifecycle.PreStop != nil {
+			return true
+		}
+	}
+	return false
 }
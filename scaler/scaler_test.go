@@ -0,0 +1,455 @@
+/*
+Copyright 2017 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scaler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	kube_client "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	core "k8s.io/client-go/testing"
+	kube_record "k8s.io/client-go/tools/record"
+)
+
+func TestPodGracePeriod(t *testing.T) {
+	plainPod := createTestPod("plain", 300, false)
+	preStopPod := createTestPod("prestop", 300, true)
+	shortPreStopPod := createTestPod("short-prestop", 30, true)
+
+	MaxPreStopGracePeriod = 0
+	assert.Equal(t, 120, podGracePeriod(preStopPod, 120), "expected no extension when disabled")
+
+	MaxPreStopGracePeriod = 10 * time.Minute
+	assert.Equal(t, 120, podGracePeriod(plainPod, 120), "expected no extension without a PreStop hook")
+	assert.Equal(t, 300, podGracePeriod(preStopPod, 120), "expected the pod's own grace period")
+	assert.Equal(t, 120, podGracePeriod(shortPreStopPod, 120), "expected grace period never to be shortened")
+
+	MaxPreStopGracePeriod = 4 * time.Minute
+	assert.Equal(t, 240, podGracePeriod(preStopPod, 120), "expected grace period to be capped")
+	assert.Equal(t, -1, podGracePeriod(preStopPod, -1), "expected the pod's own grace period when not overridden")
+
+	MaxPreStopGracePeriod = 0
+}
+
+func TestPodTerminationWait(t *testing.T) {
+	pod := createTestPod("pod", 300, false)
+	assert.Equal(t, 60, podTerminationWait(pod, 60, 120), "expected the overridden grace period")
+	assert.Equal(t, 120, podTerminationWait(pod, -1, 120), "expected the wait to be capped")
+	assert.Equal(t, 300, podTerminationWait(pod, -1, 600), "expected the pod's own grace period")
+
+	pod.Spec.TerminationGracePeriodSeconds = nil
+	assert.Equal(t, apiv1.DefaultTerminationGracePeriodSeconds, podTerminationWait(pod, -1, 120), "expected the default grace period")
+}
+
+func TestEvictPodGracePeriod(t *testing.T) {
+	pod := createTestPod("pod1", 300, false)
+	var gracePeriod *int64
+	fakeClient := fake.NewSimpleClientset()
+	fakeClient.PrependReactor("create", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		gracePeriod = action.(core.CreateAction).GetObject().(*policyv1.Eviction).DeleteOptions.GracePeriodSeconds
+		return true, nil, nil
+	})
+
+	_, err := evictPod(pod, fakeClient, kube_record.NewFakeRecorder(10), 60, time.Now(), time.Millisecond)
+	assert.NoError(t, err)
+	if assert.NotNil(t, gracePeriod, "expected the grace period to be overridden") {
+		assert.Equal(t, int64(60), *gracePeriod)
+	}
+
+	_, err = evictPod(pod, fakeClient, kube_record.NewFakeRecorder(10), -1, time.Now(), time.Millisecond)
+	assert.NoError(t, err)
+	assert.Nil(t, gracePeriod, "expected the pod's own grace period to be left in place")
+}
+
+func TestEvictPodGone(t *testing.T) {
+	node := &apiv1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}
+	pod := createTestPod("pod1", 30, false)
+	evictions := 0
+	fakeClient := fake.NewSimpleClientset(node)
+	fakeClient.PrependReactor("create", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		evictions++
+		return true, nil, errors.NewNotFound(schema.GroupResource{Resource: "pods"}, pod.Name)
+	})
+
+	// Pods which have already gone don't need evicting, so aren't retried
+	gone, err := evictPod(pod, fakeClient, kube_record.NewFakeRecorder(10), 30, time.Now().Add(time.Second), time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, gone)
+	assert.Equal(t, 1, evictions)
+
+	// Nor do they fail a drain
+	assert.NoError(t, DrainNode(node, []*apiv1.Pod{pod}, fakeClient, kube_record.NewFakeRecorder(100), 30, 30, time.Second, time.Millisecond, nil))
+	assert.NoError(t, DrainNode(node, []*apiv1.Pod{pod}, fakeClient, kube_record.NewFakeRecorder(100), 30, 30, time.Second, time.Millisecond, func([]*apiv1.Pod) error { return nil }))
+}
+
+func TestDrainNodeWithPlacementCheck(t *testing.T) {
+	node := &apiv1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}
+	pods := []*apiv1.Pod{
+		createTestPod("pod1", 30, false),
+		createTestPod("pod2", 30, false),
+		createTestPod("pod3", 30, false),
+	}
+
+	fakeClient, evicted := createFakeDrainClient(node)
+	recorder := kube_record.NewFakeRecorder(100)
+
+	checked := make([]int, 0)
+	check := func(remaining []*apiv1.Pod) error {
+		checked = append(checked, len(remaining))
+		if len(remaining) < 3 {
+			return fmt.Errorf("no space left")
+		}
+		return nil
+	}
+
+	err := DrainNode(node, pods, fakeClient, recorder, 30, 30, time.Second, time.Millisecond, check)
+	assert.Error(t, err, "expected the drain to be aborted")
+	assert.Equal(t, DrainReasonPlacement, DrainFailureReason(err))
+	assert.Equal(t, []string{"pod1"}, *evicted, "expected only the first pod to be evicted")
+	assert.Equal(t, []int{2}, checked)
+
+	// All pods are evicted when the check passes
+	fakeClient, evicted = createFakeDrainClient(node)
+	err = DrainNode(node, pods, fakeClient, recorder, 30, 30, time.Second, time.Millisecond, func([]*apiv1.Pod) error { return nil })
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"pod1", "pod2", "pod3"}, *evicted)
+}
+
+func TestDrainNodeConcurrency(t *testing.T) {
+	DrainConcurrency = 2
+	defer func() { DrainConcurrency = 0 }()
+
+	node := &apiv1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}
+	pods := make([]*apiv1.Pod, 0)
+	for i := 0; i < 6; i++ {
+		pods = append(pods, createTestPod(fmt.Sprintf("pod%d", i), 30, false))
+	}
+
+	// The fake client handles one action at a time, so the evictions which have
+	// started are counted by the limiter shared by all drains
+	maxRunning := 0
+	fakeClient, _ := createFakeDrainClient(node)
+	fakeClient.PrependReactor("create", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		time.Sleep(5 * time.Millisecond)
+		inflightEvictions.mu.Lock()
+		if inflightEvictions.inflight > maxRunning {
+			maxRunning = inflightEvictions.inflight
+		}
+		inflightEvictions.mu.Unlock()
+		if action.(core.CreateAction).GetObject().(*policyv1.Eviction).Name == "pod3" {
+			return true, nil, fmt.Errorf("boom")
+		}
+		return true, nil, nil
+	})
+
+	err := DrainNode(node, pods, fakeClient, kube_record.NewFakeRecorder(100), 30, 30, 0, time.Millisecond, nil)
+	assert.Equal(t, 2, maxRunning, "expected at most 2 evictions in flight")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "pod3")
+	}
+}
+
+func TestEvictionRetryWait(t *testing.T) {
+	retryUntil := time.Now().Add(time.Hour)
+	tooManyRequests := errors.NewTooManyRequests("Cannot evict pod as it would violate the pod's disruption budget.", 0)
+
+	// Budget violations back off exponentially up to the maximum
+	assert.Equal(t, 20*time.Second, evictionRetryWait(tooManyRequests, 10*time.Second, 10*time.Second, retryUntil))
+	assert.Equal(t, 80*time.Second, evictionRetryWait(tooManyRequests, 40*time.Second, 10*time.Second, retryUntil))
+	assert.Equal(t, maxEvictionBackoff, evictionRetryWait(tooManyRequests, 80*time.Second, 10*time.Second, retryUntil))
+
+	// Other errors are retried after the fixed wait
+	assert.Equal(t, 10*time.Second, evictionRetryWait(fmt.Errorf("boom"), 80*time.Second, 10*time.Second, retryUntil))
+
+	// The wait never runs past the deadline
+	wait := evictionRetryWait(tooManyRequests, 80*time.Second, 10*time.Second, time.Now().Add(30*time.Second))
+	assert.True(t, wait <= 30*time.Second, "expected the wait to be cut short, got %s", wait)
+}
+
+func TestDrainFailureReason(t *testing.T) {
+	pod := createTestPod("pod1", 30, false)
+	tooManyRequests := errors.NewTooManyRequests("Cannot evict pod as it would violate the pod's disruption budget.", 0)
+	nodeGone := errors.NewNotFound(schema.GroupResource{Resource: "nodes"}, "node1")
+
+	assert.Equal(t, DrainReasonNodeGone, DrainFailureReason(nodeGone))
+	assert.Equal(t, DrainReasonAPIError, DrainFailureReason(fmt.Errorf("boom")))
+	assert.Equal(t, DrainReasonTimeout, DrainFailureReason(&DrainError{Reason: DrainReasonTimeout, Err: fmt.Errorf("boom")}))
+
+	// Evictions refused by a budget are put down to it, even with other failures
+	assert.Equal(t, DrainReasonPDB, evictionFailureReason([]error{
+		&podEvictionError{pod: pod, last: fmt.Errorf("boom")},
+		&podEvictionError{pod: pod, last: tooManyRequests},
+	}))
+	assert.Equal(t, DrainReasonTimeout, evictionFailureReason([]error{&podEvictionError{pod: pod, last: errors.NewServerTimeout(schema.GroupResource{Resource: "pods"}, "create", 0)}}))
+	assert.Equal(t, DrainReasonAPIError, evictionFailureReason([]error{&podEvictionError{pod: pod, last: fmt.Errorf("boom")}}))
+}
+
+func TestDetectEvictionVersion(t *testing.T) {
+	fakeDiscovery := fake.NewSimpleClientset().Discovery().(*fakediscovery.FakeDiscovery)
+	fakeDiscovery.Resources = []*metav1.APIResourceList{{
+		GroupVersion: "v1",
+		APIResources: []metav1.APIResource{{Name: "pods"}, {Name: "pods/eviction", Group: "policy", Version: "v1beta1"}},
+	}}
+	version, err := DetectEvictionVersion(fakeDiscovery)
+	assert.NoError(t, err)
+	assert.Equal(t, EvictionVersionV1beta1, version)
+
+	fakeDiscovery.Resources[0].APIResources[1].Version = "v1"
+	version, err = DetectEvictionVersion(fakeDiscovery)
+	assert.NoError(t, err)
+	assert.Equal(t, EvictionVersionV1, version)
+
+	// Older API servers don't report the version of subresources
+	fakeDiscovery.Resources[0].APIResources[1] = metav1.APIResource{Name: "pods/eviction"}
+	version, err = DetectEvictionVersion(fakeDiscovery)
+	assert.NoError(t, err)
+	assert.Equal(t, EvictionVersionV1beta1, version)
+
+	_, err = DetectEvictionVersion(fake.NewSimpleClientset().Discovery())
+	assert.Error(t, err)
+}
+
+func TestEvictV1(t *testing.T) {
+	var path string
+	var received map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&received)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"kind": "Status", "apiVersion": "v1", "status": "Success"}`))
+	}))
+	defer server.Close()
+
+	client, err := kube_client.NewForConfig(&rest.Config{Host: server.URL})
+	assert.NoError(t, err)
+
+	EvictionVersion = EvictionVersionV1
+	defer func() { EvictionVersion = EvictionVersionV1beta1 }()
+
+	grace := int64(30)
+	eviction := &policyv1.Eviction{
+		ObjectMeta:    metav1.ObjectMeta{Namespace: "default", Name: "pod1"},
+		DeleteOptions: &metav1.DeleteOptions{GracePeriodSeconds: &grace},
+	}
+	assert.NoError(t, evict(client, eviction))
+	assert.Equal(t, "/api/v1/namespaces/default/pods/pod1/eviction", path)
+	assert.Equal(t, "policy/v1", received["apiVersion"])
+	assert.Equal(t, "Eviction", received["kind"])
+	assert.Equal(t, "", eviction.APIVersion, "expected the eviction to be left unchanged")
+}
+
+func TestWaitForReplacementsReady(t *testing.T) {
+	replacementPollInterval = time.Millisecond
+	defer func() { replacementPollInterval = 5 * time.Second }()
+
+	node := &apiv1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}
+	controller := true
+	owned := func(name, nodeName string, ready bool) *apiv1.Pod {
+		pod := createTestPod(name, 30, false)
+		pod.UID = types.UID(name)
+		pod.Spec.NodeName = nodeName
+		pod.OwnerReferences = []metav1.OwnerReference{
+			{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "web", UID: "web", Controller: &controller},
+		}
+		status := apiv1.ConditionFalse
+		if ready {
+			status = apiv1.ConditionTrue
+		}
+		pod.Status.Conditions = []apiv1.PodCondition{{Type: apiv1.PodReady, Status: status}}
+		return pod
+	}
+	evicted := []*apiv1.Pod{owned("old1", "node1", true), owned("old2", "node1", true)}
+
+	// Only one of the replacements is Ready
+	fakeClient := fake.NewSimpleClientset(owned("new1", "spot1", true), owned("new2", "spot1", false))
+	assert.False(t, waitForReplacementsReady(node, evicted, fakeClient, time.Now().Add(10*time.Millisecond)))
+
+	// The evicted pods themselves, and pods still on the node, aren't replacements
+	fakeClient = fake.NewSimpleClientset(evicted[0], owned("new1", "spot1", true), owned("new2", "node1", true))
+	assert.False(t, waitForReplacementsReady(node, evicted, fakeClient, time.Now().Add(10*time.Millisecond)))
+
+	fakeClient = fake.NewSimpleClientset(owned("new1", "spot1", true), owned("new2", "spot2", true))
+	assert.True(t, waitForReplacementsReady(node, evicted, fakeClient, time.Now().Add(10*time.Millisecond)))
+
+	// Pods without a controller have nothing to wait for
+	assert.True(t, waitForReplacementsReady(node, []*apiv1.Pod{createTestPod("plain", 30, false)}, fake.NewSimpleClientset(), time.Now()))
+}
+
+func TestWaitForReplacements(t *testing.T) {
+	replacementPollInterval = time.Millisecond
+	defer func() { replacementPollInterval = 5 * time.Second }()
+
+	node := &apiv1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}
+	controller := true
+	evicted := createTestPod("old1", 30, false)
+	evicted.OwnerReferences = []metav1.OwnerReference{
+		{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "web", UID: "web", Controller: &controller},
+	}
+	recorder := kube_record.NewFakeRecorder(10)
+
+	assert.NoError(t, waitForReplacements(node, []*apiv1.Pod{evicted}, fake.NewSimpleClientset(), recorder), "expected no wait when disabled")
+
+	ReplacementReadyTimeout = 10 * time.Millisecond
+	defer func() { ReplacementReadyTimeout = 0 }()
+	err := waitForReplacements(node, []*apiv1.Pod{evicted}, fake.NewSimpleClientset(), recorder)
+	if assert.IsType(t, &ReplacementsNotReadyError{}, err) {
+		assert.Equal(t, "node1", err.(*ReplacementsNotReadyError).Node)
+	}
+}
+
+func TestOwnerKind(t *testing.T) {
+	pod := createTestPod("pod1", 30, false)
+	assert.Equal(t, "None", ownerKind(pod))
+
+	controller := true
+	pod.OwnerReferences = []metav1.OwnerReference{
+		{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "web", Controller: &controller},
+	}
+	assert.Equal(t, "ReplicaSet", ownerKind(pod))
+}
+
+func TestDeletePods(t *testing.T) {
+	pods := []*apiv1.Pod{
+		createTestPod("ds1", 30, false),
+		createTestPod("ds2", 30, false),
+	}
+	recorder := kube_record.NewFakeRecorder(100)
+
+	// The DaemonSet recreates the pods straight away, so a pod must only be
+	// deleted once and never evicted
+	deleted := make([]string, 0)
+	fakeClient := fake.NewSimpleClientset()
+	fakeClient.PrependReactor("delete", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		deleted = append(deleted, action.(core.DeleteAction).GetName())
+		return true, nil, nil
+	})
+	fakeClient.PrependReactor("create", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() == "eviction" {
+			t.Errorf("unexpected eviction of pod %s", action.(core.CreateAction).GetObject().(*policyv1.Eviction).Name)
+		}
+		return true, nil, nil
+	})
+
+	err := DeletePods(pods, fakeClient, recorder, 30)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ds1", "ds2"}, deleted)
+
+	// Pods which have already gone aren't an error, but other failures are
+	fakeClient = fake.NewSimpleClientset()
+	fakeClient.PrependReactor("delete", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		name := action.(core.DeleteAction).GetName()
+		if name == "ds1" {
+			return true, nil, errors.NewNotFound(schema.GroupResource{Resource: "pods"}, name)
+		}
+		return true, nil, fmt.Errorf("boom")
+	})
+	err = DeletePods(pods, fakeClient, recorder, 30)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "ds2")
+	assert.NotContains(t, err.Error(), "ds1")
+}
+
+func TestEvictionLimiter(t *testing.T) {
+	limiter := newEvictionLimiter()
+
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			limiter.acquire(2)
+			mu.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mu.Unlock()
+
+			time.Sleep(5 * time.Millisecond)
+
+			mu.Lock()
+			running--
+			mu.Unlock()
+			limiter.release()
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 2, maxRunning, "expected at most 2 evictions in flight")
+	assert.Equal(t, 0, limiter.inflight)
+}
+
+func createFakeDrainClient(node *apiv1.Node) (*fake.Clientset, *[]string) {
+	evicted := make([]string, 0)
+	fakeClient := fake.NewSimpleClientset(node)
+	fakeClient.PrependReactor("create", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		eviction := action.(core.CreateAction).GetObject().(*policyv1.Eviction)
+		evicted = append(evicted, eviction.Name)
+		return true, nil, nil
+	})
+	// Evicted pods are gone straight away
+	fakeClient.PrependReactor("get", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		name := action.(core.GetAction).GetName()
+		return true, nil, errors.NewNotFound(schema.GroupResource{Resource: "pods"}, name)
+	})
+	return fakeClient, &evicted
+}
+
+func createTestPod(name string, gracePeriodSec int64, preStop bool) *apiv1.Pod {
+	container := apiv1.Container{Name: "test"}
+	if preStop {
+		container.Lifecycle = &apiv1.Lifecycle{
+			PreStop: &apiv1.Handler{
+				Exec: &apiv1.ExecAction{Command: []string{"sleep", "10"}},
+			},
+		}
+	}
+	return &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "kube-system",
+			Name:      name,
+		},
+		Spec: apiv1.PodSpec{
+			TerminationGracePeriodSeconds: &gracePeriodSec,
+			Containers:                    []apiv1.Container{container},
+		},
+	}
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2017 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Returns a channel which is closed when SIGTERM or SIGINT is received, so the
+// main loop can stop once the current housekeeping cycle finishes. If it
+// hasn't exited within the grace period, or a second signal is received, the
+// process exits straight away.
+func handleShutdownSignals(gracePeriod time.Duration) <-chan struct{} {
+	shutdown := make(chan struct{})
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		sig := <-signals
+		glog.Infof("Received %s, shutting down once the current housekeeping cycle finishes.", sig)
+		close(shutdown)
+
+		select {
+		case <-time.After(gracePeriod):
+			glog.Errorf("Shutdown grace period of %s expired, exiting.", gracePeriod)
+		case sig = <-signals:
+			glog.Errorf("Received %s again, exiting.", sig)
+		}
+		glog.Flush()
+		os.Exit(1)
+	}()
+	return shutdown
+}
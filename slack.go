@@ -0,0 +1,99 @@
+/*
+Copyright 2017 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	slackColorSuccess = "good"
+	slackColorFailure = "danger"
+)
+
+// slackMessage is the payload accepted by a Slack Incoming Webhook.
+type slackMessage struct {
+	Text        string            `json:"text"`
+	Attachments []slackAttachment `json:"attachments,omitempty"`
+}
+
+type slackAttachment struct {
+	Color string `json:"color"`
+	Text  string `json:"text"`
+}
+
+// slackPublisher posts a summary of each drain event to a Slack Incoming
+// Webhook.
+type slackPublisher struct {
+	url    string
+	client *http.Client
+}
+
+func newSlackPublisher(url string) *slackPublisher {
+	return &slackPublisher{url: url, client: &http.Client{Timeout: publishTimeout}}
+}
+
+func (p *slackPublisher) Publish(event drainEvent) error {
+	body, err := json.Marshal(newSlackMessage(event))
+	if err != nil {
+		return fmt.Errorf("failed to encode slack message: %v", err)
+	}
+	resp, err := p.client.Post(p.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to post drain of node %s to slack: %v", event.Node, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("failed to post drain of node %s to slack: status %s", event.Node, resp.Status)
+	}
+	return nil
+}
+
+// Builds the Slack message summarising a drain event.
+func newSlackMessage(event drainEvent) slackMessage {
+	targets := make(map[string]bool)
+	for _, target := range event.Pods {
+		targets[target] = true
+	}
+	spotNodes := make([]string, 0, len(targets))
+	for target := range targets {
+		spotNodes = append(spotNodes, target)
+	}
+	sort.Strings(spotNodes)
+
+	details := fmt.Sprintf("Pods: %d\nSpot nodes: %s", len(event.Pods), strings.Join(spotNodes, ", "))
+	if event.Outcome != drainOutcomeSuccess {
+		return slackMessage{
+			Text: fmt.Sprintf(":x: Failed to drain node %s", event.Node),
+			Attachments: []slackAttachment{
+				{Color: slackColorFailure, Text: fmt.Sprintf("%s\nError: %s", details, event.Error)},
+			},
+		}
+	}
+	return slackMessage{
+		Text: fmt.Sprintf(":white_check_mark: Drained node %s", event.Node),
+		Attachments: []slackAttachment{
+			{Color: slackColorSuccess, Text: details},
+		},
+	}
+}
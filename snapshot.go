@@ -0,0 +1,86 @@
+/*
+Copyright 2017 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pusher/k8s-spot-rescheduler/metrics"
+	"github.com/pusher/k8s-spot-rescheduler/nodes"
+	apiv1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1beta1"
+)
+
+// clusterSnapshot is the state of the cluster seen by a housekeeping cycle.
+// A new snapshot is built every cycle, so a snapshot is never modified after
+// it has been stored.
+type clusterSnapshot struct {
+	allNodes []*apiv1.Node
+	nodeMap  nodes.Map
+	pdbs     []*policyv1.PodDisruptionBudget
+}
+
+// snapshotStore holds the latest cluster snapshot for the metrics loop.
+type snapshotStore struct {
+	mutex    sync.Mutex
+	snapshot *clusterSnapshot
+}
+
+func (s *snapshotStore) set(snapshot *clusterSnapshot) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.snapshot = snapshot
+}
+
+func (s *snapshotStore) get() *clusterSnapshot {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.snapshot
+}
+
+// Updates the metrics system with the state of the cluster in the snapshot.
+func updateClusterMetrics(snapshot *clusterSnapshot) {
+	metrics.UpdateNodesMap(snapshot.nodeMap)
+	updateSpotNodeMetrics(snapshot.nodeMap[nodes.Spot], snapshot.pdbs)
+	updateDrainSkippedMetrics(snapshot.nodeMap[nodes.OnDemand])
+
+	summary := summarizeTopology(snapshot.allNodes, snapshot.nodeMap, snapshot.pdbs)
+	metrics.UpdateTopology(summary.unclassifiedNodes, summary.movablePods)
+	metrics.UpdateMinNodesEstimate(minNodesEstimate(snapshot.nodeMap))
+	metrics.UpdateUnmatchedNodeLabels(summary.onDemandNodes == 0, summary.spotNodes == 0)
+}
+
+// Updates the cluster metrics from the latest snapshot every interval, so
+// that the housekeeping cycle doesn't wait for them.
+func runMetricsLoop(store *snapshotStore, interval time.Duration, stopChannel <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if snapshot := store.get(); snapshot != nil {
+				func() {
+					defer recoverReconcile()
+					updateClusterMetrics(snapshot)
+				}()
+			}
+		case <-stopChannel:
+			return
+		}
+	}
+}
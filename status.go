@@ -0,0 +1,56 @@
+/*
+Copyright 2017 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// statusReport collects what the rescheduler has done between status reports.
+type statusReport struct {
+	onDemandNodes   int
+	spotNodes       int
+	podsMoved       int
+	drainsSucceeded int
+	drainsFailed    int
+}
+
+// recordDrain counts a drain and the pods it moved.
+func (r *statusReport) recordDrain(pods int, err error) {
+	if err != nil {
+		r.drainsFailed++
+		return
+	}
+	r.drainsSucceeded++
+	r.podsMoved += pods
+}
+
+// write prints the report and resets the counters for the next report.
+func (r *statusReport) write(out io.Writer, nextDrainTime time.Time, now time.Time) {
+	cooldown := time.Duration(0)
+	if nextDrainTime.After(now) {
+		cooldown = nextDrainTime.Sub(now).Round(time.Second)
+	}
+	fmt.Fprintf(out, "Status: on-demand nodes: %d, spot nodes: %d, pods moved: %d, drains succeeded: %d, drains failed: %d, cooldown remaining: %s\n",
+		r.onDemandNodes, r.spotNodes, r.podsMoved, r.drainsSucceeded, r.drainsFailed, cooldown)
+
+	r.podsMoved = 0
+	r.drainsSucceeded = 0
+	r.drainsFailed = 0
+}
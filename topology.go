@@ -0,0 +1,140 @@
+/*
+Copyright 2017 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/pusher/k8s-spot-rescheduler/nodes"
+	apiv1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1beta1"
+)
+
+// topologySummary describes the cluster as understood by the rescheduler.
+type topologySummary struct {
+	onDemandNodes     int
+	spotNodes         int
+	unclassifiedNodes int
+	movablePods       int
+}
+
+// Works out how many nodes fall into each category and how many pods on the
+// on-demand nodes could be moved.
+func summarizeTopology(allNodes []*apiv1.Node, nodeMap nodes.Map, pdbs []*policyv1.PodDisruptionBudget) topologySummary {
+	summary := topologySummary{
+		onDemandNodes: len(nodeMap[nodes.OnDemand]),
+		spotNodes:     len(nodeMap[nodes.Spot]),
+	}
+	summary.unclassifiedNodes = len(allNodes) - summary.onDemandNodes - summary.spotNodes
+
+	for _, nodeInfo := range nodeMap[nodes.OnDemand] {
+		podsForDeletion, err := getPodsForDeletion(nodeInfo, pdbs)
+		if err != nil {
+			continue
+		}
+		summary.movablePods += len(podsForDeletion)
+	}
+	return summary
+}
+
+// log prints the summary along with the configuration used to classify nodes.
+func (t topologySummary) log() {
+	glog.Infof("Cluster topology: on_demand_nodes=%d spot_nodes=%d unclassified_nodes=%d movable_pods=%d on_demand_node_label=%q spot_node_label=%q exclude_target_selector=%q",
+		t.onDemandNodes, t.spotNodes, t.unclassifiedNodes, t.movablePods,
+		nodes.OnDemandNodeLabel, nodes.SpotNodeLabel, *excludeTargetSelector)
+}
+
+// How many nodes' labels are included in the unmatched label warning.
+const labelSampleSize = 3
+
+// Warns when no nodes match the on-demand or spot node label, which usually
+// means the labels configured don't match the cluster, listing the labels
+// found on a few nodes to help fix the configuration.
+func (t topologySummary) warnUnmatchedLabels(allNodes []*apiv1.Node) {
+	if t.onDemandNodes > 0 && t.spotNodes > 0 {
+		return
+	}
+
+	samples := make([]string, 0, labelSampleSize)
+	for _, node := range allNodes {
+		if len(samples) == labelSampleSize {
+			break
+		}
+		samples = append(samples, fmt.Sprintf("%s: {%s}", node.Name, formatLabels(node.Labels)))
+	}
+
+	if t.onDemandNodes == 0 {
+		glog.Warningf("No nodes match the on-demand node label %q, nothing will be drained. Check --on-demand-node-label matches your nodes. Sample node labels: %s",
+			nodes.OnDemandNodeLabel, strings.Join(samples, "; "))
+	}
+	if t.spotNodes == 0 {
+		glog.Warningf("No nodes match the spot node label %q, no pods can be moved. Check --spot-node-label matches your nodes. Sample node labels: %s",
+			nodes.SpotNodeLabel, strings.Join(samples, "; "))
+	}
+}
+
+// Checks that at least one node is on-demand and one is spot, returning an
+// error naming the flag which matches no nodes.
+func checkNodeLabels(allNodes []*apiv1.Node) error {
+	onDemand, spot := false, false
+	for _, node := range allNodes {
+		if nodes.IsSpot(node) {
+			spot = true
+		} else if nodes.IsOnDemand(node) {
+			onDemand = true
+		}
+	}
+	if !onDemand {
+		return fmt.Errorf("no nodes match the on-demand node label %q, check --on-demand-node-label", nodes.OnDemandNodeLabel)
+	}
+	if !spot {
+		return fmt.Errorf("no nodes match the spot node label %q, check --spot-node-label", nodes.SpotNodeLabel)
+	}
+	return nil
+}
+
+// Formats labels as a sorted, comma separated list of key=value pairs.
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+// Estimates the fewest nodes which could host the pods on the classified nodes,
+// if their CPU requests were perfectly packed onto nodes as large as the
+// largest existing node. This is a lower bound; real packing needs more nodes.
+func minNodesEstimate(nodeMap nodes.Map) int {
+	var requested, largest int64
+	for _, nodeType := range []nodes.NodeType{nodes.OnDemand, nodes.Spot} {
+		for _, nodeInfo := range nodeMap[nodeType] {
+			requested += nodeInfo.RequestedCPU
+			if allocatable := nodeInfo.Node.Status.Allocatable.Cpu().MilliValue(); allocatable > largest {
+				largest = allocatable
+			}
+		}
+	}
+	if largest < 1 {
+		return 0
+	}
+	return int((requested + largest - 1) / largest)
+}
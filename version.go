@@ -1,4 +1,30 @@
 package main
 
+import (
+	"encoding/json"
+	"net/http"
+)
+
 // VERSION contains injected version information
 var VERSION = "undefined"
+
+// gitCommit contains the injected commit the binary was built from
+var gitCommit = "undefined"
+
+// buildDate contains the injected time the binary was built
+var buildDate = "undefined"
+
+// versionInfo describes the running build.
+type versionInfo struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"gitCommit"`
+	BuildDate string `json:"buildDate"`
+}
+
+// Serves the build information as JSON.
+func newVersionHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(versionInfo{Version: VERSION, GitCommit: gitCommit, BuildDate: buildDate})
+	})
+}
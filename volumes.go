@@ -0,0 +1,72 @@
+/*
+Copyright 2017 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/pusher/k8s-spot-rescheduler/nodes"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kube_client "k8s.io/client-go/kubernetes"
+	volumeutil "k8s.io/kubernetes/pkg/volume/util"
+)
+
+// Returns an error if any of the pods use a PersistentVolume whose node
+// affinity none of the spot nodes satisfy, such as a local volume on the
+// on-demand node, as the pod could never start anywhere it is moved to. Which
+// spot node each pod can move to is left to the scheduler's volume predicates.
+func checkVolumeNodeAffinity(kubeClient kube_client.Interface, pods []*apiv1.Pod, spotNodeInfos nodes.NodeInfoArray) error {
+	for _, pod := range pods {
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim == nil {
+				continue
+			}
+			pv, err := getBoundVolume(kubeClient, pod.Namespace, volume.PersistentVolumeClaim.ClaimName)
+			if err != nil {
+				return fmt.Errorf("failed to check volume %s of pod %s: %v", volume.Name, podID(pod), err)
+			}
+			if pv == nil || fitsAnyNode(pv, spotNodeInfos) {
+				continue
+			}
+			return fmt.Errorf("pod %s uses PersistentVolume %s, which no spot node satisfies the node affinity of", podID(pod), pv.Name)
+		}
+	}
+	return nil
+}
+
+// Gets the PersistentVolume bound to the claim, or nil if it isn't bound yet.
+func getBoundVolume(kubeClient kube_client.Interface, namespace string, claimName string) (*apiv1.PersistentVolume, error) {
+	pvc, err := kubeClient.CoreV1().PersistentVolumeClaims(namespace).Get(claimName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if pvc.Spec.VolumeName == "" {
+		return nil, nil
+	}
+	return kubeClient.CoreV1().PersistentVolumes().Get(pvc.Spec.VolumeName, metav1.GetOptions{})
+}
+
+// Determines if any of the nodes satisfy the volume's node affinity.
+func fitsAnyNode(pv *apiv1.PersistentVolume, nodeInfos nodes.NodeInfoArray) bool {
+	for _, nodeInfo := range nodeInfos {
+		if volumeutil.CheckNodeAffinity(pv, nodeInfo.Node.Labels) == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2017 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// weekdays maps the abbreviations accepted in active windows to weekdays.
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// activeWindow is the daily time range in which draining is allowed,
+// optionally only on some days of the week.
+type activeWindow struct {
+	// start and end are minutes since midnight. Windows with an end before
+	// their start run past midnight.
+	start int
+	end   int
+	// days the window starts on, every day if nil.
+	days     map[time.Weekday]bool
+	location *time.Location
+}
+
+// Parses an active window of the form [<day>[-<day>] ]HH:MM-HH:MM, such as
+// "09:00-17:00" or "Mon-Fri 09:00-17:00", in the named time zone. An empty
+// window returns nil, allowing draining at any time.
+func parseActiveWindow(window string, timezone string) (*activeWindow, error) {
+	if window == "" {
+		return nil, nil
+	}
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("the time zone %s is not valid: %v", timezone, err)
+	}
+
+	w := &activeWindow{location: location}
+	fields := strings.Fields(window)
+	switch len(fields) {
+	case 1:
+	case 2:
+		w.days, err = parseWeekdays(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("the active window is not valid: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("the active window is not valid: expected [<day>[-<day>] ]HH:MM-HH:MM, but got %s", window)
+	}
+
+	times := strings.SplitN(fields[len(fields)-1], "-", 2)
+	if len(times) != 2 {
+		return nil, fmt.Errorf("the active window is not valid: expected [<day>[-<day>] ]HH:MM-HH:MM, but got %s", window)
+	}
+	if w.start, err = parseTimeOfDay(times[0]); err != nil {
+		return nil, fmt.Errorf("the active window is not valid: %v", err)
+	}
+	if w.end, err = parseTimeOfDay(times[1]); err != nil {
+		return nil, fmt.Errorf("the active window is not valid: %v", err)
+	}
+	if w.start == w.end {
+		return nil, fmt.Errorf("the active window is not valid: it starts and ends at %s", times[0])
+	}
+	return w, nil
+}
+
+// Parses a time of day of the form HH:MM into minutes since midnight.
+func parseTimeOfDay(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("expected a time of the form HH:MM, but got %s", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Parses a day, such as "Mon", or an inclusive range of days, such as
+// "Mon-Fri" or "Fri-Mon".
+func parseWeekdays(value string) (map[time.Weekday]bool, error) {
+	parts := strings.SplitN(strings.ToLower(value), "-", 2)
+	first, ok := weekdays[parts[0]]
+	if !ok {
+		return nil, fmt.Errorf("expected a day such as Mon, but got %s", parts[0])
+	}
+	last := first
+	if len(parts) == 2 {
+		if last, ok = weekdays[parts[1]]; !ok {
+			return nil, fmt.Errorf("expected a day such as Fri, but got %s", parts[1])
+		}
+	}
+
+	days := make(map[time.Weekday]bool)
+	for day := first; ; day = (day + 1) % 7 {
+		days[day] = true
+		if day == last {
+			break
+		}
+	}
+	return days, nil
+}
+
+// Determines if draining is allowed at the time. A window which runs past
+// midnight belongs to the day it starts on.
+func (w *activeWindow) contains(now time.Time) bool {
+	now = now.In(w.location)
+	minute := now.Hour()*60 + now.Minute()
+	day := now.Weekday()
+
+	if w.start < w.end {
+		return minute >= w.start && minute < w.end && w.onDay(day)
+	}
+	if minute >= w.start {
+		return w.onDay(day)
+	}
+	return minute < w.end && w.onDay((day+6)%7)
+}
+
+func (w *activeWindow) onDay(day time.Weekday) bool {
+	return w.days == nil || w.days[day]
+}